@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// --- Content-Addressed Rewrite Cache ---
+
+// contentCache is a size-bounded, content-addressed cache for rewritten bodies.
+// Entries are evicted oldest first once maxBytes is exceeded. Each entry records
+// the sites (see cacheSite) it was used for, so forgetting a site can drop them.
+type contentCache struct {
+	mu        sync.Mutex
+	entries   map[string][]byte
+	sites     map[string]map[string]bool // Key -> sites that used the entry
+	order     []string                   // Insertion order, oldest first
+	sizeBytes int
+	maxBytes  int
+}
+
+func newContentCache(maxBytes int) *contentCache {
+	return &contentCache{entries: make(map[string][]byte), sites: make(map[string]map[string]bool), maxBytes: maxBytes}
+}
+
+// contentCacheKey derives a cache key from a variant label (e.g. the rewrite
+// settings that affect the output) and the original content.
+func contentCacheKey(variant string, content []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(variant))
+	hash.Write([]byte{0})
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *contentCache) Get(key string, site string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.entries[key]
+	if ok && site != "" {
+		c.sites[key][site] = true
+	}
+	return value, ok
+}
+
+func (c *contentCache) Put(key string, site string, value []byte) {
+	if len(value) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; exists {
+		return
+	}
+	c.entries[key] = value
+	c.sites[key] = make(map[string]bool)
+	if site != "" {
+		c.sites[key][site] = true
+	}
+	c.order = append(c.order, key)
+	c.sizeBytes += len(value)
+	for c.sizeBytes > c.maxBytes && len(c.order) > 0 {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.sizeBytes -= len(c.entries[oldest])
+		delete(c.entries, oldest)
+		delete(c.sites, oldest)
+	}
+}
+
+// Forget removes the entries used for site and returns how many were removed.
+func (c *contentCache) Forget(site string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	kept := c.order[:0]
+	for _, key := range c.order {
+		if !c.sites[key][site] {
+			kept = append(kept, key)
+			continue
+		}
+		c.sizeBytes -= len(c.entries[key])
+		delete(c.entries, key)
+		delete(c.sites, key)
+		removed++
+	}
+	c.order = kept
+	return removed
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// --- Content Classes ---
+//
+// The images, media, fonts, workers and forms preferences each block a class of
+// content. The generated CSP (see generateCSP) enforces them in the browser;
+// contentClassRewriter removes the elements that would only fail to load, and
+// puts placeholders where an image, video or audio player would have been.
+
+// blockedContentDataURL returns a placeholder image reading "<label> blocked".
+func blockedContentDataURL(label string) string {
+	return "data:image/svg+xml," + url.PathEscape(`<svg xmlns="http://www.w3.org/2000/svg" width="160" height="90" viewBox="0 0 160 90">`+
+		`<rect width="160" height="90" fill="#e5e7eb"/>`+
+		`<text x="80" y="50" font-family="sans-serif" font-size="12" fill="#4b5563" text-anchor="middle">`+label+` blocked</text></svg>`)
+}
+
+// placeholderKeptAttributes are the attributes a placeholder keeps from the element
+// it stands in for, so it takes the same place in the layout.
+var placeholderKeptAttributes = map[string]bool{
+	"id": true, "class": true, "style": true, "width": true, "height": true, "alt": true, "title": true,
+}
+
+// replaceWithBlockedPlaceholder turns n into an <img> showing the blocked
+// placeholder for label, dropping its children and every source attribute.
+func replaceWithBlockedPlaceholder(n *html.Node, label string) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		n.RemoveChild(c)
+		c = next
+	}
+	attrs := []html.Attribute{{Key: "src", Val: blockedContentDataURL(label)}}
+	hasAlt := false
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace == "" && placeholderKeptAttributes[key] {
+			attrs = append(attrs, attr)
+			hasAlt = hasAlt || key == "alt"
+		}
+	}
+	if !hasAlt {
+		attrs = append(attrs, html.Attribute{Key: "alt", Val: label + " blocked"})
+	}
+	n.Data = "img"
+	n.DataAtom = 0
+	n.Attr = attrs
+}
+
+// contentClassRewriter applies the content class preferences to the document.
+type contentClassRewriter struct{ RewriterBase }
+
+func (contentClassRewriter) Name() string { return "content-classes" }
+
+func (contentClassRewriter) OnNode(ctx *RewriteContext, n *html.Node) NodeAction {
+	prefs := ctx.Prefs
+	switch n.Data {
+	case "img":
+		if !prefs.ImagesEnabled {
+			replaceWithBlockedPlaceholder(n, "Image")
+		}
+	case "image": // SVG <image>
+		if !prefs.ImagesEnabled && n.Namespace == "svg" {
+			return NodeRemove
+		}
+	case "source":
+		if !prefs.ImagesEnabled && n.Parent != nil && n.Parent.Data == "picture" {
+			return NodeRemove
+		}
+	case "input":
+		if !prefs.ImagesEnabled && strings.EqualFold(nodeAttr(n, "type"), "image") {
+			setNodeAttr(n, "src", blockedContentDataURL("Image"))
+		}
+		if !prefs.FormsEnabled {
+			setNodeAttr(n, "disabled", "")
+		}
+	case "video", "audio":
+		if !prefs.MediaEnabled {
+			label := "Video"
+			if n.Data == "audio" {
+				label = "Audio"
+			}
+			replaceWithBlockedPlaceholder(n, label)
+			return NodeSkipChildren
+		}
+		if !prefs.ImagesEnabled {
+			removeNodeAttr(n, "poster")
+		}
+	case "link":
+		if contentClassBlocked(prefs, linkContentClass(n)) {
+			return NodeRemove
+		}
+	case "form":
+		if !prefs.FormsEnabled {
+			removeNodeAttr(n, "action")
+			setNodeAttr(n, "data-proxy-blocked", "form")
+		}
+	case "button", "select", "textarea":
+		if !prefs.FormsEnabled {
+			setNodeAttr(n, "disabled", "")
+		}
+	}
+	return NodeContinue
+}
+
+// linkContentClass returns the content class a <link> loads: "images" for icons
+// and image preloads, "fonts", "media" or "workers" for the matching preloads,
+// and "" for anything else.
+func linkContentClass(n *html.Node) string {
+	return linkRelContentClass(strings.Fields(strings.ToLower(nodeAttr(n, "rel"))), strings.ToLower(nodeAttr(n, "as")))
+}
+
+// linkRelContentClass is linkContentClass for the lower-case rel tokens and "as"
+// value of a <link> element or a Link header entry.
+func linkRelContentClass(rels []string, as string) string {
+	for _, rel := range rels {
+		switch rel {
+		case "icon", "apple-touch-icon", "apple-touch-icon-precomposed", "mask-icon", "apple-touch-startup-image":
+			return "images"
+		case "preload", "prefetch":
+			switch as {
+			case "image":
+				return "images"
+			case "font":
+				return "fonts"
+			case "audio", "video", "track":
+				return "media"
+			case "worker", "sharedworker", "serviceworker":
+				return "workers"
+			}
+		}
+	}
+	return ""
+}
+
+// contentClassBlocked reports whether prefs block a content class from linkContentClass.
+func contentClassBlocked(prefs sitePreferences, class string) bool {
+	switch class {
+	case "images":
+		return !prefs.ImagesEnabled
+	case "fonts":
+		return !prefs.FontsEnabled
+	case "media":
+		return !prefs.MediaEnabled
+	case "workers":
+		return !prefs.WorkersEnabled || !prefs.JavaScriptEnabled
+	}
+	return false
+}
+
+// setNodeAttr sets the attribute key on n, replacing any existing value.
+func setNodeAttr(n *html.Node, key string, val string) {
+	for i, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+func removeNodeAttr(n *html.Node, key string) {
+	kept := n.Attr[:0]
+	for _, attr := range n.Attr {
+		if !strings.EqualFold(attr.Key, key) {
+			kept = append(kept, attr)
+		}
+	}
+	n.Attr = kept
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// --- Server-Side Cookie Jar ---
+//
+// Upstream cookies never reach the browser, which only holds the proxy's own
+// session. They are kept per user in a jar that applies RFC 6265 storage and
+// domain/path matching for every target URL. Persistent cookies are saved to
+// the data directory, sealed with AES-GCM under a per-user key derived from
+// COOKIE_JAR_KEY; session cookies are held in memory only.
+
+const (
+	cookieJarStateFile     = "cookiejar.json"
+	maxCookiesPerUser      = 3000
+	maxCookiesPerDomain    = 180
+	maxScriptCookieBytes   = 4096
+	cookieJarFlushInterval = 10 * time.Second
+)
+
+// proxyCookieNames are the cookies the proxy itself sets on its origin, by
+// lower-case name.
+var proxyCookieNames = map[string]bool{
+	strings.ToLower(authCookieName): true,
+	"proxy-original-url":            true,
+	currentURLCookieName:            true,
+	incognitoCookieName:             true,
+	incognitoLoginCookieName:        true,
+}
+
+// isProxyCookie reports whether a browser cookie on the proxy origin belongs to the
+// proxy: one of proxyCookieNames, or a Cloudflare Access cookie relayed during login.
+func isProxyCookie(name string) bool {
+	lowerName := strings.ToLower(name)
+	return proxyCookieNames[lowerName] || strings.HasPrefix(lowerName, "cf_")
+}
+
+// isReservedCookieName reports whether a site may not use name: the proxy's own
+// cookies and the "proxy-" namespace.
+func isReservedCookieName(name string) bool {
+	lowerName := strings.ToLower(name)
+	return proxyCookieNames[lowerName] || strings.HasPrefix(lowerName, "proxy-")
+}
+
+// jarCookie is a stored cookie, as in RFC 6265 section 5.3.
+type jarCookie struct {
+	Name       string    `json:"name"`
+	Value      string    `json:"value"`
+	Domain     string    `json:"domain"`
+	Path       string    `json:"path"`
+	HostOnly   bool      `json:"hostOnly"`
+	Secure     bool      `json:"secure"`
+	HttpOnly   bool      `json:"httpOnly"`
+	SameSite   string    `json:"sameSite,omitempty"` // "strict", "lax", "none" or "" (unspecified)
+	Expires    time.Time `json:"expires"`            // Zero for session cookies
+	Created    time.Time `json:"created"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+func (c *jarCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *jarCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// userCookieJar holds one user's cookies by key.
+type userCookieJar struct {
+	cookies map[string]*jarCookie
+	dirty   bool // Persistent cookies changed since the last save
+}
+
+var (
+	cookieJarMu sync.Mutex
+	cookieJars  = make(map[string]*userCookieJar)
+	// Sealed persistent cookies per user, as last saved to cookieJarStateFile.
+	cookieJarSealed = make(map[string]string)
+
+	// cookieJarKey is the master key from COOKIE_JAR_KEY. Without one, the jar
+	// uses a random key and is not persisted.
+	cookieJarKey        []byte
+	cookieJarPersistent bool
+)
+
+// initCookieJar sets the jar's master key from secret, restores the saved jars
+// and starts saving changes in the background.
+func initCookieJar(secret string) {
+	if secret == "" {
+		cookieJarKey = make([]byte, 32)
+		if _, err := rand.Read(cookieJarKey); err != nil {
+			log.Fatalf("Error generating cookie jar key: %v", err)
+		}
+		log.Println("Warning: COOKIE_JAR_KEY not set. Site cookies are kept in memory only.")
+		return
+	}
+	sum := sha256.Sum256([]byte(secret))
+	cookieJarKey = sum[:]
+	cookieJarPersistent = dataDir != ""
+	if !cookieJarPersistent {
+		return
+	}
+
+	cookieJarMu.Lock()
+	if err := loadStateFile(cookieJarStateFile, &cookieJarSealed); err != nil {
+		log.Printf("Error loading cookie jar: %v", err)
+	}
+	now := time.Now()
+	for userID, sealed := range cookieJarSealed {
+		var cookies []*jarCookie
+		if err := openCookieJar(userID, sealed, &cookies); err != nil {
+			log.Printf("Error opening cookie jar of %s: %v. Discarding it.", userID, err)
+			delete(cookieJarSealed, userID)
+			continue
+		}
+		jar := cookieJarForLocked(userID)
+		for _, c := range cookies {
+			if !c.expired(now) {
+				jar.cookies[c.key()] = c
+			}
+		}
+	}
+	cookieJarMu.Unlock()
+
+	go func() {
+		for range time.Tick(cookieJarFlushInterval) {
+			saveCookieJars()
+		}
+	}()
+}
+
+// cookieJarUserKey derives the key sealing one user's cookies.
+func cookieJarUserKey(userID string) []byte {
+	mac := hmac.New(sha256.New, cookieJarKey)
+	mac.Write([]byte("cookiejar\n" + userID))
+	return mac.Sum(nil)
+}
+
+func cookieJarAEAD(userID string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cookieJarUserKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealCookieJar encrypts v as JSON for userID.
+func sealCookieJar(userID string, v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cookieJarAEAD(userID)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(userID))), nil
+}
+
+// openCookieJar decrypts a value from sealCookieJar into v.
+func openCookieJar(userID string, sealed string, v interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return err
+	}
+	aead, err := cookieJarAEAD(userID)
+	if err != nil {
+		return err
+	}
+	if len(data) < aead.NonceSize() {
+		return errors.New("sealed jar too short")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(userID))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// saveCookieJars seals the jars whose persistent cookies changed and saves them.
+func saveCookieJars() {
+	cookieJarMu.Lock()
+	defer cookieJarMu.Unlock()
+	changed := false
+	now := time.Now()
+	for userID, jar := range cookieJars {
+		if !jar.dirty || isIncognitoUserID(userID) {
+			continue
+		}
+		jar.dirty = false
+		changed = true
+		var persistent []*jarCookie
+		for _, c := range jar.cookies {
+			if !c.Expires.IsZero() && !c.expired(now) {
+				persistent = append(persistent, c)
+			}
+		}
+		if len(persistent) == 0 {
+			delete(cookieJarSealed, userID)
+			continue
+		}
+		sealed, err := sealCookieJar(userID, persistent)
+		if err != nil {
+			log.Printf("Error sealing cookie jar of %s: %v", userID, err)
+			continue
+		}
+		cookieJarSealed[userID] = sealed
+	}
+	if changed {
+		if err := saveStateFile(cookieJarStateFile, cookieJarSealed); err != nil {
+			log.Printf("Error saving cookie jar: %v", err)
+		}
+	}
+}
+
+// cookieJarForLocked returns userID's jar, creating it. cookieJarMu must be held.
+func cookieJarForLocked(userID string) *userCookieJar {
+	jar := cookieJars[userID]
+	if jar == nil {
+		jar = &userCookieJar{cookies: make(map[string]*jarCookie)}
+		cookieJars[userID] = jar
+	}
+	return jar
+}
+
+// markDirty records that a change to c must be saved.
+func (jar *userCookieJar) markDirty(c *jarCookie) {
+	if cookieJarPersistent && !c.Expires.IsZero() {
+		jar.dirty = true
+	}
+}
+
+// cookieDomainIsPublicSuffix reports whether domain is a public suffix ("com",
+// "co.uk", "github.io") by the Public Suffix List.
+func cookieDomainIsPublicSuffix(domain string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+// cookieDomainMatches implements domain-matching from RFC 6265 section 5.1.3.
+func cookieDomainMatches(host string, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+// cookieDefaultPath implements the default-path from RFC 6265 section 5.1.4.
+func cookieDefaultPath(requestPath string) string {
+	if !strings.HasPrefix(requestPath, "/") {
+		return "/"
+	}
+	lastSlash := strings.LastIndex(requestPath, "/")
+	if lastSlash == 0 {
+		return "/"
+	}
+	return requestPath[:lastSlash]
+}
+
+// cookiePathMatches implements path-matching from RFC 6265 section 5.1.4.
+func cookiePathMatches(requestPath string, cookiePath string) bool {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	if requestPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
+
+// storeCookie applies the storage model of RFC 6265 section 5.3 to a cookie
+// received from u, either in a Set-Cookie header or, with fromScript, through
+// document.cookie. It returns why the cookie was refused, or "".
+func storeCookie(userID string, u *url.URL, received *http.Cookie, fromScript bool, now time.Time) string {
+	host := strings.ToLower(u.Hostname())
+	if received.Name == "" {
+		return "empty name"
+	}
+	if isReservedCookieName(received.Name) {
+		return "reserved name"
+	}
+	if fromScript && received.HttpOnly {
+		return "HttpOnly cookie set from script"
+	}
+	if received.Secure && u.Scheme != "https" {
+		return "Secure cookie from an insecure origin"
+	}
+
+	stored := &jarCookie{
+		Name:       received.Name,
+		Value:      received.Value,
+		Secure:     received.Secure,
+		HttpOnly:   received.HttpOnly,
+		Created:    now,
+		LastAccess: now,
+	}
+	switch {
+	case received.MaxAge < 0:
+		stored.Expires = time.Unix(0, 0)
+	case received.MaxAge > 0:
+		stored.Expires = now.Add(time.Duration(received.MaxAge) * time.Second)
+	case !received.Expires.IsZero():
+		stored.Expires = received.Expires
+	}
+	switch received.SameSite {
+	case http.SameSiteStrictMode:
+		stored.SameSite = "strict"
+	case http.SameSiteLaxMode:
+		stored.SameSite = "lax"
+	case http.SameSiteNoneMode:
+		stored.SameSite = "none"
+	}
+
+	domain := strings.TrimPrefix(strings.ToLower(received.Domain), ".")
+	if domain != "" && cookieDomainIsPublicSuffix(domain) {
+		if domain != host {
+			return "domain is a public suffix"
+		}
+		domain = ""
+	}
+	if domain != "" {
+		if !cookieDomainMatches(host, domain) {
+			return "domain does not match the host"
+		}
+		stored.Domain = domain
+	} else {
+		stored.Domain = host
+		stored.HostOnly = true
+	}
+	stored.Path = received.Path
+	if !strings.HasPrefix(stored.Path, "/") {
+		stored.Path = cookieDefaultPath(u.Path)
+	}
+	if strings.HasPrefix(stored.Name, "__Secure-") && !stored.Secure {
+		return "__Secure- prefix without Secure"
+	}
+	if strings.HasPrefix(stored.Name, "__Host-") && (!stored.Secure || !stored.HostOnly || stored.Path != "/") {
+		return "__Host- prefix requirements not met"
+	}
+
+	cookieJarMu.Lock()
+	defer cookieJarMu.Unlock()
+	jar := cookieJarForLocked(userID)
+	key := stored.key()
+	if existing, ok := jar.cookies[key]; ok {
+		if fromScript && existing.HttpOnly {
+			return "would overwrite an HttpOnly cookie"
+		}
+		stored.Created = existing.Created
+		jar.markDirty(existing)
+		delete(jar.cookies, key)
+	}
+	if stored.expired(now) {
+		return ""
+	}
+	jar.cookies[key] = stored
+	jar.markDirty(stored)
+	jar.evictLocked(stored.Domain, now)
+	return ""
+}
+
+// evictLocked removes expired cookies, then the least recently used ones while
+// domain or the whole jar is over its limit.
+func (jar *userCookieJar) evictLocked(domain string, now time.Time) {
+	var inDomain, all []*jarCookie
+	for key, c := range jar.cookies {
+		if c.expired(now) {
+			jar.markDirty(c)
+			delete(jar.cookies, key)
+			continue
+		}
+		all = append(all, c)
+		if c.Domain == domain {
+			inDomain = append(inDomain, c)
+		}
+	}
+	for _, set := range []struct {
+		cookies []*jarCookie
+		limit   int
+	}{{inDomain, maxCookiesPerDomain}, {all, maxCookiesPerUser}} {
+		if len(set.cookies) <= set.limit {
+			continue
+		}
+		sort.Slice(set.cookies, func(i, j int) bool { return set.cookies[i].LastAccess.Before(set.cookies[j].LastAccess) })
+		for _, c := range set.cookies[:len(set.cookies)-set.limit] {
+			if _, ok := jar.cookies[c.key()]; ok {
+				jar.markDirty(c)
+				delete(jar.cookies, c.key())
+			}
+		}
+	}
+}
+
+// storeResponseCookies stores the cookies of a response from u.
+func storeResponseCookies(userID string, u *url.URL, setCookieHeaders []string) {
+	if len(setCookieHeaders) == 0 {
+		return
+	}
+	if incognitoUserEnded(userID) {
+		log.Printf("Cookie Jar: Dropping cookies from %s for an incognito session that has ended", u.Host)
+		return
+	}
+	dummyResp := http.Response{Header: http.Header{"Set-Cookie": setCookieHeaders}}
+	now := time.Now()
+	for _, received := range dummyResp.Cookies() {
+		if reason := storeCookie(userID, u, received, false, now); reason != "" {
+			log.Printf("Cookie Jar: Refused cookie %q from %s: %s", received.Name, u.Host, reason)
+		}
+	}
+}
+
+// matchingCookies returns the cookies to send to u, in the order of RFC 6265
+// section 5.4: longer paths first, then earlier creation. crossSite withholds
+// SameSite=Strict cookies, and SameSite=Lax ones unless topLevelNavigation; a
+// cookie without SameSite is treated as Lax.
+// Without includeHttpOnly, only cookies visible to scripts are returned.
+func matchingCookies(userID string, u *url.URL, crossSite bool, topLevelNavigation bool, includeHttpOnly bool) []*jarCookie {
+	host := strings.ToLower(u.Hostname())
+	requestPath := u.EscapedPath()
+	now := time.Now()
+
+	cookieJarMu.Lock()
+	defer cookieJarMu.Unlock()
+	jar := cookieJars[userID]
+	if jar == nil {
+		return nil
+	}
+	var matched []*jarCookie
+	for _, c := range jar.cookies {
+		if c.expired(now) {
+			continue
+		}
+		if (c.HostOnly && host != c.Domain) || (!c.HostOnly && !cookieDomainMatches(host, c.Domain)) {
+			continue
+		}
+		if !cookiePathMatches(requestPath, c.Path) || (c.Secure && u.Scheme != "https") || (c.HttpOnly && !includeHttpOnly) {
+			continue
+		}
+		sameSite := c.SameSite
+		if sameSite == "" {
+			sameSite = "lax" // Browsers' default for cookies without the attribute
+		}
+		if crossSite && (sameSite == "strict" || (sameSite == "lax" && !topLevelNavigation)) {
+			continue
+		}
+		c.LastAccess = now
+		copied := *c
+		matched = append(matched, &copied)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if len(matched[i].Path) != len(matched[j].Path) {
+			return len(matched[i].Path) > len(matched[j].Path)
+		}
+		return matched[i].Created.Before(matched[j].Created)
+	})
+	return matched
+}
+
+// expireForeignBrowserCookies expires the browser cookies on the proxy origin
+// that the proxy did not set: those relayed from sites before the jar existed,
+// the legacy "proxy-*-enabled" settings, and any set by a page script in raw mode.
+// Only isProxyCookie cookies may influence the proxy.
+func expireForeignBrowserCookies(w http.ResponseWriter, r *http.Request) {
+	for _, cookie := range r.Cookies() {
+		if isProxyCookie(cookie.Name) {
+			continue
+		}
+		log.Printf("Cookie Jar: Expiring foreign cookie %q on the proxy origin", cookie.Name)
+		http.SetCookie(w, &http.Cookie{Name: cookie.Name, Value: "", Path: "/", MaxAge: -1})
+	}
+}
+
+// listCookies returns copies of userID's unexpired cookies.
+func listCookies(userID string) []*jarCookie {
+	now := time.Now()
+	cookieJarMu.Lock()
+	defer cookieJarMu.Unlock()
+	var cookies []*jarCookie
+	if jar := cookieJars[userID]; jar != nil {
+		for _, c := range jar.cookies {
+			if !c.expired(now) {
+				copied := *c
+				cookies = append(cookies, &copied)
+			}
+		}
+	}
+	return cookies
+}
+
+// deleteCookies removes userID's cookies for which match returns true and
+// returns how many were removed.
+func deleteCookies(userID string, match func(c *jarCookie) bool) int {
+	cookieJarMu.Lock()
+	defer cookieJarMu.Unlock()
+	jar := cookieJars[userID]
+	if jar == nil {
+		return 0
+	}
+	removed := 0
+	for key, c := range jar.cookies {
+		if match(c) {
+			jar.markDirty(c)
+			delete(jar.cookies, key)
+			removed++
+		}
+	}
+	if len(jar.cookies) == 0 && !jar.dirty {
+		delete(cookieJars, userID)
+	}
+	return removed
+}
+
+// dropCookieJar deletes userID's jar, saved cookies included, and returns how
+// many cookies it held.
+func dropCookieJar(userID string) int {
+	cookieJarMu.Lock()
+	defer cookieJarMu.Unlock()
+	jar := cookieJars[userID]
+	delete(cookieJars, userID)
+	delete(cookieJarSealed, userID)
+	if jar == nil {
+		return 0
+	}
+	return len(jar.cookies)
+}
+
+// cookieHeaderValue serialises cookies for a Cookie header or document.cookie.
+func cookieHeaderValue(cookies []*jarCookie) string {
+	pairs := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		pairs = append(pairs, c.Name+"="+c.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// requestIsCrossSite reports whether a request to targetURL was initiated by a page
+// on another site (registrable domain). Every proxied page shares the proxy's
+// origin, so headers a page script can set (X-Proxy-Client-URL, a fetch referrer)
+// never decide it. For navigations the initiator is the page in the Referer, and
+// navigations the user started (Sec-Fetch-Site "none", or from the landing page)
+// are same-site. Other requests are same-site only with the initiator token of
+// the target's site for userID, which the runtime adds to fetch and XHR, or, for loads by
+// elements (Sec-Fetch-Dest other than "empty"), by the document URL the browser
+// puts in the Referer. Any request whose initiator cannot be verified counts as
+// cross-site.
+func requestIsCrossSite(r *http.Request, userID string, targetURL *url.URL) bool {
+	targetSite := siteOfHost(targetURL.Hostname())
+	if requestIsNavigation(r) {
+		if r.Header.Get("Sec-Fetch-Site") == "none" {
+			return false
+		}
+		if refererURL, err := url.Parse(r.Header.Get("Referer")); err == nil && refererURL.Host == r.Host && refererURL.Path == "/" {
+			return false
+		}
+	} else {
+		if validPageToken(r.Header.Get(initiatorTokenHeader), initiatorTokenPurpose, userID, targetSite) {
+			return false
+		}
+		if dest := r.Header.Get("Sec-Fetch-Dest"); dest == "" || dest == "empty" {
+			return true
+		}
+	}
+	initiator, ok := targetURLFromProxyPageURL(r.Header.Get("Referer"), r.Host)
+	if !ok {
+		return true
+	}
+	return siteOfHost(initiator.Hostname()) != targetSite
+}
+
+// requestIsNavigation reports whether the browser says r is a navigation. Unlike
+// requestDestination, it relies only on headers scripts cannot set.
+func requestIsNavigation(r *http.Request) bool {
+	return r.Header.Get("Sec-Fetch-Mode") == "navigate"
+}
+
+// requestIsDocumentNavigation reports whether r loads a page into a window or
+// frame. Tokens and cookies handed to a page are only embedded in responses to
+// these, so a page script cannot fetch another site's page to read them.
+func requestIsDocumentNavigation(r *http.Request) bool {
+	dest := r.Header.Get("Sec-Fetch-Dest")
+	return requestIsNavigation(r) && (dest == "document" || dest == "iframe")
+}
+
+// initiatorTokenHeader carries the page's initiator token (pageToken for
+// initiatorTokenPurpose and the page's site) on the runtime's fetch and XHR
+// requests, proving which site started them.
+const initiatorTokenHeader = "X-Proxy-Initiator-Token"
+
+// initiatorTokenPurpose is the pageToken purpose proving a request came from a
+// page on a given site.
+const initiatorTokenPurpose = "initiator"
+
+// cookieTokenPurpose is the pageToken purpose letting a page set its cookies from script.
+const cookieTokenPurpose = "cookies"
+
+// handleScriptCookie serves document.cookie for a proxied page. The runtime sends
+// the page's URL and a token from pageToken for its host.
+//
+//	GET   the page's script-visible cookies, as for document.cookie, so the runtime
+//	      sees cookies stored since the page loaded (by its fetches, or other tabs)
+//	POST  store the assigned cookie string from the body
+func handleScriptCookie(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := requestUserID(r)
+	pageURL, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		http.Error(w, "Invalid or missing 'url' parameter", http.StatusBadRequest)
+		return
+	}
+	if !validPageToken(r.URL.Query().Get("token"), cookieTokenPurpose, userID, pageURL.Hostname()) {
+		log.Printf("Cookie Jar: Refused script cookie %s for %s: invalid token", r.Method, pageURL.Host)
+		http.Error(w, "Forbidden: invalid cookie token", http.StatusForbidden)
+		return
+	}
+	prefs, _ := effectiveSitePreferences(userID, pageURL.Hostname())
+
+	if r.Method == http.MethodGet {
+		var cookies []*jarCookie
+		if prefs.CookiesEnabled {
+			cookies = matchingCookies(userID, pageURL, false, true, false)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, cookieHeaderValue(cookies))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxScriptCookieBytes))
+	if err != nil {
+		http.Error(w, "Cookie too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !prefs.CookiesEnabled {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	dummyResp := http.Response{Header: http.Header{"Set-Cookie": {string(body)}}}
+	for _, received := range dummyResp.Cookies() {
+		if reason := storeCookie(userID, pageURL, received, true, time.Now()); reason != "" {
+			log.Printf("Cookie Jar: Refused script cookie %q on %s: %s", received.Name, pageURL.Host, reason)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jarCookieNames returns the names of cookies, sorted.
+func jarCookieNames(cookies []*jarCookie) []string {
+	var names []string
+	for _, c := range cookies {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCookieDomainMatches(t *testing.T) {
+	tests := []struct {
+		host   string
+		domain string
+		want   bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "example.com", true},
+		{"a.b.example.com", "example.com", true},
+		{"badexample.com", "example.com", false},
+		{"example.com", "www.example.com", false},
+		{"192.168.0.1", "168.0.1", false},
+		{"192.168.0.1", "192.168.0.1", true},
+	}
+	for _, tt := range tests {
+		if got := cookieDomainMatches(tt.host, tt.domain); got != tt.want {
+			t.Errorf("cookieDomainMatches(%q, %q) = %t, want %t", tt.host, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestCookiePathMatches(t *testing.T) {
+	tests := []struct {
+		requestPath string
+		cookiePath  string
+		want        bool
+	}{
+		{"/", "/", true},
+		{"", "/", true},
+		{"/docs", "/docs", true},
+		{"/docs/a", "/docs", true},
+		{"/docs/a", "/docs/", true},
+		{"/docsearch", "/docs", false},
+		{"/doc", "/docs", false},
+		{"/other", "/docs", false},
+	}
+	for _, tt := range tests {
+		if got := cookiePathMatches(tt.requestPath, tt.cookiePath); got != tt.want {
+			t.Errorf("cookiePathMatches(%q, %q) = %t, want %t", tt.requestPath, tt.cookiePath, got, tt.want)
+		}
+	}
+}
+
+func TestCookieDefaultPath(t *testing.T) {
+	tests := []struct {
+		requestPath string
+		want        string
+	}{
+		{"", "/"},
+		{"relative", "/"},
+		{"/", "/"},
+		{"/page", "/"},
+		{"/docs/page", "/docs"},
+		{"/docs/sub/", "/docs/sub"},
+	}
+	for _, tt := range tests {
+		if got := cookieDefaultPath(tt.requestPath); got != tt.want {
+			t.Errorf("cookieDefaultPath(%q) = %q, want %q", tt.requestPath, got, tt.want)
+		}
+	}
+}
+
+func TestStoreCookieRefusals(t *testing.T) {
+	const userID = "test-store-cookie-refusals"
+	defer dropCookieJar(userID)
+	tests := []struct {
+		url        string
+		cookie     http.Cookie
+		fromScript bool
+		want       string
+	}{
+		{"https://www.example.com/", http.Cookie{Name: "a", Value: "1"}, false, ""},
+		{"https://www.example.com/", http.Cookie{Name: "", Value: "1"}, false, "empty name"},
+		{"https://www.example.com/", http.Cookie{Name: "proxy-mode", Value: "1"}, false, "reserved name"},
+		{"https://www.example.com/", http.Cookie{Name: "h", Value: "1", HttpOnly: true}, true, "HttpOnly cookie set from script"},
+		{"http://www.example.com/", http.Cookie{Name: "s", Value: "1", Secure: true}, false, "Secure cookie from an insecure origin"},
+		{"https://www.example.co.uk/", http.Cookie{Name: "d", Value: "1", Domain: "co.uk"}, false, "domain is a public suffix"},
+		{"https://co.uk/", http.Cookie{Name: "d", Value: "1", Domain: "co.uk"}, false, ""}, // Becomes host-only
+		{"https://www.example.com/", http.Cookie{Name: "d", Value: "1", Domain: "other.com"}, false, "domain does not match the host"},
+		{"https://www.example.com/", http.Cookie{Name: "d", Value: "1", Domain: ".Example.com"}, false, ""},
+		{"https://www.example.com/", http.Cookie{Name: "__Secure-a", Value: "1", Secure: true}, false, ""},
+		{"https://www.example.com/", http.Cookie{Name: "__Secure-b", Value: "1"}, false, "__Secure- prefix without Secure"},
+		{"https://www.example.com/", http.Cookie{Name: "__Host-a", Value: "1", Secure: true, Path: "/"}, false, ""},
+		{"https://www.example.com/", http.Cookie{Name: "__Host-b", Value: "1", Path: "/"}, false, "__Host- prefix requirements not met"},
+		{"https://www.example.com/", http.Cookie{Name: "__Host-c", Value: "1", Secure: true, Path: "/docs"}, false, "__Host- prefix requirements not met"},
+		{"https://www.example.com/docs/page", http.Cookie{Name: "__Host-d", Value: "1", Secure: true}, false, "__Host- prefix requirements not met"},
+		{"https://www.example.com/", http.Cookie{Name: "__Host-e", Value: "1", Secure: true, Path: "/", Domain: "example.com"}, false, "__Host- prefix requirements not met"},
+		{"https://www.example.com/", http.Cookie{Name: "session", Value: "1", HttpOnly: true}, false, ""},
+		{"https://www.example.com/", http.Cookie{Name: "session", Value: "2"}, true, "would overwrite an HttpOnly cookie"},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		cookie := tt.cookie
+		if got := storeCookie(userID, mustParseURL(t, tt.url), &cookie, tt.fromScript, now); got != tt.want {
+			t.Errorf("storeCookie(%s, %q, fromScript=%t) = %q, want %q", tt.url, tt.cookie.String(), tt.fromScript, got, tt.want)
+		}
+	}
+}
+
+func TestMatchingCookies(t *testing.T) {
+	const userID = "test-matching-cookies"
+	defer dropCookieJar(userID)
+	now := time.Now()
+	for _, stored := range []struct {
+		url    string
+		cookie http.Cookie
+	}{
+		{"https://www.shop.example/", http.Cookie{Name: "host", Value: "1"}},
+		{"https://www.shop.example/", http.Cookie{Name: "domain", Value: "1", Domain: "shop.example"}},
+		{"https://www.shop.example/", http.Cookie{Name: "docs", Value: "1", Path: "/docs"}},
+		{"https://www.shop.example/", http.Cookie{Name: "secure", Value: "1", Secure: true}},
+		{"https://www.shop.example/", http.Cookie{Name: "httponly", Value: "1", HttpOnly: true}},
+		{"https://www.shop.example/", http.Cookie{Name: "expired", Value: "1", MaxAge: -1}},
+	} {
+		cookie := stored.cookie
+		if reason := storeCookie(userID, mustParseURL(t, stored.url), &cookie, false, now); reason != "" {
+			t.Fatalf("storeCookie(%q) refused: %s", stored.cookie.Name, reason)
+		}
+	}
+	tests := []struct {
+		url             string
+		includeHttpOnly bool
+		want            []string
+	}{
+		{"https://www.shop.example/", true, []string{"domain", "host", "httponly", "secure"}},
+		{"https://www.shop.example/", false, []string{"domain", "host", "secure"}},
+		{"http://www.shop.example/", false, []string{"domain", "host"}},
+		{"https://cdn.shop.example/", false, []string{"domain"}},
+		{"https://www.shop.example/docs/a", false, []string{"docs", "domain", "host", "secure"}},
+		{"https://www.shop.example/docsearch", false, []string{"domain", "host", "secure"}},
+		{"https://www.other.example/", true, nil},
+	}
+	for _, tt := range tests {
+		got := jarCookieNames(matchingCookies(userID, mustParseURL(t, tt.url), false, false, tt.includeHttpOnly))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matchingCookies(%s, includeHttpOnly=%t) = %q, want %q", tt.url, tt.includeHttpOnly, got, tt.want)
+		}
+	}
+
+	// Longer paths come first.
+	matched := matchingCookies(userID, mustParseURL(t, "https://www.shop.example/docs/a"), false, false, false)
+	if len(matched) == 0 || matched[0].Name != "docs" {
+		t.Errorf("matchingCookies did not put the longest path first: %q", cookieHeaderValue(matched))
+	}
+}
+
+func TestMatchingCookiesSameSite(t *testing.T) {
+	const userID = "test-matching-cookies-samesite"
+	defer dropCookieJar(userID)
+	u := mustParseURL(t, "https://shop.example/")
+	now := time.Now()
+	for _, cookie := range []*http.Cookie{
+		{Name: "strict", Value: "1", SameSite: http.SameSiteStrictMode},
+		{Name: "lax", Value: "1", SameSite: http.SameSiteLaxMode},
+		{Name: "none", Value: "1", SameSite: http.SameSiteNoneMode, Secure: true},
+		{Name: "unset", Value: "1"},
+	} {
+		if reason := storeCookie(userID, u, cookie, false, now); reason != "" {
+			t.Fatalf("storeCookie(%q) refused: %s", cookie.Name, reason)
+		}
+	}
+	tests := []struct {
+		crossSite          bool
+		topLevelNavigation bool
+		want               []string
+	}{
+		{false, false, []string{"lax", "none", "strict", "unset"}},
+		{false, true, []string{"lax", "none", "strict", "unset"}},
+		{true, true, []string{"lax", "none", "unset"}},
+		{true, false, []string{"none"}},
+	}
+	for _, tt := range tests {
+		got := jarCookieNames(matchingCookies(userID, u, tt.crossSite, tt.topLevelNavigation, false))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matchingCookies(crossSite=%t, topLevelNavigation=%t) = %q, want %q", tt.crossSite, tt.topLevelNavigation, got, tt.want)
+		}
+	}
+}
+
+func TestRequestIsCrossSite(t *testing.T) {
+	const userID = "test-request-is-cross-site"
+	proxyPage := func(target string) string {
+		return "http://proxy.test" + proxyRequestPath + "?url=" + url.QueryEscape(target)
+	}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"typed navigation", map[string]string{"Sec-Fetch-Mode": "navigate", "Sec-Fetch-Site": "none"}, false},
+		{"from the landing page", map[string]string{"Sec-Fetch-Mode": "navigate", "Referer": "http://proxy.test/"}, false},
+		{"same-site link", map[string]string{"Sec-Fetch-Mode": "navigate", "Referer": proxyPage("https://www.shop.example/")}, false},
+		{"cross-site link", map[string]string{"Sec-Fetch-Mode": "navigate", "Referer": proxyPage("https://evil.example/")}, true},
+		{"navigation without a Referer", map[string]string{"Sec-Fetch-Mode": "navigate"}, true},
+		{"same-site image", map[string]string{"Sec-Fetch-Dest": "image", "Referer": proxyPage("https://www.shop.example/")}, false},
+		{"cross-site image", map[string]string{"Sec-Fetch-Dest": "image", "Referer": proxyPage("https://evil.example/")}, true},
+		{"fetch with a same-site Referer", map[string]string{"Sec-Fetch-Dest": "empty", "Referer": proxyPage("https://www.shop.example/")}, true},
+		{"fetch with a forged client URL", map[string]string{"Sec-Fetch-Dest": "empty", "X-Proxy-Client-URL": "https://www.shop.example/"}, true},
+		{"fetch with the initiator token", map[string]string{"Sec-Fetch-Dest": "empty", initiatorTokenHeader: pageToken(initiatorTokenPurpose, userID, "shop.example")}, false},
+		{"fetch with another site's token", map[string]string{"Sec-Fetch-Dest": "empty", initiatorTokenHeader: pageToken(initiatorTokenPurpose, userID, "evil.example")}, true},
+		{"fetch with another user's token", map[string]string{"Sec-Fetch-Dest": "empty", initiatorTokenHeader: pageToken(initiatorTokenPurpose, "someone-else", "shop.example")}, true},
+	}
+	target := mustParseURL(t, "https://shop.example/cart")
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://proxy.test"+proxyRequestPath+"?url="+url.QueryEscape(target.String()), nil)
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		if got := requestIsCrossSite(r, userID, target); got != tt.want {
+			t.Errorf("%s: requestIsCrossSite = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSealCookieJar(t *testing.T) {
+	if cookieJarKey == nil {
+		cookieJarKey = []byte(strings.Repeat("k", 32))
+	}
+	cookies := []*jarCookie{{Name: "a", Value: "1", Domain: "example.com", Path: "/", HostOnly: true, SameSite: "lax"}}
+	sealed, err := sealCookieJar("alice", cookies)
+	if err != nil {
+		t.Fatalf("sealCookieJar: %v", err)
+	}
+
+	var opened []*jarCookie
+	if err := openCookieJar("alice", sealed, &opened); err != nil {
+		t.Fatalf("openCookieJar: %v", err)
+	}
+	if !reflect.DeepEqual(opened, cookies) {
+		t.Errorf("openCookieJar = %+v, want %+v", opened[0], cookies[0])
+	}
+
+	tampered := []byte(sealed)
+	if tampered[len(tampered)/2] == 'A' {
+		tampered[len(tampered)/2] = 'B'
+	} else {
+		tampered[len(tampered)/2] = 'A'
+	}
+	for _, tt := range []struct {
+		name   string
+		userID string
+		sealed string
+	}{
+		{"another user", "bob", sealed},
+		{"tampered", "alice", string(tampered)},
+		{"truncated", "alice", sealed[:8]},
+		{"not base64", "alice", "%%%"},
+	} {
+		var v []*jarCookie
+		if err := openCookieJar(tt.userID, tt.sealed, &v); err == nil {
+			t.Errorf("openCookieJar(%s) succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// --- CSS Tokenizer & URL Rewriter ---
+//
+// A reduced CSS Syntax Level 3 tokenizer. It only distinguishes the tokens the
+// rewriter needs (strings, url(), functions, at-keywords, brackets) and keeps the
+// raw text of every token so untouched input is reproduced byte for byte.
+
+type cssTokenKind int
+
+const (
+	cssTokenDelim cssTokenKind = iota // Any other single code point (numbers, operators, ...)
+	cssTokenWhitespace
+	cssTokenComment
+	cssTokenString    // Quoted string; value holds the unescaped contents
+	cssTokenURL       // Unquoted url(...); value holds the unescaped URL
+	cssTokenFunction  // name( ; value holds the lowercased name
+	cssTokenAtKeyword // @name ; value holds the lowercased name
+	cssTokenIdent
+	cssTokenOpenParen
+	cssTokenCloseParen
+	cssTokenSemicolon
+	cssTokenOpenBrace
+	cssTokenCloseBrace
+)
+
+type cssToken struct {
+	kind  cssTokenKind
+	raw   string
+	value string
+	quote byte // Quote character of a cssTokenString
+}
+
+func isCSSWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isCSSNameStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c >= 0x80
+}
+
+func isCSSNameChar(c byte) bool {
+	return isCSSNameStart(c) || (c >= '0' && c <= '9') || c == '-'
+}
+
+func isCSSHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// isCSSValidEscape reports whether s[i:] starts a valid escape sequence.
+func isCSSValidEscape(s string, i int) bool {
+	return i+1 < len(s) && s[i] == '\\' && s[i+1] != '\n' && s[i+1] != '\r' && s[i+1] != '\f'
+}
+
+// isCSSIdentStart reports whether s[i:] starts an identifier.
+func isCSSIdentStart(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	switch {
+	case s[i] == '-':
+		return i+1 < len(s) && (isCSSNameStart(s[i+1]) || s[i+1] == '-' || isCSSValidEscape(s, i+1))
+	case isCSSNameStart(s[i]):
+		return true
+	default:
+		return isCSSValidEscape(s, i)
+	}
+}
+
+// consumeCSSEscape decodes the escape starting at s[i] (the backslash) and returns
+// the decoded text and the index after the escape.
+func consumeCSSEscape(s string, i int) (string, int) {
+	i++ // Skip the backslash
+	if i >= len(s) {
+		return "�", i
+	}
+	if !isCSSHexDigit(s[i]) {
+		return string(s[i]), i + 1
+	}
+	start := i
+	for i < len(s) && i-start < 6 && isCSSHexDigit(s[i]) {
+		i++
+	}
+	codePoint, _ := strconv.ParseUint(s[start:i], 16, 32)
+	if i < len(s) && isCSSWhitespace(s[i]) {
+		if s[i] == '\r' && i+1 < len(s) && s[i+1] == '\n' {
+			i++
+		}
+		i++
+	}
+	if codePoint == 0 || codePoint > 0x10FFFF || (codePoint >= 0xD800 && codePoint <= 0xDFFF) {
+		return "�", i
+	}
+	return string(rune(codePoint)), i
+}
+
+// consumeCSSName consumes an identifier starting at s[i] and returns its
+// unescaped value and the index after it.
+func consumeCSSName(s string, i int) (string, int) {
+	var sb strings.Builder
+	for i < len(s) {
+		if isCSSNameChar(s[i]) {
+			sb.WriteByte(s[i])
+			i++
+		} else if isCSSValidEscape(s, i) {
+			var decoded string
+			decoded, i = consumeCSSEscape(s, i)
+			sb.WriteString(decoded)
+		} else {
+			break
+		}
+	}
+	return sb.String(), i
+}
+
+// consumeCSSString consumes a quoted string starting at s[i] (the quote).
+// ok is false for an unterminated (bad) string, which ends before the newline.
+func consumeCSSString(s string, i int) (value string, end int, ok bool) {
+	quote := s[i]
+	i++
+	var sb strings.Builder
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == quote:
+			return sb.String(), i + 1, true
+		case c == '\n' || c == '\r' || c == '\f':
+			return sb.String(), i, false
+		case c == '\\':
+			if i+1 >= len(s) {
+				i++
+				continue
+			}
+			if next := s[i+1]; next == '\n' || next == '\f' {
+				i += 2 // Escaped newline: line continuation
+			} else if next == '\r' {
+				i += 2
+				if i < len(s) && s[i] == '\n' {
+					i++
+				}
+			} else {
+				var decoded string
+				decoded, i = consumeCSSEscape(s, i)
+				sb.WriteString(decoded)
+			}
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String(), i, true // EOF terminates the string
+}
+
+// consumeCSSURL consumes the body of an unquoted url( token, starting right after
+// the opening parenthesis. ok is false for a bad url token.
+func consumeCSSURL(s string, i int) (value string, end int, ok bool) {
+	for i < len(s) && isCSSWhitespace(s[i]) {
+		i++
+	}
+	var sb strings.Builder
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ')':
+			return sb.String(), i + 1, true
+		case isCSSWhitespace(c):
+			for i < len(s) && isCSSWhitespace(s[i]) {
+				i++
+			}
+			if i >= len(s) {
+				return sb.String(), i, true
+			}
+			if s[i] == ')' {
+				return sb.String(), i + 1, true
+			}
+			return "", consumeCSSBadURLRemnants(s, i), false
+		case c == '"' || c == '\'' || c == '(':
+			return "", consumeCSSBadURLRemnants(s, i), false
+		case c == '\\':
+			if !isCSSValidEscape(s, i) {
+				return "", consumeCSSBadURLRemnants(s, i), false
+			}
+			var decoded string
+			decoded, i = consumeCSSEscape(s, i)
+			sb.WriteString(decoded)
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String(), i, true
+}
+
+func consumeCSSBadURLRemnants(s string, i int) int {
+	for i < len(s) {
+		if s[i] == ')' {
+			return i + 1
+		}
+		if isCSSValidEscape(s, i) {
+			_, i = consumeCSSEscape(s, i)
+			continue
+		}
+		i++
+	}
+	return i
+}
+
+// tokenizeCSS splits CSS source into tokens. Concatenating the raw text of the
+// returned tokens reproduces the input exactly.
+func tokenizeCSS(s string) []cssToken {
+	var tokens []cssToken
+	i := 0
+	for i < len(s) {
+		start := i
+		c := s[i]
+		switch {
+		case isCSSWhitespace(c):
+			for i < len(s) && isCSSWhitespace(s[i]) {
+				i++
+			}
+			tokens = append(tokens, cssToken{kind: cssTokenWhitespace, raw: s[start:i]})
+		case c == '/' && i+1 < len(s) && s[i+1] == '*':
+			if end := strings.Index(s[i+2:], "*/"); end >= 0 {
+				i += 2 + end + 2
+			} else {
+				i = len(s)
+			}
+			tokens = append(tokens, cssToken{kind: cssTokenComment, raw: s[start:i]})
+		case c == '"' || c == '\'':
+			value, end, ok := consumeCSSString(s, i)
+			i = end
+			if ok {
+				tokens = append(tokens, cssToken{kind: cssTokenString, raw: s[start:i], value: value, quote: c})
+			} else {
+				tokens = append(tokens, cssToken{kind: cssTokenDelim, raw: s[start:i]})
+			}
+		case c == '@' && isCSSIdentStart(s, i+1):
+			name, end := consumeCSSName(s, i+1)
+			i = end
+			tokens = append(tokens, cssToken{kind: cssTokenAtKeyword, raw: s[start:i], value: strings.ToLower(name)})
+		case isCSSIdentStart(s, i):
+			name, end := consumeCSSName(s, i)
+			i = end
+			if i < len(s) && s[i] == '(' {
+				i++
+				lowerName := strings.ToLower(name)
+				if lowerName == "url" {
+					// url( followed by a quote is a function holding a string;
+					// otherwise the whole url(...) is a single url token.
+					j := i
+					for j < len(s) && isCSSWhitespace(s[j]) {
+						j++
+					}
+					if j >= len(s) || (s[j] != '"' && s[j] != '\'') {
+						value, end, ok := consumeCSSURL(s, i)
+						i = end
+						if ok {
+							tokens = append(tokens, cssToken{kind: cssTokenURL, raw: s[start:i], value: value})
+						} else {
+							tokens = append(tokens, cssToken{kind: cssTokenDelim, raw: s[start:i]})
+						}
+						continue
+					}
+				}
+				tokens = append(tokens, cssToken{kind: cssTokenFunction, raw: s[start:i], value: lowerName})
+			} else {
+				tokens = append(tokens, cssToken{kind: cssTokenIdent, raw: s[start:i], value: name})
+			}
+		case c == '\\':
+			// Invalid escape (backslash before a newline or at EOF).
+			i++
+			tokens = append(tokens, cssToken{kind: cssTokenDelim, raw: s[start:i]})
+		default:
+			i++
+			kind := cssTokenDelim
+			switch c {
+			case '(':
+				kind = cssTokenOpenParen
+			case ')':
+				kind = cssTokenCloseParen
+			case ';':
+				kind = cssTokenSemicolon
+			case '{':
+				kind = cssTokenOpenBrace
+			case '}':
+				kind = cssTokenCloseBrace
+			}
+			tokens = append(tokens, cssToken{kind: kind, raw: s[start:i]})
+		}
+	}
+	return tokens
+}
+
+// cssQuoteString serialises a value as a CSS string using the given quote character.
+func cssQuoteString(value string, quote byte) string {
+	var sb strings.Builder
+	sb.WriteByte(quote)
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case quote, '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\a `)
+		case '\r':
+			sb.WriteString(`\d `)
+		case '\f':
+			sb.WriteString(`\c `)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte(quote)
+	return sb.String()
+}
+
+// isCSSImageSetFunction reports whether a function's string arguments are image URLs.
+func isCSSImageSetFunction(name string) bool {
+	return name == "image-set" || name == "-webkit-image-set"
+}
+
+// rewriteCSSURLsInString rewrites every URL reference in CSS source through the
+// proxy: url() tokens (quoted and unquoted, including @font-face src lists),
+// @import strings, src() and the string form of image-set(). It is shared by
+// text/css responses, <style> element contents and style attributes.
+func rewriteCSSURLsInString(cssContent string, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) string {
+	tokens := tokenizeCSS(cssContent)
+
+	rewriteRef := func(rawURL string) (string, bool) {
+		if rawURL == "" || strings.HasPrefix(strings.ToLower(strings.TrimSpace(rawURL)), "data:") {
+			return rawURL, false
+		}
+		proxiedURL, err := rewriteProxiedURL(rawURL, baseURL, clientReq, blockTrackers)
+		if err != nil {
+			log.Printf("CSS Rewrite: Error proxying URL '%s' (base '%s'): %v", rawURL, baseURL.String(), err)
+			return rawURL, false
+		}
+		return proxiedURL, proxiedURL != rawURL
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(cssContent))
+	var funcStack []string // Enclosing function names; "" for plain parentheses
+	awaitingImportURL := false
+
+	for _, tok := range tokens {
+		switch tok.kind {
+		case cssTokenAtKeyword:
+			awaitingImportURL = tok.value == "import"
+			sb.WriteString(tok.raw)
+		case cssTokenURL:
+			if proxiedURL, changed := rewriteRef(tok.value); changed {
+				sb.WriteString("url(" + cssQuoteString(proxiedURL, '\'') + ")")
+			} else {
+				sb.WriteString(tok.raw)
+			}
+			awaitingImportURL = false
+		case cssTokenString:
+			enclosing := ""
+			if len(funcStack) > 0 {
+				enclosing = funcStack[len(funcStack)-1]
+			}
+			isURLString := (awaitingImportURL && len(funcStack) == 0) ||
+				enclosing == "url" || enclosing == "src" || isCSSImageSetFunction(enclosing)
+			if !isURLString {
+				sb.WriteString(tok.raw)
+			} else if proxiedURL, changed := rewriteRef(tok.value); changed {
+				sb.WriteString(cssQuoteString(proxiedURL, tok.quote))
+			} else {
+				sb.WriteString(tok.raw)
+			}
+			if len(funcStack) == 0 {
+				awaitingImportURL = false
+			}
+		case cssTokenFunction:
+			funcStack = append(funcStack, tok.value)
+			sb.WriteString(tok.raw)
+		case cssTokenOpenParen:
+			funcStack = append(funcStack, "")
+			sb.WriteString(tok.raw)
+		case cssTokenCloseParen:
+			if len(funcStack) > 0 {
+				funcStack = funcStack[:len(funcStack)-1]
+			}
+			sb.WriteString(tok.raw)
+		case cssTokenSemicolon, cssTokenOpenBrace, cssTokenCloseBrace:
+			// Statement boundaries; also recovers from unbalanced parentheses.
+			funcStack = funcStack[:0]
+			awaitingImportURL = false
+			sb.WriteString(tok.raw)
+		default:
+			sb.WriteString(tok.raw)
+		}
+	}
+	return sb.String()
+}
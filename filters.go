@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Ad & Tracker Filtering (Adblock Plus / EasyList syntax) ---
+
+// Resource types a network filter can be restricted to ($script, $image, ...).
+const (
+	filterTypeScript uint32 = 1 << iota
+	filterTypeImage
+	filterTypeStylesheet
+	filterTypeObject
+	filterTypeXHR
+	filterTypeSubdocument
+	filterTypeMedia
+	filterTypeFont
+	filterTypeWebSocket
+	filterTypePing
+	filterTypeOther
+	filterTypeDocument
+	filterTypeElemHide
+	filterTypeGenericHide
+
+	// Types a filter applies to when it names none. $document and the
+	// element hiding types must be requested explicitly.
+	filterTypeDefault = filterTypeDocument - 1
+)
+
+var filterTypeOptions = map[string]uint32{
+	"script":            filterTypeScript,
+	"image":             filterTypeImage,
+	"stylesheet":        filterTypeStylesheet,
+	"css":               filterTypeStylesheet,
+	"object":            filterTypeObject,
+	"object-subrequest": filterTypeObject,
+	"xmlhttprequest":    filterTypeXHR,
+	"xhr":               filterTypeXHR,
+	"subdocument":       filterTypeSubdocument,
+	"frame":             filterTypeSubdocument,
+	"media":             filterTypeMedia,
+	"font":              filterTypeFont,
+	"websocket":         filterTypeWebSocket,
+	"ping":              filterTypePing,
+	"beacon":            filterTypePing,
+	"other":             filterTypeOther,
+	"document":          filterTypeDocument,
+	"doc":               filterTypeDocument,
+	"elemhide":          filterTypeElemHide,
+	"ehide":             filterTypeElemHide,
+	"generichide":       filterTypeGenericHide,
+	"ghide":             filterTypeGenericHide,
+}
+
+// filterTypeForDestination maps a fetch destination (Sec-Fetch-Dest) to a filter type.
+func filterTypeForDestination(destination string) uint32 {
+	switch destination {
+	case "script", "worker", "sharedworker", "serviceworker", "audioworklet", "paintworklet":
+		return filterTypeScript
+	case "image":
+		return filterTypeImage
+	case "style":
+		return filterTypeStylesheet
+	case "object", "embed":
+		return filterTypeObject
+	case "", "empty":
+		return filterTypeXHR
+	case "iframe", "frame":
+		return filterTypeSubdocument
+	case "audio", "video", "track":
+		return filterTypeMedia
+	case "font":
+		return filterTypeFont
+	case "document":
+		return filterTypeDocument
+	case "report":
+		return filterTypePing
+	}
+	return filterTypeOther
+}
+
+// networkFilter is a parsed blocking (or @@exception) rule.
+type networkFilter struct {
+	raw            string
+	pattern        string         // Lowercased unless matchCase; may contain * and ^
+	regex          *regexp.Regexp // For /regex/ rules
+	anchorDomain   bool           // ||
+	anchorStart    bool           // |
+	anchorEnd      bool           // trailing |
+	isException    bool
+	important      bool
+	matchCase      bool
+	thirdParty     int // 0: any, 1: third-party only, -1: first-party only
+	types          uint32
+	includeDomains []string
+	excludeDomains []string
+}
+
+// cosmeticFilter is an element hiding rule (domains##selector).
+type cosmeticFilter struct {
+	selector       string
+	includeDomains []string
+	excludeDomains []string
+}
+
+// filterEngine holds the rules loaded from the configured filter lists. Network
+// filters are indexed by a token that any matching URL must contain, so only a
+// handful of candidates are checked per request.
+type filterEngine struct {
+	blockingByToken   map[string][]*networkFilter
+	blockingUntokened []*networkFilter
+	exceptionByToken  map[string][]*networkFilter
+	exceptionUntoken  []*networkFilter
+
+	genericCosmetic   []cosmeticFilter
+	specificCosmetic  map[string][]cosmeticFilter // By included domain
+	cosmeticException map[string][]string         // Selector -> domains (empty: everywhere)
+
+	networkCount  int
+	cosmeticCount int
+}
+
+func newFilterEngine() *filterEngine {
+	return &filterEngine{
+		blockingByToken:   make(map[string][]*networkFilter),
+		exceptionByToken:  make(map[string][]*networkFilter),
+		specificCosmetic:  make(map[string][]cosmeticFilter),
+		cosmeticException: make(map[string][]string),
+	}
+}
+
+// loadFilterLists parses the given Adblock Plus format list files.
+// Unreadable files are logged and skipped.
+func loadFilterLists(paths []string) *filterEngine {
+	engine := newFilterEngine()
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Printf("Filters: Error opening filter list %s: %v", path, err)
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		lines, skipped := 0, 0
+		for scanner.Scan() {
+			lines++
+			if !engine.addRule(scanner.Text()) {
+				skipped++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("Filters: Error reading filter list %s: %v", path, err)
+		}
+		file.Close()
+		log.Printf("Filters: Loaded %s (%d lines, %d comments or unsupported rules skipped)", path, lines, skipped)
+	}
+	log.Printf("Filters: %d network rules (%d unindexed) and %d cosmetic rules active",
+		engine.networkCount, len(engine.blockingUntokened)+len(engine.exceptionUntoken), engine.cosmeticCount)
+	return engine
+}
+
+// addRule parses one filter list line. It returns false for comments, blank lines
+// and rules using syntax this engine does not support (extended CSS, scriptlets,
+// redirects, ...), which are skipped rather than approximated.
+func (e *filterEngine) addRule(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return false
+	}
+
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		rest := line[idx:]
+		switch {
+		case strings.HasPrefix(rest, "##"):
+			return e.addCosmeticRule(line[:idx], rest[2:], false)
+		case strings.HasPrefix(rest, "#@#"):
+			return e.addCosmeticRule(line[:idx], rest[3:], true)
+		case strings.HasPrefix(rest, "#?#"), strings.HasPrefix(rest, "#$#"), strings.HasPrefix(rest, "#%#"), strings.HasPrefix(rest, "#@"):
+			return false
+		}
+	}
+
+	filter, ok := parseNetworkFilter(line)
+	if !ok {
+		return false
+	}
+	token := filterToken(filter)
+	switch {
+	case filter.isException && token != "":
+		e.exceptionByToken[token] = append(e.exceptionByToken[token], filter)
+	case filter.isException:
+		e.exceptionUntoken = append(e.exceptionUntoken, filter)
+	case token != "":
+		e.blockingByToken[token] = append(e.blockingByToken[token], filter)
+	default:
+		e.blockingUntokened = append(e.blockingUntokened, filter)
+	}
+	e.networkCount++
+	return true
+}
+
+func (e *filterEngine) addCosmeticRule(domainList string, selector string, isException bool) bool {
+	selector = strings.TrimSpace(selector)
+	// Selectors end up inside a stylesheet; anything that could close the rule or
+	// the surrounding markup is rejected.
+	if selector == "" || strings.ContainsAny(selector, "{}<") || strings.HasPrefix(selector, "+js(") {
+		return false
+	}
+	includeDomains, excludeDomains := parseFilterDomains(domainList, ",")
+
+	if isException {
+		e.cosmeticException[selector] = append(e.cosmeticException[selector], includeDomains...)
+		if len(includeDomains) == 0 {
+			e.cosmeticException[selector] = append(e.cosmeticException[selector], "")
+		}
+		e.cosmeticCount++
+		return true
+	}
+
+	rule := cosmeticFilter{selector: selector, includeDomains: includeDomains, excludeDomains: excludeDomains}
+	if len(includeDomains) == 0 {
+		e.genericCosmetic = append(e.genericCosmetic, rule)
+	} else {
+		for _, domain := range includeDomains {
+			e.specificCosmetic[domain] = append(e.specificCosmetic[domain], rule)
+		}
+	}
+	e.cosmeticCount++
+	return true
+}
+
+// parseFilterDomains splits a domain list ("a.com,~b.a.com" or "a.com|~b.a.com")
+// into included and excluded (~) domains.
+func parseFilterDomains(domainList string, separator string) (include []string, exclude []string) {
+	for _, domain := range strings.Split(domainList, separator) {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if strings.HasPrefix(domain, "~") {
+			if d := domain[1:]; d != "" {
+				exclude = append(exclude, d)
+			}
+		} else if domain != "" {
+			include = append(include, domain)
+		}
+	}
+	return include, exclude
+}
+
+// parseNetworkFilter parses a blocking or exception rule with its $options.
+func parseNetworkFilter(line string) (*networkFilter, bool) {
+	filter := &networkFilter{raw: line}
+	if strings.HasPrefix(line, "@@") {
+		filter.isException = true
+		line = line[2:]
+	}
+
+	// Options follow the last '$', unless the rule is a /regex/ without options.
+	if idx := strings.LastIndex(line, "$"); idx >= 0 && !(strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/")) {
+		options := line[idx+1:]
+		line = line[:idx]
+		negatedTypes := uint32(0)
+		for _, option := range strings.Split(options, ",") {
+			option = strings.TrimSpace(option)
+			lowerOption := strings.ToLower(option)
+			negated := strings.HasPrefix(lowerOption, "~")
+			name := strings.TrimPrefix(lowerOption, "~")
+			switch {
+			case name == "third-party" || name == "3p":
+				filter.thirdParty = 1
+				if negated {
+					filter.thirdParty = -1
+				}
+			case name == "first-party" || name == "1p":
+				filter.thirdParty = -1
+				if negated {
+					filter.thirdParty = 1
+				}
+			case name == "match-case":
+				filter.matchCase = true
+			case name == "important":
+				filter.important = true
+			case name == "collapse":
+				// Cosmetic hint only.
+			case strings.HasPrefix(lowerOption, "domain="):
+				filter.includeDomains, filter.excludeDomains = parseFilterDomains(option[len("domain="):], "|")
+			default:
+				typeBit, known := filterTypeOptions[name]
+				if !known {
+					return nil, false
+				}
+				if negated {
+					negatedTypes |= typeBit
+				} else {
+					filter.types |= typeBit
+				}
+			}
+		}
+		if filter.types == 0 {
+			filter.types = filterTypeDefault
+		}
+		filter.types &^= negatedTypes
+	} else {
+		filter.types = filterTypeDefault
+	}
+
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		expr := line[1 : len(line)-1]
+		if !filter.matchCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, false
+		}
+		filter.regex = re
+		return filter, true
+	}
+
+	if strings.HasPrefix(line, "||") {
+		filter.anchorDomain = true
+		line = line[2:]
+	} else if strings.HasPrefix(line, "|") {
+		filter.anchorStart = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "|") {
+		filter.anchorEnd = true
+		line = line[:len(line)-1]
+	}
+	if !filter.matchCase {
+		line = strings.ToLower(line)
+	}
+	filter.pattern = line
+	return filter, true
+}
+
+func isFilterTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '%'
+}
+
+// filterToken picks the longest run of token characters in the pattern that is
+// guaranteed to appear as a whole token in every matching URL: it may not touch
+// a wildcard, and may sit at a pattern edge only where that edge is anchored.
+func filterToken(filter *networkFilter) string {
+	if filter.regex != nil {
+		return ""
+	}
+	pattern := strings.ToLower(filter.pattern)
+	best := ""
+	for i := 0; i < len(pattern); {
+		if !isFilterTokenChar(pattern[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(pattern) && isFilterTokenChar(pattern[j]) {
+			j++
+		}
+		startOK := (i > 0 && pattern[i-1] != '*') || (i == 0 && (filter.anchorStart || filter.anchorDomain))
+		endOK := (j < len(pattern) && pattern[j] != '*') || (j == len(pattern) && filter.anchorEnd)
+		if startOK && endOK && j-i >= 2 && j-i > len(best) {
+			best = pattern[i:j]
+		}
+		i = j
+	}
+	return best
+}
+
+// urlFilterTokens returns the set of tokens in a lowercased URL.
+func urlFilterTokens(lowerURL string) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(lowerURL); {
+		if !isFilterTokenChar(lowerURL[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(lowerURL) && isFilterTokenChar(lowerURL[j]) {
+			j++
+		}
+		if token := lowerURL[i:j]; !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+		i = j
+	}
+	return tokens
+}
+
+// isFilterSeparator reports whether c matches the ^ placeholder.
+func isFilterSeparator(c byte) bool {
+	return !(isFilterTokenChar(c) || c == '_' || c == '-' || c == '.')
+}
+
+// matchFilterPatternAt matches a pattern with * and ^ against s starting at
+// position 0. Without anchorEnd, trailing input is allowed.
+func matchFilterPatternAt(pattern string, s string, anchorEnd bool) bool {
+	pi, si := 0, 0
+	starPi, starSi := -1, 0
+	for {
+		if pi == len(pattern) {
+			if !anchorEnd || si == len(s) {
+				return true
+			}
+		} else if pattern[pi] == '*' {
+			starPi, starSi = pi, si
+			pi++
+			continue
+		} else if si < len(s) && (pattern[pi] == s[si] || (pattern[pi] == '^' && isFilterSeparator(s[si]))) {
+			pi++
+			si++
+			continue
+		} else if si == len(s) && pattern[pi] == '^' {
+			// ^ also matches the end of the address.
+			pi++
+			continue
+		}
+		if starPi < 0 || starSi >= len(s) {
+			return false
+		}
+		starSi++
+		pi, si = starPi+1, starSi
+	}
+}
+
+// filterRequest describes a request being checked against the filters.
+type filterRequest struct {
+	url          string // Full target URL
+	lowerURL     string
+	host         string
+	resourceType uint32
+	pageHost     string // Host of the page that issued the request ("" if unknown)
+	isThirdParty bool
+}
+
+func newFilterRequest(targetURL *url.URL, resourceType uint32, pageURL *url.URL) filterRequest {
+	req := filterRequest{
+		url:          targetURL.String(),
+		host:         strings.ToLower(targetURL.Hostname()),
+		resourceType: resourceType,
+	}
+	req.lowerURL = strings.ToLower(req.url)
+	if pageURL != nil {
+		req.pageHost = strings.ToLower(pageURL.Hostname())
+		req.isThirdParty = siteOfHost(req.host) != siteOfHost(req.pageHost)
+	}
+	return req
+}
+
+// hostMatchesFilterDomain reports whether host is domain or one of its subdomains.
+func hostMatchesFilterDomain(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func (f *networkFilter) matches(req filterRequest) bool {
+	if f.types&req.resourceType == 0 {
+		return false
+	}
+	if f.thirdParty == 1 && !req.isThirdParty || f.thirdParty == -1 && req.isThirdParty {
+		return false
+	}
+	if len(f.includeDomains) > 0 || len(f.excludeDomains) > 0 {
+		for _, domain := range f.excludeDomains {
+			if hostMatchesFilterDomain(req.pageHost, domain) {
+				return false
+			}
+		}
+		if len(f.includeDomains) > 0 {
+			included := false
+			for _, domain := range f.includeDomains {
+				if hostMatchesFilterDomain(req.pageHost, domain) {
+					included = true
+					break
+				}
+			}
+			if !included {
+				return false
+			}
+		}
+	}
+
+	if f.regex != nil {
+		return f.regex.MatchString(req.url)
+	}
+	subject := req.lowerURL
+	if f.matchCase {
+		subject = req.url
+	}
+	switch {
+	case f.anchorStart:
+		return matchFilterPatternAt(f.pattern, subject, f.anchorEnd)
+	case f.anchorDomain:
+		// The pattern must start at the host or at one of its label boundaries.
+		hostStart := strings.Index(subject, "://")
+		if hostStart < 0 {
+			return false
+		}
+		hostStart += 3
+		hostEnd := hostStart + len(req.host)
+		for i := hostStart; i < hostEnd && i < len(subject); i++ {
+			if (i == hostStart || subject[i-1] == '.') && matchFilterPatternAt(f.pattern, subject[i:], f.anchorEnd) {
+				return true
+			}
+		}
+		return false
+	default:
+		for i := 0; i <= len(subject); i++ {
+			if matchFilterPatternAt(f.pattern, subject[i:], f.anchorEnd) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// firstMatch returns the first filter in the token index or untokened list that matches.
+func firstMatch(byToken map[string][]*networkFilter, untokened []*networkFilter, tokens []string, req filterRequest, importantOnly bool) *networkFilter {
+	for _, token := range tokens {
+		for _, filter := range byToken[token] {
+			if (!importantOnly || filter.important) && filter.matches(req) {
+				return filter
+			}
+		}
+	}
+	for _, filter := range untokened {
+		if (!importantOnly || filter.important) && filter.matches(req) {
+			return filter
+		}
+	}
+	return nil
+}
+
+// pageAllowlisted reports whether an exception rule of the given type
+// ($document, $elemhide, $generichide) covers the page itself.
+func (e *filterEngine) pageAllowlisted(pageURL *url.URL, typeBit uint32) bool {
+	if pageURL == nil {
+		return false
+	}
+	req := newFilterRequest(pageURL, typeBit, pageURL)
+	return firstMatch(e.exceptionByToken, e.exceptionUntoken, urlFilterTokens(req.lowerURL), req, false) != nil
+}
+
+// shouldBlock checks a request against the network filters. $important rules win
+// over exceptions; otherwise any matching exception allows the request.
+func (e *filterEngine) shouldBlock(targetURL *url.URL, resourceType uint32, pageURL *url.URL) (*networkFilter, bool) {
+	if e.pageAllowlisted(pageURL, filterTypeDocument) {
+		return nil, false
+	}
+	req := newFilterRequest(targetURL, resourceType, pageURL)
+	tokens := urlFilterTokens(req.lowerURL)
+
+	if important := firstMatch(e.blockingByToken, e.blockingUntokened, tokens, req, true); important != nil {
+		return important, true
+	}
+	blocking := firstMatch(e.blockingByToken, e.blockingUntokened, tokens, req, false)
+	if blocking == nil {
+		return nil, false
+	}
+	if exception := firstMatch(e.exceptionByToken, e.exceptionUntoken, tokens, req, false); exception != nil {
+		return nil, false
+	}
+	return blocking, true
+}
+
+// cosmeticCSS returns the element hiding stylesheet for a page. Selectors are
+// grouped so that one selector the browser does not understand only disables
+// its own group, not the whole sheet.
+func (e *filterEngine) cosmeticCSS(pageURL *url.URL) string {
+	if e.pageAllowlisted(pageURL, filterTypeElemHide) || e.pageAllowlisted(pageURL, filterTypeDocument) {
+		return ""
+	}
+	pageHost := strings.ToLower(pageURL.Hostname())
+
+	excepted := func(selector string) bool {
+		for _, domain := range e.cosmeticException[selector] {
+			if domain == "" || hostMatchesFilterDomain(pageHost, domain) {
+				return true
+			}
+		}
+		return false
+	}
+	excluded := func(rule cosmeticFilter) bool {
+		for _, domain := range rule.excludeDomains {
+			if hostMatchesFilterDomain(pageHost, domain) {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := make(map[string]bool)
+	var selectors []string
+	add := func(rule cosmeticFilter) {
+		if !seen[rule.selector] && !excluded(rule) && !excepted(rule.selector) {
+			seen[rule.selector] = true
+			selectors = append(selectors, rule.selector)
+		}
+	}
+	// Specific rules for the host and each parent domain.
+	labels := strings.Split(pageHost, ".")
+	for i := range labels {
+		for _, rule := range e.specificCosmetic[strings.Join(labels[i:], ".")] {
+			add(rule)
+		}
+	}
+	if !e.pageAllowlisted(pageURL, filterTypeGenericHide) {
+		for _, rule := range e.genericCosmetic {
+			add(rule)
+		}
+	}
+	if len(selectors) == 0 {
+		return ""
+	}
+
+	const selectorsPerRule = 50
+	var sb strings.Builder
+	for start := 0; start < len(selectors); start += selectorsPerRule {
+		end := start + selectorsPerRule
+		if end > len(selectors) {
+			end = len(selectors)
+		}
+		sb.WriteString(strings.Join(selectors[start:end], ",\n"))
+		sb.WriteString(" { display: none !important; }\n")
+	}
+	return sb.String()
+}
+
+// --- Blocked Request Accounting ---
+
+const (
+	blockedCountPageTTL  = 30 * time.Minute
+	maxBlockedCountPages = 10000
+)
+
+// blockedCountPage counts the blocked requests of one proxied page load.
+type blockedCountPage struct {
+	TargetURL       string
+	UserID          string // requestUserID of the page's request
+	Expires         time.Time
+	BlockedRequests int // Requests from this page rejected by the filter lists
+}
+
+// blockedCountPageKey identifies the loads of one page by one user.
+type blockedCountPageKey struct {
+	UserID    string
+	TargetURL string
+}
+
+var (
+	blockedCountPagesMu sync.Mutex
+	blockedCountPages   = make(map[string]blockedCountPage) // By token
+	// Token of the latest load of each page, for recordBlockedRequest.
+	latestBlockedCountPages = make(map[blockedCountPageKey]string)
+)
+
+// registerBlockedCountPage starts counting the blocked requests of a served page
+// under a fresh token. The token is handed to the page by makeInjectedHTML, which
+// polls the count with it (see serveBlockedCount).
+func registerBlockedCountPage(targetURL *url.URL, userID string) string {
+	token := generateSecureNonce()
+	now := time.Now()
+
+	blockedCountPagesMu.Lock()
+	defer blockedCountPagesMu.Unlock()
+	if len(blockedCountPages) >= maxBlockedCountPages {
+		for t, page := range blockedCountPages {
+			if now.After(page.Expires) {
+				deleteBlockedCountPageLocked(t, page)
+			}
+		}
+		if len(blockedCountPages) >= maxBlockedCountPages {
+			log.Printf("Blocked counts: store full (%d entries). Not counting for %s", len(blockedCountPages), targetURL.String())
+			return ""
+		}
+	}
+	page := blockedCountPage{TargetURL: targetURL.String(), UserID: userID, Expires: now.Add(blockedCountPageTTL)}
+	blockedCountPages[token] = page
+	latestBlockedCountPages[blockedCountPageKey{userID, page.TargetURL}] = token
+	return token
+}
+
+// deleteBlockedCountPageLocked deletes the count of page under token.
+// blockedCountPagesMu must be held.
+func deleteBlockedCountPageLocked(token string, page blockedCountPage) {
+	delete(blockedCountPages, token)
+	key := blockedCountPageKey{page.UserID, page.TargetURL}
+	if latestBlockedCountPages[key] == token {
+		delete(latestBlockedCountPages, key)
+	}
+}
+
+// forgetBlockedCountPages deletes the counts of userID's pages and returns how
+// many were deleted.
+func forgetBlockedCountPages(userID string) int {
+	blockedCountPagesMu.Lock()
+	defer blockedCountPagesMu.Unlock()
+	removed := 0
+	for token, page := range blockedCountPages {
+		if page.UserID == userID {
+			deleteBlockedCountPageLocked(token, page)
+			removed++
+		}
+	}
+	return removed
+}
+
+// recordBlockedRequest counts a blocked request against the page that issued it:
+// userID's latest load of pageURL.
+func recordBlockedRequest(userID string, pageURL *url.URL) {
+	if pageURL == nil {
+		return
+	}
+	blockedCountPagesMu.Lock()
+	defer blockedCountPagesMu.Unlock()
+	latest := latestBlockedCountPages[blockedCountPageKey{userID, pageURL.String()}]
+	if page, ok := blockedCountPages[latest]; ok {
+		page.BlockedRequests++
+		blockedCountPages[latest] = page
+	}
+}
+
+// blockedRequestCount returns the number of requests blocked for a page, if it
+// was loaded by userID.
+func blockedRequestCount(token string, userID string) int {
+	blockedCountPagesMu.Lock()
+	defer blockedCountPagesMu.Unlock()
+	page, ok := blockedCountPages[token]
+	if !ok || page.UserID != userID {
+		return 0
+	}
+	return page.BlockedRequests
+}
+
+// blockFilteredRequest checks a proxy request against the filter lists and, if it
+// matches, rejects it before anything is fetched upstream. Returns true if the
+// request was blocked.
+func blockFilteredRequest(w http.ResponseWriter, r *http.Request, userID string, targetURL *url.URL) bool {
+	if activeFilters == nil {
+		return false
+	}
+	destination := requestDestination(r)
+	resourceType := filterTypeForDestination(destination)
+
+	var pageURL *url.URL
+	if resourceType == filterTypeDocument {
+		pageURL = targetURL
+	} else {
+		pageURL, _ = resolveNavigationBase(r)
+	}
+
+	filter, blocked := activeFilters.shouldBlock(targetURL, resourceType, pageURL)
+	if !blocked {
+		return false
+	}
+	log.Printf("Filters: Blocked %s (destination %q) by rule %q", targetURL.String(), destination, filter.raw)
+	if resourceType != filterTypeDocument {
+		recordBlockedRequest(userID, pageURL)
+	}
+
+	w.Header().Set("X-Proxy-Blocked", "filter")
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, fmt.Sprintf("Blocked by filter rule: %s", filter.raw), http.StatusForbidden)
+	return true
+}
+
+// serveFilterStylesheet serves the element hiding CSS for the page given in the
+// "url" query parameter. It is linked from every rewritten page.
+func serveFilterStylesheet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	pageURL, err := url.Parse(r.URL.Query().Get("url"))
+	if activeFilters == nil || err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		return
+	}
+	fmt.Fprint(w, activeFilters.cosmeticCSS(pageURL))
+}
+
+// serveBlockedCount reports the blocked request count for the current user's page
+// identified by the "token" query parameter (from registerBlockedCountPage).
+func serveBlockedCount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, `{"blocked":%d}`, blockedRequestCount(r.URL.Query().Get("token"), requestUserID(r)))
+}
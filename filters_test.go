@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestFilterEngine(t *testing.T, rules ...string) *filterEngine {
+	t.Helper()
+	engine := newFilterEngine()
+	for _, rule := range rules {
+		if !engine.addRule(rule) {
+			t.Fatalf("addRule(%q) refused the rule", rule)
+		}
+	}
+	return engine
+}
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", rawURL, err)
+	}
+	return u
+}
+
+func TestFilterToken(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"||ads.example.com^", "example"},
+		{"/banner/*", "banner"},
+		{"banner", ""},             // Both edges unanchored
+		{"|https://ads.", "https"}, // Start anchored
+		{"example.com|", "com"},    // Only the end is anchored
+		{"ad*server.com", ""},      // Every run touches a wildcard or a free edge
+		{"*tracker*", ""},
+		{"||a.b^", ""}, // Runs shorter than two characters
+		{"/ads[0-9]+/", ""},
+		{"@@||cdn.example.net/lib/*", "example"},
+		{"||Example.COM^$match-case", "example"}, // Tokens are always lowercase
+	}
+	for _, tt := range tests {
+		filter, ok := parseNetworkFilter(tt.rule)
+		if !ok {
+			t.Fatalf("parseNetworkFilter(%q) failed", tt.rule)
+		}
+		if got := filterToken(filter); got != tt.want {
+			t.Errorf("filterToken(%q) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestFilterEngineShouldBlock(t *testing.T) {
+	engine := newTestFilterEngine(t,
+		"||ads.example.com^",
+		"||tracker.example^",
+		"|https://pixel.example.org/p.gif|",
+		"/banner/*$image",
+		"||cdn.example.net^$third-party",
+		"||strict.example^$important",
+		"@@||strict.example^",
+		"||trk.example.net^",
+		"@@||trk.example.net/ok^",
+		"@@||allowed.example^$document",
+	)
+	tests := []struct {
+		name   string
+		target string
+		typ    uint32
+		page   string
+		want   bool
+	}{
+		{"^ at end of input", "https://ads.example.com", filterTypeScript, "https://news.example/", true},
+		{"^ before path", "https://ads.example.com/x.js", filterTypeScript, "https://news.example/", true},
+		{"^ not matching a dot", "https://ads.example.com.evil.net/", filterTypeScript, "https://news.example/", false},
+		{"|| at a label boundary", "https://sub.tracker.example/t", filterTypeXHR, "https://news.example/", true},
+		{"|| not inside a label", "https://badtracker.example/t", filterTypeXHR, "https://news.example/", false},
+		{"|| only in the host", "https://news.example/?u=tracker.example/", filterTypeXHR, "https://news.example/", false},
+		{"| anchored both ends", "https://pixel.example.org/p.gif", filterTypeImage, "https://news.example/", true},
+		{"| anchored end", "https://pixel.example.org/p.gif?x=1", filterTypeImage, "https://news.example/", false},
+		{"type option", "https://news.example/banner/1.png", filterTypeImage, "https://news.example/", true},
+		{"other type", "https://news.example/banner/1.js", filterTypeScript, "https://news.example/", false},
+		{"third party", "https://cdn.example.net/lib.js", filterTypeScript, "https://news.example/", true},
+		{"first party", "https://cdn.example.net/lib.js", filterTypeScript, "https://www.example.net/", false},
+		{"$important beats @@", "https://strict.example/x", filterTypeScript, "https://news.example/", true},
+		{"@@ beats a plain rule", "https://trk.example.net/ok", filterTypeXHR, "https://news.example/", false},
+		{"@@ only where it matches", "https://trk.example.net/pixel", filterTypeXHR, "https://news.example/", true},
+		{"$document exception on the page", "https://ads.example.com/x.js", filterTypeScript, "https://allowed.example/", false},
+	}
+	for _, tt := range tests {
+		_, got := engine.shouldBlock(mustParseURL(t, tt.target), tt.typ, mustParseURL(t, tt.page))
+		if got != tt.want {
+			t.Errorf("%s: shouldBlock(%s from %s) = %t, want %t", tt.name, tt.target, tt.page, got, tt.want)
+		}
+	}
+}
+
+func TestFilterEngineCosmeticCSS(t *testing.T) {
+	engine := newTestFilterEngine(t,
+		"##.ad",
+		"news.example##.sponsored",
+		"@@||news.example/live/$elemhide",
+		"@@|http://news.example/$generichide",
+	)
+	tests := []struct {
+		page    string
+		want    []string
+		wantNot []string
+	}{
+		{"https://news.example/story", []string{".ad", ".sponsored"}, nil},
+		{"https://news.example/live/feed", nil, []string{".ad", ".sponsored"}},
+		{"http://news.example/story", []string{".sponsored"}, []string{".ad"}},
+		{"https://other.example/", []string{".ad"}, []string{".sponsored"}},
+	}
+	for _, tt := range tests {
+		css := engine.cosmeticCSS(mustParseURL(t, tt.page))
+		for _, selector := range tt.want {
+			if !strings.Contains(css, selector+" {") && !strings.Contains(css, selector+",") {
+				t.Errorf("cosmeticCSS(%s) lacks %s:\n%s", tt.page, selector, css)
+			}
+		}
+		for _, selector := range tt.wantNot {
+			if strings.Contains(css, selector) {
+				t.Errorf("cosmeticCSS(%s) has %s:\n%s", tt.page, selector, css)
+			}
+		}
+	}
+}
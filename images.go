@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // Registers the GIF decoder with image.Decode
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// --- Data Saver (Image Transcoding & Placeholders) ---
+
+// maxTranscodePixels bounds the images the data saver will decode, so a small
+// compressed file cannot make the proxy allocate gigabytes.
+const maxTranscodePixels = 40 * 1000 * 1000
+
+var imageTranscodeCache = newContentCache(imageCacheMaxBytes)
+
+// isTranscodableImage reports whether the data saver can decode a response's media type.
+func isTranscodableImage(mediaType string) bool {
+	switch mediaType {
+	case "image/jpeg", "image/jpg", "image/pjpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// transcodeImageCached decodes a JPEG, PNG or GIF image, downscales it to fit
+// dataSaverMaxDimension and re-encodes it: opaque images as JPEG at
+// dataSaverJPEGQuality, images with transparency as PNG. A JPEG's EXIF orientation
+// is applied to the pixels, since re-encoding drops all metadata (EXIF, ICC, text
+// chunks). Animated GIFs keep only their first frame.
+// Returns the new body and its content type. Results are cached for site (see cacheSite).
+func transcodeImageCached(imageBytes []byte, site string) ([]byte, string, error) {
+	variant := fmt.Sprintf("image-v2:%d:%d", dataSaverMaxDimension, dataSaverJPEGQuality)
+	cacheKey := contentCacheKey(variant, imageBytes)
+	if cached, ok := imageTranscodeCache.Get(cacheKey, site); ok {
+		return cached[1:], transcodedContentType(cached[0]), nil
+	}
+
+	config, imageFormat, err := image.DecodeConfig(bytes.NewReader(imageBytes))
+	if err != nil {
+		return nil, "", fmt.Errorf("reading image header: %w", err)
+	}
+	if config.Width*config.Height > maxTranscodePixels {
+		return nil, "", fmt.Errorf("image too large to transcode (%dx%d)", config.Width, config.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(imageBytes))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding image: %w", err)
+	}
+
+	scaled := downscaleImage(decoded, dataSaverMaxDimension)
+	if imageFormat == "jpeg" {
+		scaled = orientImage(scaled, jpegEXIFOrientation(imageBytes))
+	}
+	var out bytes.Buffer
+	format := byte('j')
+	if scaled.Opaque() {
+		err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: dataSaverJPEGQuality})
+	} else {
+		format = 'p'
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&out, scaled)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("encoding image: %w", err)
+	}
+
+	// The format tag is stored in front of the cached body.
+	imageTranscodeCache.Put(cacheKey, site, append([]byte{format}, out.Bytes()...))
+	return out.Bytes(), transcodedContentType(format), nil
+}
+
+func transcodedContentType(format byte) string {
+	if format == 'p' {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// downscaleImage returns src as RGBA, box-filtered down so that neither side
+// exceeds maxDimension. Smaller images are only converted.
+func downscaleImage(src image.Image, maxDimension int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if maxDimension <= 0 || (srcW <= maxDimension && srcH <= maxDimension) {
+		return rgba
+	}
+	dstW, dstH := maxDimension, maxDimension
+	if srcW >= srcH {
+		dstH = srcH * maxDimension / srcW
+	} else {
+		dstW = srcW * maxDimension / srcH
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	// Each destination pixel averages the source pixels of its box. RGBA is
+	// alpha-premultiplied, so averaging the channels directly is correct.
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for dy := 0; dy < dstH; dy++ {
+		y0, y1 := dy*srcH/dstH, (dy+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dstW; dx++ {
+			x0, x1 := dx*srcW/dstW, (dx+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, count uint32
+			for y := y0; y < y1; y++ {
+				row := rgba.Pix[y*rgba.Stride+x0*4 : y*rgba.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint32(row[i])
+					g += uint32(row[i+1])
+					b += uint32(row[i+2])
+					a += uint32(row[i+3])
+					count++
+				}
+			}
+			offset := dy*dst.Stride + dx*4
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
+
+// jpegEXIFOrientation returns the Orientation tag (1-8) of a JPEG's EXIF data,
+// or 1 when there is none.
+func jpegEXIFOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 { // Start of scan, end of image
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the Orientation tag from the first IFD of TIFF data.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 { // Orientation, a SHORT stored in the value field
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orientImage returns src transformed as an EXIF orientation says it should be
+// displayed: mirrored (2, 4), rotated (3, 6, 8) or both (5, 7).
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
+
+// imagePlaceholderDataURL is shown in place of images until they are clicked.
+var imagePlaceholderDataURL = "data:image/svg+xml," + url.PathEscape(`<svg xmlns="http://www.w3.org/2000/svg" width="160" height="90" viewBox="0 0 160 90">`+
+	`<rect width="160" height="90" fill="#e5e7eb"/>`+
+	`<text x="80" y="50" font-family="sans-serif" font-size="12" fill="#4b5563" text-anchor="middle">Click to load image</text></svg>`)
+
+// applyImagePlaceholder swaps an <img> (or a <picture> <source>) for a
+// click-to-load placeholder. The already proxied src/srcset are parked in
+// data-proxy-src/data-proxy-srcset, where the script from makeInjectedHTML
+// restores them on click.
+func applyImagePlaceholder(n *html.Node) {
+	var kept []html.Attribute
+	var parked []html.Attribute
+	hasInlineSrc := false
+	for _, attr := range n.Attr {
+		switch strings.ToLower(attr.Key) {
+		case "src":
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(attr.Val)), "data:") {
+				kept = append(kept, attr)
+				hasInlineSrc = true
+				continue
+			}
+			parked = append(parked, html.Attribute{Key: "data-proxy-src", Val: attr.Val})
+		case "srcset":
+			parked = append(parked, html.Attribute{Key: "data-proxy-srcset", Val: attr.Val})
+		case "loading", "decoding":
+			continue
+		default:
+			kept = append(kept, attr)
+		}
+	}
+	if len(parked) == 0 {
+		return
+	}
+	if n.Data == "img" && !hasInlineSrc {
+		kept = append(kept, html.Attribute{Key: "src", Val: imagePlaceholderDataURL})
+	}
+	n.Attr = append(kept, parked...)
+}
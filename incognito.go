@@ -0,0 +1,284 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Incognito Sessions ---
+//
+// An incognito session gives the user a separate identity in every server-side
+// store (see requestUserID): its own cookie jar, preference records and user
+// content, the latter two seeded from the account when the session starts.
+// Nothing of it is written to the data directory. Ending the session, on
+// logout, after INCOGNITO_IDLE_TIMEOUT without a request, or when the auth
+// cookie it started under expires, deletes all of it along with the rewrite
+// cache entries and blocked request counts it used.
+
+const (
+	incognitoCookieName      = "proxy-incognito"
+	incognitoLoginCookieName = "proxy-login-incognito" // Carries the login page's choice to handleSubmitCodeToExternalCF
+	incognitoUserSeparator   = "#incognito-"
+	incognitoSweepInterval   = time.Minute
+)
+
+// incognitoSession is a running incognito session, by session ID.
+type incognitoSession struct {
+	AccountID   string // requestAccountID of the user who started it
+	Started     time.Time
+	LastSeen    time.Time
+	AuthExpires time.Time // Expiry of the auth cookie; zero if unknown
+}
+
+var (
+	incognitoMu          sync.Mutex
+	incognitoSessions    = make(map[string]*incognitoSession)
+	incognitoIdleTimeout = 30 * time.Minute
+)
+
+// incognitoUserID is the user ID an incognito session uses in the stores.
+func incognitoUserID(accountID string, sessionID string) string {
+	return accountID + incognitoUserSeparator + sessionID
+}
+
+// isIncognitoUserID reports whether userID belongs to an incognito session, whose
+// data must never be persisted.
+func isIncognitoUserID(userID string) bool {
+	return strings.Contains(userID, incognitoUserSeparator)
+}
+
+// incognitoUserEnded reports whether userID belongs to an incognito session that
+// is no longer running, whose stores have been deleted.
+func incognitoUserEnded(userID string) bool {
+	idx := strings.LastIndex(userID, incognitoUserSeparator)
+	if idx < 0 {
+		return false
+	}
+	incognitoMu.Lock()
+	defer incognitoMu.Unlock()
+	return incognitoSessions[userID[idx+len(incognitoUserSeparator):]] == nil
+}
+
+// ended reports whether the session is over at now.
+func (session *incognitoSession) ended(now time.Time) bool {
+	return now.Sub(session.LastSeen) > incognitoIdleTimeout || (!session.AuthExpires.IsZero() && now.After(session.AuthExpires))
+}
+
+// initIncognitoSessions starts ending idle and expired sessions in the background.
+func initIncognitoSessions() {
+	go func() {
+		for range time.Tick(incognitoSweepInterval) {
+			now := time.Now()
+			var ended []string
+			incognitoMu.Lock()
+			for sessionID, session := range incognitoSessions {
+				if session.ended(now) {
+					ended = append(ended, sessionID)
+				}
+			}
+			incognitoMu.Unlock()
+			for _, sessionID := range ended {
+				endIncognitoSession(sessionID, "timed out")
+			}
+		}
+	}()
+}
+
+// requestIncognitoSession returns the ID of the running incognito session named
+// by r's cookie, if it belongs to accountID, and marks it as used.
+func requestIncognitoSession(r *http.Request, accountID string) (string, bool) {
+	cookie, err := r.Cookie(incognitoCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	now := time.Now()
+	incognitoMu.Lock()
+	defer incognitoMu.Unlock()
+	session := incognitoSessions[cookie.Value]
+	if session == nil || session.AccountID != accountID || session.ended(now) {
+		return "", false
+	}
+	session.LastSeen = now
+	return cookie.Value, true
+}
+
+// startIncognitoSession starts a session for accountID and sets its cookie. The
+// session copies the account's preference records and user content.
+func startIncognitoSession(w http.ResponseWriter, r *http.Request, accountID string, authExpires time.Time) incognitoSession {
+	if cookie, err := r.Cookie(incognitoCookieName); err == nil {
+		endIncognitoSession(cookie.Value, "replaced")
+	}
+	sessionID := generateSecureNonce()
+	userID := incognitoUserID(accountID, sessionID)
+	now := time.Now()
+
+	sitePrefsMu.Lock()
+	if records := sitePrefsByUser[accountID]; len(records) > 0 {
+		copied := make(map[string]sitePreferenceRecord, len(records))
+		for key, record := range records {
+			flags := make(map[string]bool, len(record.Flags))
+			for flagKey, value := range record.Flags {
+				flags[flagKey] = value
+			}
+			copied[key] = sitePreferenceRecord{Profile: record.Profile, Flags: flags}
+		}
+		sitePrefsByUser[userID] = copied
+	}
+	sitePrefsMu.Unlock()
+	userContentMu.Lock()
+	if entries := userContentByUser[accountID]; len(entries) > 0 {
+		userContentByUser[userID] = append([]userContentEntry(nil), entries...)
+	}
+	userContentMu.Unlock()
+
+	session := incognitoSession{AccountID: accountID, Started: now, LastSeen: now, AuthExpires: authExpires}
+	incognitoMu.Lock()
+	incognitoSessions[sessionID] = &session
+	incognitoMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     incognitoCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("Incognito: Started a session for %s", accountID)
+	return session
+}
+
+// endIncognitoSession ends a session and deletes everything it stored.
+func endIncognitoSession(sessionID string, reason string) {
+	incognitoMu.Lock()
+	session := incognitoSessions[sessionID]
+	delete(incognitoSessions, sessionID)
+	incognitoMu.Unlock()
+	if session == nil {
+		return
+	}
+	userID := incognitoUserID(session.AccountID, sessionID)
+
+	cookies := dropCookieJar(userID)
+	sitePrefsMu.Lock()
+	delete(sitePrefsByUser, userID)
+	sitePrefsMu.Unlock()
+	userContentMu.Lock()
+	delete(userContentByUser, userID)
+	userContentMu.Unlock()
+	cacheEntries := jsRewriteCache.Forget(userID) + imageTranscodeCache.Forget(userID)
+	pages := forgetBlockedCountPages(userID)
+	log.Printf("Incognito: Session of %s %s. Deleted %d cookies, %d cache entries and %d blocked request counts.", session.AccountID, reason, cookies, cacheEntries, pages)
+}
+
+// expireIncognitoCookie removes the session cookie from the browser, and with it
+// the HTTP cache and the storage (localStorage, IndexedDB, ...) the session's
+// pages filled on the proxy origin.
+func expireIncognitoCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: incognitoCookieName, Value: "", Path: "/", MaxAge: -1})
+	w.Header().Set("Clear-Site-Data", `"cache", "storage"`)
+}
+
+// enforceIncognitoSession stops requests still carrying the cookie of a session
+// that has ended, so they do not fall back to the account's persistent stores.
+// The landing page is served (without the cookie) so the user can carry on.
+// Returns false when a response has been sent.
+func enforceIncognitoSession(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(incognitoCookieName)
+	if err != nil {
+		return true
+	}
+	if _, ok := requestIncognitoSession(r, requestAccountID(r)); ok {
+		return true
+	}
+	endIncognitoSession(cookie.Value, "expired")
+	expireIncognitoCookie(w)
+	if r.URL.Path == "/" {
+		return true
+	}
+	log.Printf("Incognito: Refused %s %s from an ended session", r.Method, r.URL.Path)
+	http.Error(w, "Your incognito session has ended. Open the proxy home page to continue.", http.StatusGone)
+	return false
+}
+
+// incognitoStatus is the body of GET /proxy-incognito.
+type incognitoStatus struct {
+	Active             bool      `json:"active"`
+	IdleTimeoutSeconds int       `json:"idleTimeoutSeconds"`
+	Started            time.Time `json:"started"`
+	AuthExpires        time.Time `json:"authExpires"` // Zero when the auth cookie does not expire
+}
+
+// serveIncognitoAPI reports, starts and ends the current user's incognito session:
+//
+//	GET       session status
+//	POST      start a session, ending any running one
+//	DELETE    end the running session
+func serveIncognitoAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowSettingsAPIRequest(w, r) {
+		return
+	}
+	accountID := requestAccountID(r)
+	sessionID, active := requestIncognitoSession(r, accountID)
+
+	switch r.Method {
+	case http.MethodGet:
+		status := incognitoStatus{Active: active, IdleTimeoutSeconds: int(incognitoIdleTimeout / time.Second)}
+		if active {
+			incognitoMu.Lock()
+			if session := incognitoSessions[sessionID]; session != nil {
+				status.Started = session.Started
+				status.AuthExpires = session.AuthExpires
+			}
+			incognitoMu.Unlock()
+		}
+		writeJSONResponse(w, http.StatusOK, status)
+	case http.MethodPost:
+		_, payload, _ := isCFAuthCookieValid(r)
+		session := startIncognitoSession(w, r, accountID, authExpiry(payload))
+		writeJSONResponse(w, http.StatusOK, incognitoStatus{Active: true, IdleTimeoutSeconds: int(incognitoIdleTimeout / time.Second), Started: session.Started, AuthExpires: session.AuthExpires})
+	case http.MethodDelete:
+		if active {
+			endIncognitoSession(sessionID, "ended by the user")
+		}
+		expireIncognitoCookie(w)
+		writeJSONResponse(w, http.StatusOK, incognitoStatus{IdleTimeoutSeconds: int(incognitoIdleTimeout / time.Second)})
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authExpiry returns when an auth cookie's token expires, or zero if it does not say.
+func authExpiry(payload *JWTPayload) time.Time {
+	if payload == nil || payload.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(payload.ExpiresAt, 0)
+}
+
+// handleLogout ends the incognito session, if any, and removes the proxy's
+// cookies, then returns to the login page.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clearSiteData := `"cache"`
+	if cookie, err := r.Cookie(incognitoCookieName); err == nil {
+		endIncognitoSession(cookie.Value, "logged out")
+		clearSiteData = `"cache", "storage"`
+	}
+	for _, cookie := range r.Cookies() {
+		if isProxyCookie(cookie.Name) {
+			http.SetCookie(w, &http.Cookie{Name: cookie.Name, Value: "", Path: "/", MaxAge: -1})
+		}
+	}
+	w.Header().Set("Clear-Site-Data", clearSiteData)
+	log.Printf("Auth: %s logged out", requestAccountID(r))
+	http.Redirect(w, r, "/auth/enter-email", http.StatusSeeOther)
+}
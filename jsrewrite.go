@@ -0,0 +1,761 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// --- JavaScript Tokenizer & Location Rewriter ---
+//
+// A lexical-level JavaScript tokenizer: enough to tell code from strings,
+// template literals, regular expressions and comments, so that references to
+// window.location, document.domain and friends can be redirected to the
+// proxy-aware accessors of the injected runtime (see embeddedRuntimeJSContent).
+// Every token keeps its raw text; untouched input is reproduced byte for byte.
+
+type jsTokenKind int
+
+const (
+	jsTokenWhitespace jsTokenKind = iota // Includes line terminators
+	jsTokenComment
+	jsTokenIdent // Identifiers and keywords
+	jsTokenNumber
+	jsTokenString
+	jsTokenTemplate // A literal chunk of a template: `...`, `...${, }...${ or }...`
+	jsTokenRegExp
+	jsTokenPunct
+)
+
+type jsToken struct {
+	kind jsTokenKind
+	raw  string
+}
+
+// jsPunctuators lists multi-character punctuators, longest first.
+var jsPunctuators = []string{
+	">>>=", "...", "===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=",
+	"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "**", "<<", ">>",
+}
+
+// jsKeywordsBeforeExpression are keywords after which a '/' starts a regular expression.
+var jsKeywordsBeforeExpression = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true,
+	"new": true, "delete": true, "void": true, "throw": true, "case": true,
+	"do": true, "else": true, "yield": true, "await": true,
+}
+
+func isJSIdentStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '$' || c == '\\' || c >= 0x80
+}
+
+func isJSIdentPart(c byte) bool {
+	return isJSIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isJSWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// jsRegExpAllowed reports whether a '/' following prev starts a regular expression
+// rather than a division operator.
+func jsRegExpAllowed(prev *jsToken) bool {
+	if prev == nil {
+		return true
+	}
+	switch prev.kind {
+	case jsTokenNumber, jsTokenString, jsTokenRegExp:
+		return false
+	case jsTokenTemplate:
+		return strings.HasSuffix(prev.raw, "${")
+	case jsTokenIdent:
+		return jsKeywordsBeforeExpression[prev.raw]
+	case jsTokenPunct:
+		return prev.raw != ")" && prev.raw != "]" && prev.raw != "}" && prev.raw != "++" && prev.raw != "--"
+	}
+	return true
+}
+
+// scanJSTemplateChunk scans template characters starting at s[i] until the closing
+// backtick or a substitution start. It returns the end index and whether the
+// chunk ended with "${".
+func scanJSTemplateChunk(s string, i int) (int, bool) {
+	for i < len(s) {
+		switch s[i] {
+		case '\\':
+			i += 2
+		case '`':
+			return i + 1, false
+		case '$':
+			if i+1 < len(s) && s[i+1] == '{' {
+				return i + 2, true
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	return len(s), false
+}
+
+// tokenizeJS splits JavaScript source into tokens. Concatenating the raw text of
+// the returned tokens reproduces the input exactly.
+func tokenizeJS(s string) []jsToken {
+	var tokens []jsToken
+	var prevSignificant *jsToken
+	var braceStack []bool // true for a template substitution, false for a plain brace
+
+	emit := func(kind jsTokenKind, raw string) {
+		tokens = append(tokens, jsToken{kind: kind, raw: raw})
+		if kind != jsTokenWhitespace && kind != jsTokenComment {
+			prevSignificant = &jsToken{kind: kind, raw: raw}
+		}
+	}
+
+	i := 0
+	for i < len(s) {
+		start := i
+		c := s[i]
+		switch {
+		case isJSWhitespace(c):
+			for i < len(s) && isJSWhitespace(s[i]) {
+				i++
+			}
+			emit(jsTokenWhitespace, s[start:i])
+		case c == '/' && i+1 < len(s) && s[i+1] == '/':
+			if end := strings.IndexAny(s[i:], "\n\r"); end >= 0 {
+				i += end
+			} else {
+				i = len(s)
+			}
+			emit(jsTokenComment, s[start:i])
+		case c == '/' && i+1 < len(s) && s[i+1] == '*':
+			if end := strings.Index(s[i+2:], "*/"); end >= 0 {
+				i += 2 + end + 2
+			} else {
+				i = len(s)
+			}
+			emit(jsTokenComment, s[start:i])
+		case c == '/' && jsRegExpAllowed(prevSignificant):
+			i++
+			inClass := false
+			for i < len(s) && s[i] != '\n' && s[i] != '\r' {
+				if s[i] == '\\' {
+					i += 2
+					continue
+				}
+				if s[i] == '[' {
+					inClass = true
+				} else if s[i] == ']' {
+					inClass = false
+				} else if s[i] == '/' && !inClass {
+					i++
+					break
+				}
+				i++
+			}
+			for i < len(s) && isJSIdentPart(s[i]) {
+				i++ // Flags
+			}
+			if i > len(s) {
+				i = len(s)
+			}
+			emit(jsTokenRegExp, s[start:i])
+		case c == '"' || c == '\'':
+			i++
+			for i < len(s) && s[i] != c && s[i] != '\n' {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i < len(s) && s[i] == c {
+				i++
+			}
+			if i > len(s) {
+				i = len(s)
+			}
+			emit(jsTokenString, s[start:i])
+		case c == '`':
+			end, opensSubstitution := scanJSTemplateChunk(s, i+1)
+			i = end
+			if opensSubstitution {
+				braceStack = append(braceStack, true)
+			}
+			emit(jsTokenTemplate, s[start:i])
+		case c == '}' && len(braceStack) > 0 && braceStack[len(braceStack)-1]:
+			braceStack = braceStack[:len(braceStack)-1]
+			end, opensSubstitution := scanJSTemplateChunk(s, i+1)
+			i = end
+			if opensSubstitution {
+				braceStack = append(braceStack, true)
+			}
+			emit(jsTokenTemplate, s[start:i])
+		case (c >= '0' && c <= '9') || (c == '.' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9'):
+			i++
+			for i < len(s) && (isJSIdentPart(s[i]) || s[i] == '.' ||
+				((s[i] == '+' || s[i] == '-') && (s[i-1] == 'e' || s[i-1] == 'E') && !strings.HasPrefix(strings.ToLower(s[start:i]), "0x"))) {
+				i++
+			}
+			emit(jsTokenNumber, s[start:i])
+		case isJSIdentStart(c):
+			for i < len(s) && isJSIdentPart(s[i]) {
+				if s[i] == '\\' {
+					i++ // Unicode escape in an identifier
+				}
+				i++
+			}
+			if i > len(s) {
+				i = len(s)
+			}
+			emit(jsTokenIdent, s[start:i])
+		default:
+			matched := ""
+			for _, punct := range jsPunctuators {
+				if strings.HasPrefix(s[i:], punct) {
+					matched = punct
+					break
+				}
+			}
+			if matched == "?." && i+2 < len(s) && s[i+2] >= '0' && s[i+2] <= '9' {
+				matched = "" // Conditional followed by a number, e.g. a?.5:1
+			}
+			if matched == "" {
+				matched = s[i : i+1]
+			}
+			i += len(matched)
+			switch matched {
+			case "{":
+				braceStack = append(braceStack, false)
+			case "}":
+				if len(braceStack) > 0 {
+					braceStack = braceStack[:len(braceStack)-1]
+				}
+			}
+			emit(jsTokenPunct, matched)
+		}
+	}
+	return tokens
+}
+
+// jsLocationHosts are the global objects whose .location is redirected.
+var jsLocationHosts = map[string]bool{
+	"window": true, "self": true, "globalThis": true, "top": true, "parent": true, "document": true,
+}
+
+// jsWindowOriginHosts are the global objects whose .origin is redirected.
+var jsWindowOriginHosts = map[string]bool{"window": true, "self": true, "globalThis": true}
+
+// jsDocumentProperties are document properties redirected to the runtime.
+var jsDocumentProperties = map[string]bool{"domain": true, "referrer": true, "URL": true}
+
+// jsStatementStarts are tokens after which a bare 'location =' is an assignment statement.
+var jsStatementStarts = map[string]bool{"": true, ";": true, "{": true, "}": true, ")": true, "=>": true, "else": true}
+
+// jsRuntimeAccessor returns a guarded reference to a runtime accessor that falls
+// back to the original object where the runtime is not loaded (e.g. in workers).
+func jsRuntimeAccessor(fallbackObject, property string) string {
+	return "(self.__proxyRuntime||" + fallbackObject + ")." + property
+}
+
+// jsNameShadowing reports, for each of the significant tokens sig, whether name
+// is bound there by a parameter or declaration rather than being the global. The
+// check is per function: a binding anywhere in a function (or, outside any
+// function, in the script) covers all of it, and patterns are matched loosely, so
+// doubtful cases count as shadowed.
+func jsNameShadowing(sig []jsToken, name string) []bool {
+	n := len(sig)
+	raw := func(i int) string {
+		if i < 0 || i >= n {
+			return ""
+		}
+		return sig[i].raw
+	}
+	opens := func(i int) bool {
+		tok := sig[i]
+		return (tok.kind == jsTokenPunct && (tok.raw == "(" || tok.raw == "[" || tok.raw == "{")) ||
+			(tok.kind == jsTokenTemplate && strings.HasSuffix(tok.raw, "${"))
+	}
+	closes := func(i int) bool {
+		tok := sig[i]
+		return (tok.kind == jsTokenPunct && (tok.raw == ")" || tok.raw == "]" || tok.raw == "}")) ||
+			(tok.kind == jsTokenTemplate && strings.HasPrefix(tok.raw, "}"))
+	}
+
+	// Matching brackets, by position of either end (-1 when unbalanced).
+	closer := make([]int, n)
+	opener := make([]int, n)
+	var stack []int
+	for i := range sig {
+		closer[i], opener[i] = -1, -1
+		if closes(i) && len(stack) > 0 {
+			open := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			closer[open], opener[i] = i, open
+		}
+		if opens(i) {
+			stack = append(stack, i)
+		}
+	}
+
+	isName := func(i int) bool {
+		return i >= 0 && i < n && sig[i].kind == jsTokenIdent && sig[i].raw == name && raw(i-1) != "." && raw(i-1) != "?."
+	}
+	// bindsIn reports whether the parameter list or pattern sig[from:to] binds name.
+	bindsIn := func(from, to int) bool {
+		for i := from; i < to; i++ {
+			if isName(i) {
+				switch raw(i + 1) {
+				case ",", ")", "]", "}", "=", "=>":
+					return true
+				}
+			}
+		}
+		return false
+	}
+	// expressionEnd returns the last position of the expression starting at i.
+	expressionEnd := func(i int) int {
+		for ; i < n; i++ {
+			if opens(i) {
+				if closer[i] < 0 {
+					return n - 1
+				}
+				i = closer[i]
+				continue
+			}
+			if closes(i) || (sig[i].kind == jsTokenPunct && (sig[i].raw == "," || sig[i].raw == ";")) {
+				return i - 1
+			}
+		}
+		return n - 1
+	}
+
+	type region struct{ start, end int } // Inclusive positions
+	var functions, shadowing []region
+	addFunction := func(start, paramsFrom, paramsTo, bodyEnd int) {
+		functions = append(functions, region{start, bodyEnd})
+		if bindsIn(paramsFrom, paramsTo) {
+			shadowing = append(shadowing, region{start, bodyEnd})
+		}
+	}
+	for i := 0; i < n; i++ {
+		switch {
+		case sig[i].kind == jsTokenPunct && sig[i].raw == "=>":
+			// (params) => body, or param => body
+			start, paramsFrom, paramsTo := i-1, i-1, i
+			if raw(i-1) == ")" && opener[i-1] >= 0 {
+				start, paramsFrom = opener[i-1], opener[i-1]+1
+				paramsTo = i - 1
+			} else if i == 0 || sig[i-1].kind != jsTokenIdent {
+				continue
+			}
+			bodyEnd := expressionEnd(i + 1)
+			if raw(i+1) == "{" && closer[i+1] >= 0 {
+				bodyEnd = closer[i+1]
+			}
+			addFunction(start, paramsFrom, paramsTo, bodyEnd)
+		case sig[i].kind == jsTokenPunct && sig[i].raw == "(" && closer[i] >= 0 && raw(closer[i]+1) == "{" && closer[closer[i]+1] >= 0:
+			// function f(params) {, method(params) {, catch (param) {
+			switch raw(i - 1) {
+			case "if", "for", "while", "switch", "with":
+				continue
+			}
+			addFunction(i, i+1, closer[i], closer[closer[i]+1])
+		}
+	}
+
+	// Declarations shadow name in the innermost function containing them.
+	shadowDeclaration := func(pos int) {
+		innermost := region{0, n - 1}
+		for _, f := range functions {
+			if f.start <= pos && pos <= f.end && f.end-f.start < innermost.end-innermost.start {
+				innermost = f
+			}
+		}
+		shadowing = append(shadowing, innermost)
+	}
+	for i := 0; i < n; i++ {
+		if sig[i].kind != jsTokenIdent {
+			continue
+		}
+		switch sig[i].raw {
+		case "function", "class":
+			if isName(i + 1) {
+				shadowDeclaration(i)
+			}
+		case "var", "let", "const":
+			// Each declarator's target is a name or a pattern, optionally followed
+			// by an initializer.
+			for j := i + 1; j < n; j++ {
+				if isName(j) {
+					shadowDeclaration(i)
+				} else if (raw(j) == "{" || raw(j) == "[") && closer[j] >= 0 {
+					if bindsIn(j+1, closer[j]) {
+						shadowDeclaration(i)
+					}
+					j = closer[j]
+				}
+				j++
+				if raw(j) == "=" {
+					j = expressionEnd(j+1) + 1
+				}
+				if raw(j) != "," {
+					break
+				}
+			}
+		}
+	}
+
+	shadowed := make([]bool, n)
+	for _, r := range shadowing {
+		for i := r.start; i <= r.end && i < n; i++ {
+			shadowed[i] = true
+		}
+	}
+	return shadowed
+}
+
+// rewriteJSLocationReferences redirects location, origin, document.domain,
+// document.referrer and document.URL references to the injected runtime. The
+// rewrite is lexical: member accesses on well-known globals, plus bare
+// 'location.x' and 'location =' statements where no parameter or declaration
+// of the enclosing function shadows the global location.
+func rewriteJSLocationReferences(jsContent string) string {
+	tokens := tokenizeJS(jsContent)
+
+	// Indexes of significant (non-whitespace, non-comment) tokens.
+	var significant []int
+	var significantTokens []jsToken
+	for idx, tok := range tokens {
+		if tok.kind != jsTokenWhitespace && tok.kind != jsTokenComment {
+			significant = append(significant, idx)
+			significantTokens = append(significantTokens, tok)
+		}
+	}
+	var locationShadowed []bool // Computed on the first bare location reference
+	sigRaw := func(pos int) string {
+		if pos < 0 || pos >= len(significant) {
+			return ""
+		}
+		return tokens[significant[pos]].raw
+	}
+	sigKind := func(pos int) jsTokenKind {
+		if pos < 0 || pos >= len(significant) {
+			return jsTokenWhitespace
+		}
+		return tokens[significant[pos]].kind
+	}
+
+	// precededByLineTerminator reports whether a newline separates the significant
+	// token at pos from the previous one (automatic semicolon insertion).
+	precededByLineTerminator := func(pos int) bool {
+		if pos <= 0 {
+			return true
+		}
+		for idx := significant[pos-1] + 1; idx < significant[pos]; idx++ {
+			if strings.ContainsAny(tokens[idx].raw, "\n\r") {
+				return true
+			}
+		}
+		return false
+	}
+
+	// asiGuard returns ";" when a replacement (which starts with '(') begins a line
+	// after a complete expression; without it the parenthesis would turn the
+	// previous line into a call.
+	asiGuard := func(pos int) string {
+		if pos <= 0 || !precededByLineTerminator(pos) {
+			return ""
+		}
+		prev := sigRaw(pos - 1)
+		switch sigKind(pos - 1) {
+		case jsTokenIdent:
+			if jsKeywordsBeforeExpression[prev] {
+				return ""
+			}
+			return ";"
+		case jsTokenNumber, jsTokenString, jsTokenRegExp:
+			return ";"
+		case jsTokenTemplate:
+			if strings.HasSuffix(prev, "`") && !strings.HasSuffix(prev, "\\`") {
+				return ";"
+			}
+		case jsTokenPunct:
+			switch prev {
+			case ")", "]", "}", "++", "--":
+				return ";"
+			}
+		}
+		return ""
+	}
+
+	replacements := make(map[int]string) // Token index -> replacement text
+	skipped := make(map[int]bool)        // Token indexes folded into a replacement
+
+	for pos := 0; pos < len(significant); pos++ {
+		if sigKind(pos) != jsTokenIdent {
+			continue
+		}
+		name := sigRaw(pos)
+		prev := sigRaw(pos - 1)
+		if prev == "." || prev == "?." {
+			continue // Property of something else, e.g. foo.window.location
+		}
+
+		// obj.location / obj.origin / document.domain ...
+		if sigRaw(pos+1) == "." && sigKind(pos+2) == jsTokenIdent {
+			property := sigRaw(pos + 2)
+			redirect := (jsLocationHosts[name] && property == "location") ||
+				(jsWindowOriginHosts[name] && property == "origin") ||
+				(name == "document" && jsDocumentProperties[property])
+			if redirect {
+				replacements[significant[pos]] = asiGuard(pos) + jsRuntimeAccessor(name, property)
+				for idx := significant[pos] + 1; idx <= significant[pos+2]; idx++ {
+					skipped[idx] = true
+				}
+				pos += 2
+				continue
+			}
+		}
+
+		// Bare location.x and 'location = ...' statements.
+		if name == "location" {
+			switch prev {
+			case "var", "let", "const", "function", "class", "import", "export":
+				continue
+			}
+			next := sigRaw(pos + 1)
+			if next == "." || (next == "=" && (jsStatementStarts[prev] || precededByLineTerminator(pos))) {
+				if locationShadowed == nil {
+					locationShadowed = jsNameShadowing(significantTokens, "location")
+				}
+				if !locationShadowed[pos] {
+					replacements[significant[pos]] = asiGuard(pos) + jsRuntimeAccessor("self", "location")
+				}
+			}
+		}
+	}
+
+	if len(replacements) == 0 {
+		return jsContent
+	}
+	var sb strings.Builder
+	sb.Grow(len(jsContent) + len(replacements)*32)
+	for idx, tok := range tokens {
+		if skipped[idx] {
+			continue
+		}
+		if replacement, ok := replacements[idx]; ok {
+			sb.WriteString(replacement)
+			continue
+		}
+		sb.WriteString(tok.raw)
+	}
+	return sb.String()
+}
+
+// jsRewriteCache holds rewritten scripts keyed by the hash of their original content.
+var jsRewriteCache = newContentCache(jsRewriteCacheMaxBytes)
+
+// rewriteJavaScriptCached applies rewriteJSLocationReferences, reusing earlier
+// results for identical script bodies. site is the cacheSite the script is used for.
+func rewriteJavaScriptCached(jsBytes []byte, site string) []byte {
+	key := contentCacheKey("js-location-v2", jsBytes)
+	if cached, ok := jsRewriteCache.Get(key, site); ok {
+		return cached
+	}
+	rewritten := []byte(rewriteJSLocationReferences(string(jsBytes)))
+	jsRewriteCache.Put(key, site, rewritten)
+	return rewritten
+}
+
+// isJavaScriptMIMEType reports whether a Content-Type or <script type> denotes JavaScript.
+func isJavaScriptMIMEType(mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if idx := strings.IndexByte(mimeType, ';'); idx >= 0 {
+		mimeType = strings.TrimSpace(mimeType[:idx])
+	}
+	switch mimeType {
+	case "application/javascript", "text/javascript", "application/x-javascript",
+		"application/ecmascript", "text/ecmascript", "module":
+		return true
+	}
+	return false
+}
+
+// isURLLikeModuleSpecifier reports whether an import specifier is a URL (absolute,
+// or relative with ./, ../ or /) rather than a bare name resolved via import maps.
+func isURLLikeModuleSpecifier(specifier string) bool {
+	if strings.HasPrefix(specifier, "./") || strings.HasPrefix(specifier, "../") || strings.HasPrefix(specifier, "/") {
+		return true
+	}
+	lowerSpecifier := strings.ToLower(specifier)
+	return strings.HasPrefix(lowerSpecifier, "http://") || strings.HasPrefix(lowerSpecifier, "https://")
+}
+
+// rewriteJSImportSpecifiers routes URL-like module specifiers through the proxy:
+// import "x", import ... from "x", export ... from "x" and import("x") with a
+// string literal. Relative specifiers are resolved against the module's own
+// target URL; bare specifiers are left for the (rewritten) import map.
+func rewriteJSImportSpecifiers(jsContent string, moduleURL *url.URL, clientReq *http.Request, blockTrackers bool) string {
+	if !strings.Contains(jsContent, "import") && !strings.Contains(jsContent, "from") {
+		return jsContent
+	}
+	tokens := tokenizeJS(jsContent)
+
+	var significant []int
+	for idx, tok := range tokens {
+		if tok.kind != jsTokenWhitespace && tok.kind != jsTokenComment {
+			significant = append(significant, idx)
+		}
+	}
+	sigTok := func(pos int) jsToken {
+		if pos < 0 || pos >= len(significant) {
+			return jsToken{kind: jsTokenWhitespace}
+		}
+		return tokens[significant[pos]]
+	}
+
+	changed := false
+	rewriteSpecifierAt := func(pos int) {
+		tok := sigTok(pos)
+		if tok.kind != jsTokenString || len(tok.raw) < 2 || strings.ContainsRune(tok.raw, '\\') {
+			return
+		}
+		quote := tok.raw[:1]
+		specifier := tok.raw[1 : len(tok.raw)-1]
+		if !isURLLikeModuleSpecifier(specifier) {
+			return
+		}
+		proxiedURL, err := rewriteProxiedURL(specifier, moduleURL, clientReq, blockTrackers)
+		if err != nil || proxiedURL == specifier {
+			return
+		}
+		tokens[significant[pos]].raw = quote + proxiedURL + quote
+		changed = true
+	}
+
+	for pos := 0; pos < len(significant); pos++ {
+		tok := sigTok(pos)
+		if tok.kind != jsTokenIdent {
+			continue
+		}
+		if prev := sigTok(pos - 1).raw; prev == "." || prev == "?." {
+			continue // Property access, e.g. Array.from or obj.import
+		}
+		switch tok.raw {
+		case "import":
+			if next := sigTok(pos + 1); next.kind == jsTokenString {
+				rewriteSpecifierAt(pos + 1) // import "x"
+			} else if next.raw == "(" {
+				if after := sigTok(pos + 3).raw; after == ")" || after == "," {
+					rewriteSpecifierAt(pos + 2) // import("x")
+				}
+			}
+		case "from":
+			// 'from' directly followed by a string only occurs in import/export declarations.
+			if sigTok(pos+1).kind == jsTokenString {
+				rewriteSpecifierAt(pos + 1)
+			}
+		}
+	}
+
+	if !changed {
+		return jsContent
+	}
+	var sb strings.Builder
+	sb.Grow(len(jsContent))
+	for _, tok := range tokens {
+		sb.WriteString(tok.raw)
+	}
+	return sb.String()
+}
+
+// rewriteImportMapAddress rewrites one import map key or value. Addresses ending
+// in "/" are prefix mappings, which cannot be expressed as ?url= proxy URLs; they
+// are left for the service worker to route.
+func rewriteImportMapAddress(address string, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) string {
+	if !isURLLikeModuleSpecifier(address) || strings.HasSuffix(address, "/") {
+		return address
+	}
+	if proxiedURL, err := rewriteProxiedURL(address, baseURL, clientReq, blockTrackers); err == nil {
+		return proxiedURL
+	}
+	return address
+}
+
+// rewriteImportMap rewrites the URL-like keys and the addresses of an import map's
+// "imports", "scopes" and "integrity" sections.
+func rewriteImportMap(importMapJSON string, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) (string, error) {
+	var importMap map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(importMapJSON), &importMap); err != nil {
+		return importMapJSON, fmt.Errorf("parsing import map: %w", err)
+	}
+
+	rewriteSpecifierMap := func(raw json.RawMessage) (json.RawMessage, error) {
+		var specifierMap map[string]string
+		if err := json.Unmarshal(raw, &specifierMap); err != nil {
+			return raw, err
+		}
+		rewritten := make(map[string]string, len(specifierMap))
+		for specifier, address := range specifierMap {
+			rewritten[rewriteImportMapAddress(specifier, baseURL, clientReq, blockTrackers)] = rewriteImportMapAddress(address, baseURL, clientReq, blockTrackers)
+		}
+		return json.Marshal(rewritten)
+	}
+
+	for _, section := range []string{"imports", "integrity"} {
+		if raw, ok := importMap[section]; ok {
+			rewritten, err := rewriteSpecifierMap(raw)
+			if err != nil {
+				return importMapJSON, fmt.Errorf("parsing import map %q: %w", section, err)
+			}
+			importMap[section] = rewritten
+		}
+	}
+	if raw, ok := importMap["scopes"]; ok {
+		var scopes map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &scopes); err != nil {
+			return importMapJSON, fmt.Errorf("parsing import map scopes: %w", err)
+		}
+		rewrittenScopes := make(map[string]json.RawMessage, len(scopes))
+		for scope, scopeMap := range scopes {
+			rewrittenScopeMap, err := rewriteSpecifierMap(scopeMap)
+			if err != nil {
+				return importMapJSON, fmt.Errorf("parsing import map scope %q: %w", scope, err)
+			}
+			rewrittenScopes[rewriteImportMapAddress(scope, baseURL, clientReq, blockTrackers)] = rewrittenScopeMap
+		}
+		rewrittenRaw, err := json.Marshal(rewrittenScopes)
+		if err != nil {
+			return importMapJSON, err
+		}
+		importMap["scopes"] = rewrittenRaw
+	}
+
+	out, err := json.Marshal(importMap)
+	if err != nil {
+		return importMapJSON, err
+	}
+	return string(out), nil
+}
+
+// rewriteJSModuleCached applies rewriteJSImportSpecifiers, caching by content and
+// by everything the output depends on (proxy origin, module URL and URL cleaning).
+func rewriteJSModuleCached(jsBytes []byte, moduleURL *url.URL, clientReq *http.Request, userID string, blockTrackers bool) []byte {
+	proxyScheme := "http"
+	if clientReq.TLS != nil || clientReq.Header.Get("X-Forwarded-Proto") == "https" {
+		proxyScheme = "https"
+	}
+	key := contentCacheKey(fmt.Sprintf("js-imports-v1|%s://%s|%s|%t", proxyScheme, clientReq.Host, moduleURL.String(), blockTrackers), jsBytes)
+	site := cacheSite(clientReq, userID, moduleURL)
+	if cached, ok := jsRewriteCache.Get(key, site); ok {
+		return cached
+	}
+	rewritten := []byte(rewriteJSImportSpecifiers(string(jsBytes), moduleURL, clientReq, blockTrackers))
+	jsRewriteCache.Put(key, site, rewritten)
+	return rewritten
+}
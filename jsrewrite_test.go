@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// jsTokensOfKind returns the raw text of the tokens of kind in s.
+func jsTokensOfKind(s string, kind jsTokenKind) []string {
+	var raws []string
+	for _, tok := range tokenizeJS(s) {
+		if tok.kind == kind {
+			raws = append(raws, tok.raw)
+		}
+	}
+	return raws
+}
+
+func TestTokenizeJSRoundTrip(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"a = b / c / d;",
+		"x = /[/]+/g.test(s) // trailing comment",
+		"`a${ `b${c}d` }e` + '\\'' + \"\\\"\"",
+		"/* unterminated comment",
+		"'unterminated string",
+		"`unterminated ${template",
+		"a?.b ?? c?.5:1",
+		"\\u0061bc = 1e+5 + 0x1E-2",
+	} {
+		var sb strings.Builder
+		for _, tok := range tokenizeJS(src) {
+			sb.WriteString(tok.raw)
+		}
+		if sb.String() != src {
+			t.Errorf("tokenizeJS(%q) reassembles to %q", src, sb.String())
+		}
+	}
+}
+
+func TestTokenizeJSRegExpOrDivision(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string // Regular expression literals
+	}{
+		{"a = b / c / d", nil},
+		{"x = /ab+c/gi.test(s)", []string{"/ab+c/gi"}},
+		{"return /x/.test(y)", []string{"/x/"}},
+		{"typeof /x/", []string{"/x/"}},
+		{"(a) / 2 / b", nil},
+		{"arr[0] / 2 / b", nil},
+		{"i++ / 2 / b", nil},
+		{"a = 1 /2/ 3", nil},
+		{"f(/[/]/, 1)", []string{"/[/]/"}},
+		{"s.replace(/\\//g, '')", []string{"/\\//g"}},
+		{"x = y // not a regexp /", nil},
+		{"`${a / b / c}`", nil},
+		{"`${ /re/.source }`", []string{"/re/"}},
+		{"{} /re/.test(s)", nil}, // Treated as division after a closing brace
+	}
+	for _, tt := range tests {
+		if got := jsTokensOfKind(tt.src, jsTokenRegExp); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeJS(%q) regexps = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestTokenizeJSTemplateNesting(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string // Template chunks
+	}{
+		{"`plain`", []string{"`plain`"}},
+		{"`a${b}c`", []string{"`a${", "}c`"}},
+		{"`a${ `b${c}d` }e`", []string{"`a${", "`b${", "}d`", "}e`"}},
+		{"`${ {a: 1}.a }`", []string{"`${", "}`"}},
+		{"`${a}${b}`", []string{"`${", "}${", "}`"}},
+		{"`\\${not} ${x}`", []string{"`\\${not} ${", "}`"}},
+		{"`a` + {b: `c`}", []string{"`a`", "`c`"}},
+	}
+	for _, tt := range tests {
+		if got := jsTokensOfKind(tt.src, jsTokenTemplate); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeJS(%q) templates = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteJSLocationReferences(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"bare location", "location.href = u", "(self.__proxyRuntime||self).location.href = u"},
+		{"bare assignment", "location = u", "(self.__proxyRuntime||self).location = u"},
+		{"window location", "window.location.href", "(self.__proxyRuntime||window).location.href"},
+		{"document property", "document.referrer", "(self.__proxyRuntime||document).referrer"},
+		{"other object", "obj.location.href", "obj.location.href"},
+		{"ASI guard", "a = b\nlocation.href = u", "a = b\n;(self.__proxyRuntime||self).location.href = u"},
+		{"parameter", "function f(location) { location.href = u }", "function f(location) { location.href = u }"},
+		{"arrow parameter", "const f = location => location.reload()", "const f = location => location.reload()"},
+		{"parenthesised arrow", "(a, location) => location.x", "(a, location) => location.x"},
+		{"method parameter", "class A { m(location) { location.x } }", "class A { m(location) { location.x } }"},
+		{"catch binding", "try {} catch (location) { location.x }", "try {} catch (location) { location.x }"},
+		{"var", "function f() { var location = 1; location.x }", "function f() { var location = 1; location.x }"},
+		{"destructuring", "function f() { let {location} = o; location.x }", "function f() { let {location} = o; location.x }"},
+		{"default value", "function f(a, location = b) { location.x }", "function f(a, location = b) { location.x }"},
+		{
+			"shadowing is per function",
+			"function g() { location.x }\nfunction f(location) { location.x }",
+			"function g() { (self.__proxyRuntime||self).location.x }\nfunction f(location) { location.x }",
+		},
+		{"if is no function", "if (location) { location.x }", "if (location) { (self.__proxyRuntime||self).location.x }"},
+	}
+	for _, tt := range tests {
+		if got := rewriteJSLocationReferences(tt.src); got != tt.want {
+			t.Errorf("%s: rewriteJSLocationReferences(%q) = %q, want %q", tt.name, tt.src, got, tt.want)
+		}
+	}
+}
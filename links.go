@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// --- Link Headers, Web App Manifests & Speculation Rules ---
+
+// manifestURLFields are web app manifest members holding a URL, at any depth
+// (icons[].src, shortcuts[].url, share_target.action, ...).
+var manifestURLFields = map[string]bool{
+	"start_url": true,
+	"scope":     true,
+	"src":       true,
+	"url":       true,
+	"action":    true,
+}
+
+// manifestDroppedFields are manifest members that cannot work through the proxy:
+// protocol handler templates carry a %s placeholder that would be escaped away, and
+// a manifest-declared service worker would compete with the proxy's own.
+var manifestDroppedFields = map[string]bool{
+	"protocol_handlers": true,
+	"serviceworker":     true,
+}
+
+// splitHeaderList splits a comma-separated header value, ignoring commas inside
+// <...> references and quoted strings.
+func splitHeaderList(value string) []string {
+	var parts []string
+	inAngle, inQuote := false, false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case inQuote:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuote = false
+			}
+		case c == '"':
+			inQuote = true
+		case c == '<':
+			inAngle = true
+		case c == '>':
+			inAngle = false
+		case c == ',' && !inAngle:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// linkParam returns the lowercased, unquoted value of a parameter in a Link
+// header entry ("rel", "as", ...), or "" when absent.
+func linkParam(params string, name string) string {
+	for _, param := range strings.Split(params, ";") {
+		key, val, found := strings.Cut(param, "=")
+		if found && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.ToLower(strings.Trim(strings.TrimSpace(val), `"`))
+		}
+	}
+	return ""
+}
+
+// rewriteLinkHeaderValue proxies the target of every entry in a Link header value
+// (preload, modulepreload, preconnect, ...). Script preloads are dropped when
+// JavaScript is disabled, and hints for a content class prefs block (image, font,
+// media and worker preloads, icons) likewise. ok is false when no entries remain.
+func rewriteLinkHeaderValue(value string, baseURL *url.URL, clientReq *http.Request, prefs sitePreferences, blockTrackers bool) (string, bool) {
+	var kept []string
+	for _, entry := range splitHeaderList(value) {
+		entry = strings.TrimSpace(entry)
+		if !strings.HasPrefix(entry, "<") {
+			continue
+		}
+		end := strings.IndexByte(entry, '>')
+		if end < 0 {
+			continue
+		}
+		target, params := entry[1:end], entry[end+1:]
+
+		rels := strings.Fields(linkParam(params, "rel"))
+		as := linkParam(params, "as")
+		if !prefs.JavaScriptEnabled {
+			isScriptHint := as == "script" || as == "worker" || as == "sharedworker" || as == "serviceworker"
+			for _, rel := range rels {
+				if rel == "modulepreload" {
+					isScriptHint = true
+				}
+			}
+			if isScriptHint {
+				continue
+			}
+		}
+		if contentClassBlocked(prefs, linkRelContentClass(rels, as)) {
+			continue
+		}
+
+		proxiedURL, err := rewriteProxiedURL(target, baseURL, clientReq, blockTrackers)
+		if err != nil || !strings.Contains(proxiedURL, proxyRequestPath+"?url=") {
+			continue
+		}
+		kept = append(kept, "<"+proxiedURL+">"+params)
+	}
+	if len(kept) == 0 {
+		return "", false
+	}
+	return strings.Join(kept, ", "), true
+}
+
+// rewriteSpeculationRulesHeader proxies the rule set URLs listed in a
+// Speculation-Rules header (a list of quoted strings).
+func rewriteSpeculationRulesHeader(value string, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) (string, bool) {
+	var kept []string
+	for _, entry := range splitHeaderList(value) {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 2 || entry[0] != '"' || entry[len(entry)-1] != '"' {
+			continue
+		}
+		proxiedURL, err := rewriteProxiedURL(entry[1:len(entry)-1], baseURL, clientReq, blockTrackers)
+		if err != nil || !strings.Contains(proxiedURL, proxyRequestPath+"?url=") {
+			continue
+		}
+		kept = append(kept, `"`+proxiedURL+`"`)
+	}
+	if len(kept) == 0 {
+		return "", false
+	}
+	return strings.Join(kept, ", "), true
+}
+
+// rewriteJSONURLFields walks decoded JSON and proxies string values (or arrays of
+// strings) stored under any of urlFields. Members in droppedFields are removed.
+func rewriteJSONURLFields(value interface{}, urlFields map[string]bool, droppedFields map[string]bool, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) interface{} {
+	rewriteString := func(s string) string {
+		if proxiedURL, err := rewriteProxiedURL(s, baseURL, clientReq, blockTrackers); err == nil {
+			return proxiedURL
+		}
+		return s
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, member := range v {
+			if droppedFields[key] {
+				delete(v, key)
+				continue
+			}
+			if urlFields[key] {
+				switch m := member.(type) {
+				case string:
+					v[key] = rewriteString(m)
+					continue
+				case []interface{}:
+					for i, item := range m {
+						if s, ok := item.(string); ok {
+							m[i] = rewriteString(s)
+						}
+					}
+					continue
+				}
+			}
+			v[key] = rewriteJSONURLFields(member, urlFields, droppedFields, baseURL, clientReq, blockTrackers)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = rewriteJSONURLFields(item, urlFields, droppedFields, baseURL, clientReq, blockTrackers)
+		}
+		return v
+	}
+	return value
+}
+
+// rewriteWebManifest rewrites the URL members of a web app manifest served from
+// manifestURL (start_url, scope, icons, shortcuts, screenshots, share_target).
+// Proxied URLs keep their target as an escaped prefix, so scope still contains
+// start_url after rewriting.
+func rewriteWebManifest(manifestJSON []byte, manifestURL *url.URL, clientReq *http.Request, blockTrackers bool) ([]byte, error) {
+	var manifest interface{}
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing web app manifest: %w", err)
+	}
+	return json.Marshal(rewriteJSONURLFields(manifest, manifestURLFields, manifestDroppedFields, manifestURL, clientReq, blockTrackers))
+}
+
+// rewriteSpeculationRules rewrites a speculation rules set (inline
+// <script type="speculationrules"> or an application/speculationrules+json body).
+// List rules get their URLs proxied. Document rules match link hrefs against
+// patterns written for the origin's URLs, which no longer hold once links point
+// at the proxy, so they are dropped.
+func rewriteSpeculationRules(rulesJSON []byte, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) ([]byte, error) {
+	var ruleSet map[string]interface{}
+	if err := json.Unmarshal(rulesJSON, &ruleSet); err != nil {
+		return nil, fmt.Errorf("parsing speculation rules: %w", err)
+	}
+	for action, rawRules := range ruleSet {
+		rules, ok := rawRules.([]interface{})
+		if !ok {
+			continue
+		}
+		var kept []interface{}
+		for _, rawRule := range rules {
+			rule, ok := rawRule.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, isDocumentRule := rule["where"]; isDocumentRule || rule["source"] == "document" {
+				continue
+			}
+			kept = append(kept, rewriteJSONURLFields(rule, map[string]bool{"urls": true}, nil, baseURL, clientReq, blockTrackers))
+		}
+		if len(kept) == 0 {
+			delete(ruleSet, action)
+		} else {
+			ruleSet[action] = kept
+		}
+	}
+	return json.Marshal(ruleSet)
+}
@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	stdhtml "html" // Standard library html, aliased to avoid conflict
@@ -14,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,13 +25,52 @@ import (
 // Configuration
 var (
 	listenPort string
-	// Default privacy settings
+	// Default privacy settings, before any stored preference record applies (see preferences.go)
 	defaultGlobalJSEnabled      = false
 	defaultGlobalCookiesEnabled = false
 	defaultGlobalIframesEnabled = false
 	defaultGlobalRawModeEnabled = false
 
 	authServiceURL string
+
+	// Lazy-load data attributes rewritten through the proxy, mapped to the real
+	// attribute they stand in for ("src", "srcset", "poster" or "background").
+	// Overridable with LAZY_LOAD_ATTRIBUTES, e.g. "data-src=src,data-bg=background".
+	lazyLoadAttributes = map[string]string{
+		"data-src":              "src",
+		"data-lazy-src":         "src",
+		"data-original":         "src",
+		"data-lazy":             "src",
+		"data-srcset":           "srcset",
+		"data-lazy-srcset":      "srcset",
+		"data-original-set":     "srcset",
+		"data-poster":           "poster",
+		"data-bg":               "background",
+		"data-background":       "background",
+		"data-background-image": "background",
+		"data-bg-src":           "background",
+	}
+	// When JavaScript is disabled, move lazy-load sources into src/srcset/style
+	// so images still render. Disable with PROMOTE_LAZY_ATTRIBUTES=false.
+	promoteLazyLoadAttrs = true
+	// Server-side rewriting of location/origin references in scripts.
+	// Enable with JS_REWRITE_ENABLED=true.
+	jsRewriteEnabled = false
+	// Data saver: images are downscaled to fit this many pixels on their longest
+	// side and re-encoded at this JPEG quality. Overridable with
+	// DATA_SAVER_MAX_DIMENSION and DATA_SAVER_JPEG_QUALITY.
+	dataSaverMaxDimension = 1024
+	dataSaverJPEGQuality  = 50
+	// Strip tracking parameters and unwrap redirect wrappers (see urlclean.go).
+	// Disable with URL_CLEANER_ENABLED=false; URL_CLEANER_RULES points at a
+	// ClearURLs rules file to use instead of the built-in rules.
+	urlCleanerEnabled = true
+	// Adblock Plus / EasyList format filter lists, loaded from the comma-separated
+	// file paths in FILTER_LISTS. nil when no lists are configured.
+	activeFilters *filterEngine
+	// Directory for server-side state (site preferences, user scripts and styles, site
+	// cookies), from DATA_DIR. When unset, that state is kept in memory only.
+	dataDir string
 )
 
 // Cookie names & Constants
@@ -38,16 +79,33 @@ const (
 	maxRedirects      = 5
 	proxyRequestPath  = "/proxy"
 	serviceWorkerPath = "/sw.js"
+	runtimeScriptPath = "/proxy-runtime.js"
+	filterCSSPath     = "/proxy-filters.css"
+	blockedCountPath  = "/proxy-blocked"
+	userContentPath   = "/proxy-usercontent"
+	sitePrefsPath     = "/proxy-prefs"
+	cookieJarPath     = "/proxy-cookies"
+	siteDataPath      = "/proxy-sitedata"
+	incognitoPath     = "/proxy-incognito"
 	fallbackNonce     = "ZmFsbGJhY2tOb25jZQ=="
+
+	// Page that issued a request relayed by the service worker.
+	clientURLHeader = "X-Proxy-Client-URL"
+
+	jsRewriteCacheMaxBytes = 64 << 20
+	imageCacheMaxBytes     = 128 << 20
 )
 
+// nonProxiedURLPrefixes are URL prefixes left untouched by rewriteProxiedURL and by
+// the injected runtime (see makeRuntimeJS), which share this list.
+var nonProxiedURLPrefixes = []string{"#", "javascript:", "mailto:", "tel:", "data:", "blob:"}
+
 // Regex for parsing forms (used in auth flow)
 var (
 	formActionRegex    = regexp.MustCompile(`(?is)<form[^>]*action\s*=\s*["']([^"']+)["'][^>]*>`)
 	hiddenInputRegex   = regexp.MustCompile(`(?is)<input[^>]*type\s*=\s*["']hidden["'][^>]*name\s*=\s*["']([^"']+)["'][^>]*value\s*=\s*["']([^"']*)["'][^>]*>`)
 	nonceInputRegex    = regexp.MustCompile(`(?is)<input[^>]*name\s*=\s*["']nonce["'][^>]*value\s*=\s*["']([^"']+)["']`)
 	codeInputFormRegex = regexp.MustCompile(`(?is)<form[^>]*action\s*=\s*["']([^"']*/cdn-cgi/access/callback[^"']*)["'][^>]*>`)
-	cssURLRegex        = regexp.MustCompile(`(?i)url\s*\(\s*(?:'([^']*)'|"([^"]*)"|([^)\s'"]+))\s*\)`)
 )
 
 // sitePreferences holds the privacy settings for a site.
@@ -56,6 +114,20 @@ type sitePreferences struct {
 	CookiesEnabled    bool
 	IframesEnabled    bool
 	RawModeEnabled    bool
+	ReaderModeEnabled bool // Serve only the extracted article (see reader.go)
+	DataSaverEnabled  bool // Downscale and re-encode images (see images.go)
+	ImagePlaceholders bool // Replace images with click-to-load placeholders
+	ImagesEnabled     bool // Content classes (see contentclasses.go)
+	MediaEnabled      bool
+	FontsEnabled      bool
+	WorkersEnabled    bool
+	FormsEnabled      bool
+
+	// Request-side policies, set by privacy profiles (see profiles.go)
+	Profile        string   // Name of the profile these preferences started from; "" for the built-in defaults
+	ReferrerPolicy string   // Referrer-Policy token applied to forwarded Referers
+	StripHeaders   []string // Request headers not forwarded upstream
+	BlockTrackers  bool     // Apply the filter lists and the URL cleaner
 }
 
 // JWTHeader represents the decoded header of a JWT
@@ -89,8 +161,13 @@ body {
 #bookmarks-list .bookmark-item:last-child {
     border-bottom: none;
 }
-.bookmark-prefs-emojis span { 
-    cursor: default; 
+.profile-badge {
+    cursor: default;
+    padding: 0.1rem 0.5rem;
+    border-radius: 9999px;
+    font-size: 0.75rem;
+    font-weight: 600;
+    white-space: nowrap;
 }
 details > summary {
   list-style-type: disclosure-open; 
@@ -110,18 +187,24 @@ details[open] > summary {
     font-size: 0.75rem; 
     font-weight: 500;
 }
-#global-settings-indicators span {
-    cursor: default; 
-		padding: 0.25rem 0.35rem; 
+.content-class-blocked {
+    cursor: default;
+    padding: 0.1rem 0.25rem;
     border-radius: 0.25rem;
-		font-size: 1rem; 
+    background-color: #fee2e2;
+}
+#global-settings-indicators .profile-badge {
+    padding: 0.25rem 0.6rem;
+    font-size: 0.875rem;
 }
 `
 
 // makeInjectedHTML generates the HTML for the proxy home button and an injected script
 // that includes GET form interception logic.
 // scriptNonce is used for the script tag's nonce attribute.
-func makeInjectedHTML(scriptNonce string) string {
+// blockedCountToken identifies this page for its blocked request count (see
+// registerBlockedCountPage).
+func makeInjectedHTML(scriptNonce string, blockedCountToken string) string {
 	var sb strings.Builder
 	sb.WriteString(`<style id="proxy-home-button-styles" type="text/css">
 #proxy-home-button {
@@ -153,9 +236,31 @@ func makeInjectedHTML(scriptNonce string) string {
     height: 24px !important;
     fill: currentColor !important;
 }
+#proxy-blocked-badge {
+    position: absolute !important;
+    top: -4px !important;
+    right: -4px !important;
+    min-width: 18px !important;
+    height: 18px !important;
+    padding: 0 4px !important;
+    border-radius: 9px !important;
+    background-color: #dc2626 !important;
+    color: white !important;
+    font: bold 11px/18px sans-serif !important;
+    text-align: center !important;
+    box-sizing: border-box !important;
+}
+#proxy-blocked-badge[hidden] {
+    display: none !important;
+}
 </style>
 <a href="/" id="proxy-home-button" title="Return to Proxy Home">
-    <svg viewBox="0 0 24 24" xmlns="http://www.w3.org/2000/svg"><path d="M10 20v-6h4v6h5v-8h3L12 3 2 12h3v8z"/></svg>
+    <svg viewBox="0 0 24 24" xmlns="http://www.w3.org/2000/svg"><path d="M10 20v-6h4v6h5v-8h3L12 3 2 12h3v8z"/></svg>`)
+	if activeFilters != nil {
+		sb.WriteString(`
+    <span id="proxy-blocked-badge" hidden></span>`)
+	}
+	sb.WriteString(`
 </a>`)
 
 	sb.WriteString(`<script nonce="`)
@@ -163,6 +268,58 @@ func makeInjectedHTML(scriptNonce string) string {
 	sb.WriteString(`">`)
 	sb.WriteString(`
 (function() {
+    // This page's token for its blocked request count.
+    const proxyBlockedCountToken = '`)
+	sb.WriteString(blockedCountToken)
+	sb.WriteString(`';
+
+    // Click-to-load for data saver image placeholders: restores the parked sources
+    // of the image (and of its <picture> sources) instead of following a link.
+    document.addEventListener('click', function(event) {
+        const img = event.target && event.target.closest ? event.target.closest('img[data-proxy-src], img[data-proxy-srcset]') : null;
+        if (!img) {
+            return;
+        }
+        event.preventDefault();
+        event.stopPropagation();
+        const restore = function(el) {
+            if (el.dataset.proxySrcset) {
+                el.setAttribute('srcset', el.dataset.proxySrcset);
+                el.removeAttribute('data-proxy-srcset');
+            }
+            if (el.dataset.proxySrc) {
+                el.setAttribute('src', el.dataset.proxySrc);
+                el.removeAttribute('data-proxy-src');
+            }
+        };
+        if (img.parentElement && img.parentElement.tagName === 'PICTURE') {
+            img.parentElement.querySelectorAll('source[data-proxy-srcset]').forEach(restore);
+        }
+        restore(img);
+    }, true);
+
+    // Shows how many requests from this page the filter lists have blocked.
+    // Polls with backoff, since blocked subresources keep arriving after load.
+    const blockedBadge = document.getElementById('proxy-blocked-badge');
+    if (blockedBadge && proxyBlockedCountToken) {
+        let pollDelay = 1000;
+        const pollBlockedCount = function() {
+            fetch('/proxy-blocked?token=' + encodeURIComponent(proxyBlockedCountToken), { credentials: 'same-origin' })
+                .then(response => response.json())
+                .then(data => {
+                    if (data.blocked > 0) {
+                        blockedBadge.textContent = data.blocked > 99 ? '99+' : String(data.blocked);
+                        blockedBadge.hidden = false;
+                        document.getElementById('proxy-home-button').title = 'Return to Proxy Home (' + data.blocked + ' requests blocked on this page)';
+                    }
+                })
+                .catch(e => console.warn('Proxy JS (injected): Error fetching blocked count:', e));
+            pollDelay = Math.min(pollDelay * 2, 30000);
+            setTimeout(pollBlockedCount, pollDelay);
+        };
+        setTimeout(pollBlockedCount, pollDelay);
+    }
+
     // Derives the original page's base URL from the current window.location (the proxy URL).
     let originalPageBaseURL = '';
     try {
@@ -255,6 +412,13 @@ self.addEventListener('fetch', event => {
         (
             requestUrl.pathname.startsWith('/auth/') || 
             requestUrl.pathname === '/sw.js' ||
+            requestUrl.pathname === '/proxy-runtime.js' ||
+            requestUrl.pathname === '/proxy-filters.css' ||
+            requestUrl.pathname === '/proxy-blocked' ||
+            requestUrl.pathname === '/proxy-prefs' ||
+            requestUrl.pathname === '/proxy-cookies' ||
+            requestUrl.pathname === '/proxy-sitedata' ||
+            requestUrl.pathname === '/proxy-incognito' ||
             (request.mode === 'navigate' && requestUrl.pathname === '/')
         )
     ) {
@@ -333,6 +497,12 @@ self.addEventListener('fetch', event => {
             const newHeaders = new Headers(request.headers);
             newHeaders.delete('Range'); 
             newHeaders.delete('If-Range');
+            // The issuing page, since the re-fetch's Referer is the service worker.
+            newHeaders.set('X-Proxy-Client-URL', client.url);
+            // Re-fetching resets Sec-Fetch-Dest, so pass the original destination along.
+            if (request.destination) {
+                newHeaders.set('X-Proxy-Request-Destination', request.destination);
+            }
 
             return fetch(newProxyRequestUrl.toString(), {
                 method: request.method,
@@ -352,6 +522,593 @@ self.addEventListener('fetch', event => {
 // --- End of embeddedSWContent ---
 `
 
+// embeddedRuntimeJSContent is the in-page proxy runtime served at runtimeScriptPath.
+// It is injected as the first script of every proxied page with JavaScript enabled,
+// so script-initiated requests and navigations are routed through the proxy even
+// when the service worker is not (yet) in control.
+const embeddedRuntimeJSContent = `
+// --- Start of embeddedRuntimeJSContent (In-page Proxy Runtime) ---
+(function() {
+    'use strict';
+    if (window.__proxyRuntime) {
+        return;
+    }
+    const CONFIG = __PROXY_RUNTIME_CONFIG__;
+    const proxyOrigin = window.location.origin;
+    const currentScript = document.currentScript;
+
+    // The target page URL comes from the proxy URL; the document base from the
+    // server, which has already resolved any <base href>.
+    let targetPageURL = null;
+    let targetBaseURL = null;
+    let baseFromDocument = false;
+
+    function refreshTargetFromLocation() {
+        try {
+            const here = new URL(window.location.href);
+            if (here.pathname === CONFIG.proxyPath && here.searchParams.has('url')) {
+                targetPageURL = new URL(here.searchParams.get('url'));
+                if (!baseFromDocument) {
+                    targetBaseURL = targetPageURL;
+                }
+            }
+        } catch (e) {
+            console.error('Proxy runtime: Error deriving target URL:', e);
+        }
+    }
+
+    if (currentScript && currentScript.dataset.proxyBase) {
+        try {
+            targetBaseURL = new URL(currentScript.dataset.proxyBase);
+            baseFromDocument = true;
+        } catch (e) { /* Fall back to the page URL */ }
+    }
+    refreshTargetFromLocation();
+    if (!targetPageURL && window.location.href === 'about:srcdoc' && baseFromDocument) {
+        // iframe srcdoc documents have no URL of their own; they inherit the parent's base.
+        targetPageURL = targetBaseURL;
+    }
+    if (!targetPageURL) {
+        console.warn('Proxy runtime: Not running on a proxied page. Runtime disabled.');
+        return;
+    }
+
+__PROXY_URL_FUNCTIONS__
+    function rewriteSrcset(srcset) {
+        if (typeof srcset !== 'string') {
+            return srcset;
+        }
+        return srcset.split(',').map(candidate => {
+            const parts = candidate.trim().split(/\s+/);
+            if (!parts[0]) {
+                return candidate;
+            }
+            parts[0] = toProxyURL(parts[0]);
+            return parts.join(' ');
+        }).join(', ');
+    }
+
+    // --- Network APIs ---
+    // The initiator token shows the proxy which site a script request comes from,
+    // for the SameSite rules of the cookie jar (see requestIsCrossSite).
+    const initiatorToken = (currentScript && currentScript.dataset.proxyInitiatorToken) || '';
+
+    function sendsInitiatorToken(url) {
+        try {
+            return initiatorToken !== '' && isProxiedURL(new URL(url, window.location.href));
+        } catch (e) {
+            return false;
+        }
+    }
+
+    // Responses may store cookies in the jar; document.cookie then re-reads them.
+    let cookiesStale = false;
+    function markCookiesStale() {
+        cookiesStale = true;
+    }
+
+    const nativeFetch = window.fetch;
+    if (nativeFetch) {
+        window.fetch = function(input, init) {
+            try {
+                if (input instanceof Request) {
+                    const proxiedURL = toProxyURL(input.url);
+                    if (proxiedURL !== input.url) {
+                        input = new Request(proxiedURL, input);
+                    }
+                } else {
+                    input = toProxyURL(input);
+                }
+                if (sendsInitiatorToken(input instanceof Request ? input.url : input)) {
+                    const headers = new Headers(init && init.headers !== undefined ? init.headers : (input instanceof Request ? input.headers : undefined));
+                    headers.set('X-Proxy-Initiator-Token', initiatorToken);
+                    init = Object.assign({}, init, { headers: headers });
+                }
+            } catch (e) {
+                console.error('Proxy runtime: Error rewriting fetch:', e);
+            }
+            return nativeFetch.call(this, input, init).finally(markCookiesStale);
+        };
+    }
+
+    function markXHRCookiesStale() {
+        if (this.readyState === XMLHttpRequest.DONE) {
+            markCookiesStale();
+        }
+    }
+
+    const nativeXHROpen = XMLHttpRequest.prototype.open;
+    XMLHttpRequest.prototype.open = function(method, url) {
+        const args = Array.prototype.slice.call(arguments);
+        if (args.length > 1) {
+            args[1] = toProxyURL(url);
+        }
+        const result = nativeXHROpen.apply(this, args);
+        if (args.length > 1 && sendsInitiatorToken(args[1])) {
+            this.setRequestHeader('X-Proxy-Initiator-Token', initiatorToken);
+        }
+        this.addEventListener('readystatechange', markXHRCookiesStale);
+        return result;
+    };
+
+    if (navigator.sendBeacon) {
+        const nativeSendBeacon = navigator.sendBeacon.bind(navigator);
+        navigator.sendBeacon = function(url, data) {
+            return nativeSendBeacon(toProxyURL(url), data);
+        };
+    }
+
+    if (window.EventSource) {
+        const NativeEventSource = window.EventSource;
+        window.EventSource = function(url, config) {
+            return new NativeEventSource(toProxyURL(url), config);
+        };
+        window.EventSource.prototype = NativeEventSource.prototype;
+    }
+
+    // --- Workers ---
+    ['Worker', 'SharedWorker'].forEach(name => {
+        const NativeWorkerCtor = window[name];
+        if (!NativeWorkerCtor) {
+            return;
+        }
+        window[name] = function(url, options) {
+            return new NativeWorkerCtor(toProxyURL(url), options);
+        };
+        window[name].prototype = NativeWorkerCtor.prototype;
+    });
+
+    // --- Cookies ---
+    // The site's cookies live in the proxy's server-side jar (cookiejar.go), not in
+    // the browser. document.cookie shows the page's script-visible cookies from
+    // the server, and assignments are sent to the jar for this page's URL. After
+    // a request or a return to this tab, the next read fetches the jar's current
+    // cookies, keeping assignments the jar has not confirmed yet.
+    const cookieValues = new Map();
+    const cookieToken = (currentScript && currentScript.dataset.proxyCookieToken) || '';
+    const pendingCookieWrites = new Map(); // Name -> { value (null when deleted), seq }
+    let cookieWriteSeq = 0;
+
+    function cookieURL() {
+        return CONFIG.cookiePath + '?url=' + encodeURIComponent(targetPageURL.href) + '&token=' + encodeURIComponent(cookieToken);
+    }
+
+    function setCookieValues(list) {
+        cookieValues.clear();
+        list.split('; ').forEach(pair => {
+            const eq = pair.indexOf('=');
+            if (eq > 0) {
+                cookieValues.set(pair.slice(0, eq), pair.slice(eq + 1));
+            }
+        });
+    }
+
+    function applyCookieValue(name, value) {
+        if (value === null) {
+            cookieValues.delete(name);
+        } else {
+            cookieValues.set(name, value);
+        }
+    }
+
+    function refreshCookies() {
+        cookiesStale = false;
+        try {
+            // document.cookie is synchronous, so the read has to be as well.
+            const xhr = new XMLHttpRequest();
+            nativeXHROpen.call(xhr, 'GET', cookieURL(), false);
+            xhr.send();
+            if (xhr.status !== 200) {
+                return;
+            }
+            setCookieValues(xhr.responseText);
+        } catch (e) {
+            console.error('Proxy runtime: Error refreshing cookies:', e);
+            return;
+        }
+        pendingCookieWrites.forEach((pending, name) => applyCookieValue(name, pending.value));
+    }
+
+    setCookieValues((currentScript && currentScript.dataset.proxyCookies) || '');
+    if (cookieToken) {
+        document.addEventListener('visibilitychange', () => {
+            if (document.visibilityState === 'visible') {
+                markCookiesStale(); // Other tabs may have changed the jar
+            }
+        });
+        window.addEventListener('pageshow', markCookiesStale);
+    }
+
+    const nativeCookieDescriptor = Object.getOwnPropertyDescriptor(Document.prototype, 'cookie');
+    if (nativeCookieDescriptor && nativeCookieDescriptor.configurable) {
+        Object.defineProperty(Document.prototype, 'cookie', {
+            configurable: true,
+            enumerable: nativeCookieDescriptor.enumerable,
+            get: function() {
+                if (cookiesStale && cookieToken) {
+                    refreshCookies();
+                }
+                return Array.from(cookieValues, entry => entry[0] + '=' + entry[1]).join('; ');
+            },
+            set: function(cookieString) {
+                cookieString = String(cookieString);
+                const pair = cookieString.split(';')[0];
+                const eq = pair.indexOf('=');
+                if (eq <= 0) {
+                    return;
+                }
+                const name = pair.slice(0, eq).trim();
+                const attributes = cookieString.slice(pair.length).toLowerCase();
+                const maxAge = /;\s*max-age\s*=\s*(-?\d+)/.exec(attributes);
+                const expires = /;\s*expires\s*=\s*([^;]+)/.exec(attributes);
+                const deleted = maxAge ? parseInt(maxAge[1], 10) <= 0 : (expires && Date.parse(expires[1]) <= Date.now());
+                const value = deleted ? null : pair.slice(eq + 1).trim();
+                applyCookieValue(name, value);
+                if (!cookieToken || !nativeFetch) {
+                    return; // Cookies are disabled for this site.
+                }
+                const seq = ++cookieWriteSeq;
+                pendingCookieWrites.set(name, { value: value, seq: seq });
+                nativeFetch.call(window, cookieURL(), { method: 'POST', body: cookieString, credentials: 'same-origin', keepalive: true })
+                    .catch(e => console.error('Proxy runtime: Error storing cookie:', e))
+                    .finally(() => {
+                        const pending = pendingCookieWrites.get(name);
+                        if (pending && pending.seq === seq) {
+                            pendingCookieWrites.delete(name);
+                        }
+                        markCookiesStale(); // The jar may have refused the cookie
+                    });
+            },
+        });
+    }
+    // The Cookie Store API would bypass the jar.
+    try {
+        Object.defineProperty(window, 'cookieStore', { value: undefined, configurable: true });
+    } catch (e) { /* Not redefinable in this browser */ }
+
+    // Proxied sites must not replace the proxy's own service worker.
+    if (navigator.serviceWorker) {
+        navigator.serviceWorker.register = function(scriptURL) {
+            console.warn('Proxy runtime: Blocked service worker registration for', scriptURL);
+            return Promise.reject(new DOMException('Service workers are not available through the proxy.', 'SecurityError'));
+        };
+    }
+
+    // --- Navigation APIs ---
+    ['pushState', 'replaceState'].forEach(fn => {
+        const nativeHistoryFn = history[fn];
+        history[fn] = function(state, title, url) {
+            if (url !== undefined && url !== null) {
+                url = toProxyURL(url);
+            }
+            const result = nativeHistoryFn.call(this, state, title, url);
+            refreshTargetFromLocation();
+            return result;
+        };
+    });
+    window.addEventListener('popstate', refreshTargetFromLocation);
+
+    const nativeWindowOpen = window.open;
+    window.open = function(url) {
+        const args = Array.prototype.slice.call(arguments);
+        if (args.length > 0 && args[0]) {
+            args[0] = toProxyURL(args[0]);
+        }
+        return nativeWindowOpen.apply(window, args);
+    };
+
+    // Location methods are unforgeable in most browsers; patch them where permitted.
+    // Rewritten scripts use __proxyRuntime.navigate instead.
+    ['assign', 'replace'].forEach(fn => {
+        try {
+            const nativeLocationFn = window.location[fn].bind(window.location);
+            Object.defineProperty(window.location, fn, {
+                value: function(url) { return nativeLocationFn(toProxyURL(url)); },
+            });
+        } catch (e) { /* Unforgeable in this browser */ }
+    });
+
+    // --- Dynamically created elements ---
+    function patchURLProperty(ctor, prop, rewrite) {
+        if (!ctor) {
+            return;
+        }
+        const descriptor = Object.getOwnPropertyDescriptor(ctor.prototype, prop);
+        if (!descriptor || !descriptor.set) {
+            return;
+        }
+        Object.defineProperty(ctor.prototype, prop, {
+            configurable: true,
+            enumerable: descriptor.enumerable,
+            get: descriptor.get,
+            set: function(value) { descriptor.set.call(this, rewrite(value)); },
+        });
+    }
+    [
+        [window.HTMLImageElement, 'src'], [window.HTMLScriptElement, 'src'],
+        [window.HTMLLinkElement, 'href'], [window.HTMLIFrameElement, 'src'],
+        [window.HTMLMediaElement, 'src'], [window.HTMLSourceElement, 'src'],
+        [window.HTMLTrackElement, 'src'], [window.HTMLEmbedElement, 'src'],
+        [window.HTMLInputElement, 'src'], [window.HTMLVideoElement, 'poster'],
+        [window.HTMLObjectElement, 'data'], [window.HTMLFormElement, 'action'],
+        [window.HTMLAnchorElement, 'href'], [window.HTMLAreaElement, 'href'],
+    ].forEach(([ctor, prop]) => patchURLProperty(ctor, prop, toProxyURL));
+    patchURLProperty(window.HTMLImageElement, 'srcset', rewriteSrcset);
+    patchURLProperty(window.HTMLSourceElement, 'srcset', rewriteSrcset);
+
+    const urlAttributes = ['src', 'href', 'action', 'formaction', 'poster', 'background'];
+
+    function rewriteAttributeValue(element, name, value) {
+        const lowerName = String(name).toLowerCase();
+        if (lowerName === 'srcset') {
+            return rewriteSrcset(value);
+        }
+        if (urlAttributes.includes(lowerName) || (lowerName === 'data' && element.tagName === 'OBJECT')) {
+            return toProxyURL(value);
+        }
+        return value;
+    }
+
+    function isProxyUIElement(element) {
+        return element.id && element.id.startsWith('proxy-');
+    }
+
+    const nativeSetAttribute = Element.prototype.setAttribute;
+    Element.prototype.setAttribute = function(name, value) {
+        if (!isProxyUIElement(this)) {
+            value = rewriteAttributeValue(this, name, value);
+        }
+        return nativeSetAttribute.call(this, name, value);
+    };
+
+    // Catches markup inserted via innerHTML, insertAdjacentHTML, document.write, ...
+    function rewriteElementTree(root) {
+        if (root.nodeType !== Node.ELEMENT_NODE) {
+            return;
+        }
+        const elements = [root].concat(Array.from(root.querySelectorAll('[src],[href],[srcset],[action],[formaction],[poster],[background],object[data]')));
+        elements.forEach(element => {
+            if (isProxyUIElement(element)) {
+                return;
+            }
+            for (const attr of Array.from(element.attributes)) {
+                const rewritten = rewriteAttributeValue(element, attr.name, attr.value);
+                if (rewritten !== attr.value) {
+                    nativeSetAttribute.call(element, attr.name, rewritten);
+                }
+            }
+        });
+    }
+    new MutationObserver(mutations => {
+        mutations.forEach(mutation => mutation.addedNodes.forEach(rewriteElementTree));
+    }).observe(document.documentElement, { childList: true, subtree: true });
+
+    // --- Proxy-aware accessors (targets of server-side script rewriting) ---
+    function navigate(url, replace) {
+        const proxiedURL = toProxyURL(url);
+        if (replace) {
+            window.location.replace(proxiedURL);
+        } else {
+            window.location.assign(proxiedURL);
+        }
+    }
+
+    function currentTargetURL() {
+        const u = new URL(targetPageURL.href);
+        u.hash = window.location.hash; // The fragment lives on the proxy URL
+        return u;
+    }
+
+    // proxyLocation behaves like window.location, but for the target page.
+    const proxyLocation = {
+        assign: function(url) { navigate(url, false); },
+        replace: function(url) { navigate(url, true); },
+        reload: function() { window.location.reload(); },
+        toString: function() { return currentTargetURL().href; },
+    };
+    ['href', 'protocol', 'host', 'hostname', 'port', 'pathname', 'search', 'hash', 'origin'].forEach(prop => {
+        Object.defineProperty(proxyLocation, prop, {
+            enumerable: true,
+            get: function() { return currentTargetURL()[prop]; },
+            set: function(value) {
+                if (prop === 'origin') {
+                    return;
+                }
+                if (prop === 'hash') {
+                    window.location.hash = value;
+                    return;
+                }
+                if (prop === 'href') {
+                    navigate(value, false);
+                    return;
+                }
+                const next = currentTargetURL();
+                next[prop] = value;
+                navigate(next.href, false);
+            },
+        });
+    });
+
+    function originalReferrer() {
+        if (!document.referrer) {
+            return '';
+        }
+        try {
+            const referrer = new URL(document.referrer);
+            if (isProxiedURL(referrer)) {
+                return referrer.searchParams.get('url') || '';
+            }
+            if (referrer.origin === proxyOrigin) {
+                return ''; // Proxy landing page
+            }
+        } catch (e) { /* Not a URL */ }
+        return document.referrer;
+    }
+
+    const runtime = {
+        toProxyURL: toProxyURL,
+        targetURL: function() { return targetPageURL.href; },
+        navigate: navigate,
+    };
+    Object.defineProperties(runtime, {
+        location: { get: function() { return proxyLocation; }, set: function(url) { navigate(url, false); } },
+        origin: { get: function() { return targetPageURL.origin; } },
+        domain: {
+            get: function() { return targetPageURL.hostname; },
+            set: function(value) { console.log('Proxy runtime: Ignoring document.domain assignment:', value); },
+        },
+        referrer: { get: originalReferrer },
+        URL: { get: function() { return currentTargetURL().href; } },
+    });
+    Object.defineProperty(window, '__proxyRuntime', { value: Object.freeze(runtime) });
+})();
+// --- End of embeddedRuntimeJSContent ---
+`
+
+// embeddedProxyURLFunctionsJS holds the URL helpers shared by the in-page runtime
+// and the worker prelude (spliced in for __PROXY_URL_FUNCTIONS__).
+const embeddedProxyURLFunctionsJS = `
+    function isProxiedURL(u) {
+        return u.origin === proxyOrigin && u.pathname === CONFIG.proxyPath && u.searchParams.has('url');
+    }
+
+    // toProxyURL mirrors rewriteProxiedURL on the server: same passthrough
+    // prefixes, same /proxy?url= form, fragment kept on the proxy URL.
+    // Expects CONFIG, proxyOrigin and targetBaseURL in the enclosing scope.
+    function toProxyURL(rawURL) {
+        if (rawURL === null || rawURL === undefined) {
+            return rawURL;
+        }
+        if (rawURL instanceof URL) {
+            rawURL = rawURL.href;
+        }
+        const str = String(rawURL).trim();
+        if (str === '') {
+            return rawURL;
+        }
+        const lower = str.toLowerCase();
+        for (const prefix of CONFIG.passthroughPrefixes) {
+            if (lower.startsWith(prefix)) {
+                return rawURL;
+            }
+        }
+        let abs;
+        try {
+            // about:srcdoc cannot serve as a base; relative proxy URLs there are relative to the proxy.
+            const pageURL = self.location.protocol === 'about:' ? proxyOrigin + CONFIG.proxyPath : self.location.href;
+            const onProxy = new URL(str, pageURL);
+            if (isProxiedURL(onProxy)) {
+                return onProxy.href;
+            }
+            abs = new URL(str, targetBaseURL);
+            if (abs.origin === proxyOrigin) {
+                // Resolved by the browser against the proxy page: rebase onto the target.
+                abs = new URL(abs.pathname + abs.search + abs.hash, targetBaseURL);
+            }
+        } catch (e) {
+            return rawURL;
+        }
+        if (abs.protocol !== 'http:' && abs.protocol !== 'https:') {
+            return abs.href;
+        }
+        const hash = abs.hash;
+        abs.hash = '';
+        return proxyOrigin + CONFIG.proxyPath + '?url=' + encodeURIComponent(abs.href) + hash;
+    }
+`
+
+// embeddedWorkerPreludeContent is prepended to dedicated and shared worker scripts.
+// Workers have no DOM and no in-page runtime, so the prelude routes importScripts,
+// fetch, XMLHttpRequest and nested workers through the proxy itself.
+const embeddedWorkerPreludeContent = `
+// --- Start of embeddedWorkerPreludeContent (Worker Proxy Prelude) ---
+(function() {
+    'use strict';
+    if (self.__proxyWorkerPrelude) {
+        return;
+    }
+    self.__proxyWorkerPrelude = true;
+    const CONFIG = __PROXY_RUNTIME_CONFIG__;
+    const proxyOrigin = self.location.origin;
+    let targetBaseURL;
+    try {
+        targetBaseURL = new URL(CONFIG.targetURL);
+    } catch (e) {
+        console.error('Proxy worker prelude: Invalid target URL:', CONFIG.targetURL);
+        return;
+    }
+__PROXY_URL_FUNCTIONS__
+    if (typeof self.importScripts === 'function') {
+        const nativeImportScripts = self.importScripts;
+        self.importScripts = function() {
+            return nativeImportScripts.apply(self, Array.prototype.map.call(arguments, toProxyURL));
+        };
+    }
+    if (typeof self.fetch === 'function') {
+        const nativeFetch = self.fetch;
+        self.fetch = function(input, init) {
+            try {
+                if (input instanceof Request) {
+                    const proxiedURL = toProxyURL(input.url);
+                    if (proxiedURL !== input.url) {
+                        input = new Request(proxiedURL, input);
+                    }
+                } else {
+                    input = toProxyURL(input);
+                }
+            } catch (e) {
+                console.error('Proxy worker prelude: Error rewriting fetch:', e);
+            }
+            return nativeFetch.call(this, input, init).finally(markCookiesStale);
+        };
+    }
+    if (typeof XMLHttpRequest !== 'undefined') {
+        function markXHRCookiesStale() {
+        if (this.readyState === XMLHttpRequest.DONE) {
+            markCookiesStale();
+        }
+    }
+
+    const nativeXHROpen = XMLHttpRequest.prototype.open;
+        XMLHttpRequest.prototype.open = function(method, url) {
+            const args = Array.prototype.slice.call(arguments);
+            if (args.length > 1) {
+                args[1] = toProxyURL(url);
+            }
+            return nativeXHROpen.apply(this, args);
+        };
+    }
+    if (typeof self.Worker === 'function') {
+        const NativeWorker = self.Worker;
+        self.Worker = function(url, options) {
+            return new NativeWorker(toProxyURL(url), options);
+        };
+        self.Worker.prototype = NativeWorker.prototype;
+    }
+})();
+// --- End of embeddedWorkerPreludeContent ---
+`
+
 const clientJSContentForEmbedding = `
 // --- Start of clientJSContentForEmbedding ---
     document.addEventListener('DOMContentLoaded', () => {
@@ -368,6 +1125,16 @@ const clientJSContentForEmbedding = `
             };
         }
 
+        // The proxy's settings APIs only answer calls carrying this page's token.
+        const settingsTokenMeta = document.querySelector('meta[name="proxy-settings-token"]');
+        const settingsToken = settingsTokenMeta ? settingsTokenMeta.content : '';
+        if (settingsTokenMeta) settingsTokenMeta.remove();
+        function settingsFetch(url, options) {
+            options = Object.assign({ credentials: 'same-origin' }, options);
+            options.headers = Object.assign({}, options.headers, { 'X-Proxy-Settings-Token': settingsToken });
+            return fetch(url, options);
+        }
+
         const urlInput = document.getElementById('url-input');
         const visitBtn = document.getElementById('visit-btn'); 
         const errorMessageDiv = document.getElementById('error-message');
@@ -375,44 +1142,243 @@ const clientJSContentForEmbedding = `
         const globalJsCheckbox = document.getElementById('global-js');
         const globalCookiesCheckbox = document.getElementById('global-cookies');
         const globalIframesCheckbox = document.getElementById('global-iframes');
+        const globalImagesCheckbox = document.getElementById('global-images');
+        const globalMediaCheckbox = document.getElementById('global-media');
+        const globalFontsCheckbox = document.getElementById('global-fonts');
+        const globalWorkersCheckbox = document.getElementById('global-workers');
+        const globalFormsCheckbox = document.getElementById('global-forms');
         const globalRawModeCheckbox = document.getElementById('global-raw-mode'); 
+        const globalReaderModeCheckbox = document.getElementById('global-reader-mode');
+        const globalDataSaverCheckbox = document.getElementById('global-data-saver');
+        const globalImagePlaceholdersCheckbox = document.getElementById('global-image-placeholders');
+        const globalProfileSelect = document.getElementById('global-profile');
+        const globalProfileDescription = document.getElementById('global-profile-description');
         const globalSettingsIndicatorsDiv = document.getElementById('global-settings-indicators');
 
 
         const bookmarksList = document.getElementById('bookmarks-list');
         const bookmarkCurrentSiteBtn = document.getElementById('bookmark-current-site-btn'); 
 
+        // Settings as named in this page, mapped to their keys in the server-side
+        // preference records (see preferences.go).
         const settingsKeys = { 
+            js: 'js', 
+            cookies: 'cookies', 
+            iframes: 'iframes',
+            images: 'images',
+            media: 'media',
+            fonts: 'fonts',
+            workers: 'workers',
+            forms: 'forms',
+            rawMode: 'raw',
+            readerMode: 'reader',
+            dataSaver: 'datasaver',
+            imagePlaceholders: 'placeholders'
+        };
+        // Settings stored in localStorage and cookies before preferences moved server-side.
+        const legacySettingsKeys = { 
             js: 'proxy-js-enabled', 
             cookies: 'proxy-cookies-enabled', 
             iframes: 'proxy-iframes-enabled',
-            rawMode: 'proxy-raw-mode-enabled' 
+            rawMode: 'proxy-raw-mode-enabled',
+            readerMode: 'proxy-reader-mode-enabled',
+            dataSaver: 'proxy-data-saver-enabled',
+            imagePlaceholders: 'proxy-image-placeholders-enabled'
         };
+        // Effective preferences per host (and for "default"), as returned by /proxy-prefs.
+        let effectivePrefs = {};
+        // Privacy profiles offered by the server (see profiles.go).
+        let privacyProfiles = [];
+        // Whether an incognito session is running (see incognito.go).
+        let incognitoActive = false;
+        const profileBadgeClasses = {
+            strict: 'bg-red-100 text-red-700',
+            balanced: 'bg-blue-100 text-blue-700',
+            compatible: 'bg-green-100 text-green-700'
+        };
+        const settingLabels = {
+            js: 'JavaScript',
+            cookies: 'Cookies',
+            iframes: 'Iframes',
+            images: 'Images',
+            media: 'Audio & Video',
+            fonts: 'Web Fonts',
+            workers: 'Web Workers',
+            forms: 'Forms',
+            rawMode: 'Raw Mode',
+            readerMode: 'Reader Mode',
+            dataSaver: 'Data Saver',
+            imagePlaceholders: 'Click-to-Load Images'
+        };
+
+        function fromPreferenceRecord(record) {
+            const settings = {};
+            Object.keys(settingsKeys).forEach(name => {
+                settings[name] = !!(record && record[settingsKeys[name]]);
+            });
+            return settings;
+        }
+
+        function toPreferenceRecord(settings) {
+            const record = {};
+            Object.keys(settingsKeys).forEach(name => {
+                record[settingsKeys[name]] = !!settings[name];
+            });
+            return record;
+        }
+
+        function preferencesRequest(method, host, record) {
+            const options = { method: method, credentials: 'same-origin' };
+            if (record) {
+                options.headers = { 'Content-Type': 'application/json' };
+                options.body = JSON.stringify(record);
+            }
+            return settingsFetch('/proxy-prefs?host=' + encodeURIComponent(host), options)
+                .then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                });
+        }
         
+        function findProfile(name) {
+            return privacyProfiles.find(profile => profile.name === name);
+        }
+
+        // Builds the badge naming the privacy profile of an effective preference
+        // record; its tooltip lists the resulting settings.
+        function createProfileBadge(record, additionalClasses = '') {
+            const profile = findProfile(record && record.profile);
+            const settings = fromPreferenceRecord(record);
+            const badge = document.createElement('span');
+            badge.className = 'profile-badge ' + ((profile && profileBadgeClasses[profile.name]) || 'bg-gray-100 text-gray-700');
+            if (additionalClasses) {
+                badge.className += ' ' + additionalClasses;
+            }
+            badge.textContent = profile ? profile.label : 'Custom';
+            const lines = [profile ? profile.label + ': ' + profile.description : 'Custom settings'];
+            Object.keys(settingLabels).forEach(name => {
+                lines.push(settingLabels[name] + ': ' + (settings[name] ? 'On' : 'Off'));
+            });
+            badge.title = lines.join('\n');
+            return badge;
+        }
+
+        // Content classes flagged next to the profile badge when blocked.
+        const contentClassEmojis = {
+            images: '🖼️',
+            media: '🎬',
+            fonts: '🔤',
+            workers: '👷',
+            forms: '📝'
+        };
+
+        // Builds the profile badge followed by an indicator for each blocked content class.
+        function createPreferenceIndicators(record, additionalClasses = '') {
+            const container = document.createElement('span');
+            container.className = 'inline-flex items-center whitespace-nowrap' + (additionalClasses ? ' ' + additionalClasses : '');
+            container.appendChild(createProfileBadge(record));
+            const settings = fromPreferenceRecord(record);
+            Object.keys(contentClassEmojis).forEach(name => {
+                if (settings[name]) return;
+                const indicator = document.createElement('span');
+                indicator.className = 'content-class-blocked ml-1';
+                indicator.title = settingLabels[name] + ': Blocked';
+                indicator.textContent = contentClassEmojis[name];
+                container.appendChild(indicator);
+            });
+            return container;
+        }
+
         function updateGlobalSettingIndicators() {
             if (!globalSettingsIndicatorsDiv) return; 
+            globalSettingsIndicatorsDiv.replaceChildren(createPreferenceIndicators(effectivePrefs.default));
+        }
 
-            const jsEnabled = globalJsCheckbox.checked;
-            const cookiesEnabled = globalCookiesCheckbox.checked;
-            const iframesEnabled = globalIframesCheckbox.checked;
-            const rawModeEnabled = globalRawModeCheckbox.checked; 
+        // Fills the profile selector; "Custom" stands for no profile.
+        function renderProfileOptions(selected) {
+            globalProfileSelect.replaceChildren();
+            const customOption = document.createElement('option');
+            customOption.value = '';
+            customOption.textContent = 'Custom';
+            globalProfileSelect.appendChild(customOption);
+            privacyProfiles.forEach(profile => {
+                const option = document.createElement('option');
+                option.value = profile.name;
+                option.textContent = profile.label;
+                option.title = profile.description;
+                globalProfileSelect.appendChild(option);
+            });
+            const profile = findProfile(selected);
+            globalProfileSelect.value = profile ? profile.name : '';
+            globalProfileDescription.textContent = profile ? profile.description : 'Only the settings below apply.';
+        }
 
-            let indicatorsHTML = '';
-            indicatorsHTML += '<span title="JavaScript: ' + (jsEnabled ? 'Enabled' : 'Disabled') + '" class="' + (jsEnabled ? 'bg-green-100 text-green-700' : 'bg-red-100 text-red-700') + '">' + (jsEnabled ? '⚙️' : '🚫') + '</span>';
-            indicatorsHTML += '<span title="Cookies: ' + (cookiesEnabled ? 'Allowed' : 'Blocked') + '" class="ml-1 ' + (cookiesEnabled ? 'bg-green-100 text-green-700' : 'bg-red-100 text-red-700') + '">' + (cookiesEnabled ? '🍪' : '🚫') + '</span>';
-            indicatorsHTML += '<span title="Iframes: ' + (iframesEnabled ? 'Allowed' : 'Blocked') + '" class="ml-1 ' + (iframesEnabled ? 'bg-green-100 text-green-700' : 'bg-red-100 text-red-700') + '">' + (iframesEnabled ? '🖼️' : '🚫') + '</span>';
-            indicatorsHTML += '<span title="Raw Mode: ' + (rawModeEnabled ? 'ON (No Server Rewrite)' : 'OFF (Server Rewrite Active)') + '" class="ml-1 ' + (rawModeEnabled ? 'bg-yellow-100 text-yellow-700' : 'bg-red-100 text-red-700') + '">' + (rawModeEnabled ? '🥩' : '🚫') + '</span>'; 
-            
-            globalSettingsIndicatorsDiv.innerHTML = indicatorsHTML;
+        function applyGlobalSettings(settings) {
+            globalJsCheckbox.checked = settings.js;
+            globalCookiesCheckbox.checked = settings.cookies;
+            globalIframesCheckbox.checked = settings.iframes;
+            globalImagesCheckbox.checked = settings.images;
+            globalMediaCheckbox.checked = settings.media;
+            globalFontsCheckbox.checked = settings.fonts;
+            globalWorkersCheckbox.checked = settings.workers;
+            globalFormsCheckbox.checked = settings.forms;
+            globalRawModeCheckbox.checked = settings.rawMode; 
+            globalReaderModeCheckbox.checked = settings.readerMode;
+            globalDataSaverCheckbox.checked = settings.dataSaver;
+            globalImagePlaceholdersCheckbox.checked = settings.imagePlaceholders;
+            updateGlobalSettingIndicators(); 
         }
 
+        // Loads the default preferences and those of every bookmarked host from the server.
         function loadGlobalSettings() {
-            globalJsCheckbox.checked = localStorage.getItem(settingsKeys.js) === 'true';
-            globalCookiesCheckbox.checked = localStorage.getItem(settingsKeys.cookies) === 'true';
-            globalIframesCheckbox.checked = localStorage.getItem(settingsKeys.iframes) === 'true';
-            globalRawModeCheckbox.checked = localStorage.getItem(settingsKeys.rawMode) === 'true'; 
-            updateGlobalPreferenceCookies(getGlobalSettings()); 
-            updateGlobalSettingIndicators(); 
+            const bookmarks = JSON.parse(localStorage.getItem(BOOKMARKS_LS_KEY)) || [];
+            const query = bookmarks.map(bm => {
+                try {
+                    return 'host=' + encodeURIComponent(new URL(bm.url).hostname);
+                } catch (e) {
+                    return '';
+                }
+            }).filter(q => q).join('&');
+            settingsFetch('/proxy-prefs' + (query ? '?' + query : ''), { credentials: 'same-origin' })
+                .then(response => {
+                    if (!response.ok) throw new Error(response.statusText);
+                    return response.json();
+                })
+                .then(data => {
+                    effectivePrefs = data.effective || {};
+                    privacyProfiles = data.profiles || [];
+                    if (!data.records || !data.records.default) {
+                        migrateLegacySettings();
+                    }
+                    renderProfileOptions(effectivePrefs.default && effectivePrefs.default.profile);
+                    applyGlobalSettings(fromPreferenceRecord(effectivePrefs.default));
+                    loadBookmarks();
+                })
+                .catch(e => console.error('Could not load preferences:', e));
+        }
+
+        // Moves settings saved by older versions of this page into the server-side
+        // default record, and expires the cookies that used to carry them.
+        function migrateLegacySettings() {
+            const legacy = {};
+            let found = false;
+            Object.keys(legacySettingsKeys).forEach(name => {
+                const value = localStorage.getItem(legacySettingsKeys[name]);
+                if (value !== null) {
+                    legacy[name] = value === 'true';
+                    found = true;
+                }
+                localStorage.removeItem(legacySettingsKeys[name]);
+                document.cookie = legacySettingsKeys[name] + '=; path=/; max-age=0';
+            });
+            if (found) {
+                const settings = Object.assign(fromPreferenceRecord(effectivePrefs.default), legacy);
+                effectivePrefs.default = toPreferenceRecord(settings);
+                preferencesRequest('PUT', 'default', effectivePrefs.default)
+                    .catch(e => console.error('Could not migrate settings:', e));
+            }
         }
 
         function getGlobalSettings() {
@@ -420,32 +1386,51 @@ const clientJSContentForEmbedding = `
                 js: globalJsCheckbox.checked,
                 cookies: globalCookiesCheckbox.checked,
                 iframes: globalIframesCheckbox.checked,
-                rawMode: globalRawModeCheckbox.checked 
+                images: globalImagesCheckbox.checked,
+                media: globalMediaCheckbox.checked,
+                fonts: globalFontsCheckbox.checked,
+                workers: globalWorkersCheckbox.checked,
+                forms: globalFormsCheckbox.checked,
+                rawMode: globalRawModeCheckbox.checked,
+                readerMode: globalReaderModeCheckbox.checked,
+                dataSaver: globalDataSaverCheckbox.checked,
+                imagePlaceholders: globalImagePlaceholdersCheckbox.checked
             };
         }
 
+        // Saves the profile and the checkboxes as the default record; sites with their
+        // own records keep them.
         function saveGlobalSettings() {
-            const settings = getGlobalSettings();
-            localStorage.setItem(settingsKeys.js, settings.js);
-            localStorage.setItem(settingsKeys.cookies, settings.cookies);
-            localStorage.setItem(settingsKeys.iframes, settings.iframes);
-            localStorage.setItem(settingsKeys.rawMode, settings.rawMode); 
-            updateGlobalPreferenceCookies(settings); 
-            updateGlobalSettingIndicators(); 
+            const record = toPreferenceRecord(getGlobalSettings());
+            if (globalProfileSelect.value) {
+                record.profile = globalProfileSelect.value;
+            }
+            preferencesRequest('PUT', 'default', record)
+                .then(loadGlobalSettings)
+                .catch(e => showError('Could not save settings: ' + e.message));
         }
 
-        function updateGlobalPreferenceCookies(prefs) { 
-            const cookieOptions = 'path=/; SameSite=Lax; max-age=31536000'; 
-            document.cookie = 'proxy-js-enabled=' + prefs.js + '; ' + cookieOptions; 
-            document.cookie = 'proxy-cookies-enabled=' + prefs.cookies + '; ' + cookieOptions; 
-            document.cookie = 'proxy-iframes-enabled=' + prefs.iframes + '; ' + cookieOptions; 
-            document.cookie = 'proxy-raw-mode-enabled=' + prefs.rawMode + '; ' + cookieOptions; 
+        // Selecting a profile replaces the default record, so the profile applies as defined.
+        function saveGlobalProfile() {
+            const record = globalProfileSelect.value ? { profile: globalProfileSelect.value } : toPreferenceRecord(getGlobalSettings());
+            preferencesRequest('PUT', 'default', record)
+                .then(loadGlobalSettings)
+                .catch(e => showError('Could not save settings: ' + e.message));
         }
 
+        globalProfileSelect.addEventListener('change', saveGlobalProfile);
         globalJsCheckbox.addEventListener('change', saveGlobalSettings);
         globalCookiesCheckbox.addEventListener('change', saveGlobalSettings);
         globalIframesCheckbox.addEventListener('change', saveGlobalSettings);
+        globalImagesCheckbox.addEventListener('change', saveGlobalSettings);
+        globalMediaCheckbox.addEventListener('change', saveGlobalSettings);
+        globalFontsCheckbox.addEventListener('change', saveGlobalSettings);
+        globalWorkersCheckbox.addEventListener('change', saveGlobalSettings);
+        globalFormsCheckbox.addEventListener('change', saveGlobalSettings);
         globalRawModeCheckbox.addEventListener('change', saveGlobalSettings); 
+        globalReaderModeCheckbox.addEventListener('change', saveGlobalSettings);
+        globalDataSaverCheckbox.addEventListener('change', saveGlobalSettings);
+        globalImagePlaceholdersCheckbox.addEventListener('change', saveGlobalSettings);
 
 
         if (visitBtn) {
@@ -470,17 +1455,15 @@ const clientJSContentForEmbedding = `
                     return;
                 }
 
-                const currentGlobalPrefs = getGlobalSettings();
                 let siteName;
                 try {
                     siteName = new URL(processedUrl).hostname;
                 } catch (e) {
                     siteName = "Bookmarked Site"; 
                 }
-                incrementBookmarkVisitCount(processedUrl, siteName, currentGlobalPrefs); 
+                incrementBookmarkVisitCount(processedUrl, siteName); 
                 loadBookmarks(); 
 
-                updateGlobalPreferenceCookies(currentGlobalPrefs); 
                 window.location.href = '/proxy?url=' + encodeURIComponent(processedUrl);
             });
         }
@@ -502,17 +1485,17 @@ const clientJSContentForEmbedding = `
 
         const BOOKMARKS_LS_KEY = 'proxy-bookmarks-v5'; 
 
-        function incrementBookmarkVisitCount(url, name, prefs) {
+        function incrementBookmarkVisitCount(url, name) {
+            if (incognitoActive) return; // Incognito sessions leave no browsing history
             const bookmarks = JSON.parse(localStorage.getItem(BOOKMARKS_LS_KEY)) || [];
             const existingBookmarkIndex = bookmarks.findIndex(bm => bm.url === url);
 
             if (existingBookmarkIndex > -1) {
                 bookmarks[existingBookmarkIndex].visitedCount = (bookmarks[existingBookmarkIndex].visitedCount || 0) + 1;
-                bookmarks[existingBookmarkIndex].prefs = prefs; 
                 bookmarks[existingBookmarkIndex].name = name; 
                 console.log('Incremented visit count for:', url);
             } else {
-                bookmarks.push({ name, url, prefs, visitedCount: 1 });
+                bookmarks.push({ name, url, visitedCount: 1 });
                 console.log('Added new bookmark with visit count 1 for:', url);
             }
             localStorage.setItem(BOOKMARKS_LS_KEY, JSON.stringify(bookmarks));
@@ -597,7 +1580,6 @@ const clientJSContentForEmbedding = `
                 link.href = '#';
                 link.className = 'go-bookmark-link text-blue-600 hover:text-blue-800 hover:underline font-medium truncate text-base';
                 link.dataset.url = bm.url;
-                link.dataset.prefs = JSON.stringify(bm.prefs);
                 link.dataset.name = bm.name;
                 link.title = bm.name;
                 link.textContent = bm.name;
@@ -631,15 +1613,8 @@ const clientJSContentForEmbedding = `
                 urlSmall.textContent = displayUrl;
                 secondLineDiv.appendChild(urlSmall);
 
-                const emojisSpan = document.createElement('span');
-                emojisSpan.className = 'bookmark-prefs-emojis text-xs ml-2 whitespace-nowrap';
-                
-                emojisSpan.appendChild(createEmojiSpan('JavaScript', bm.prefs.js, '⚙️', '🚫'));
-                emojisSpan.appendChild(createEmojiSpan('Cookies', bm.prefs.cookies, '🍪', '🚫', 'ml-1'));
-                emojisSpan.appendChild(createEmojiSpan('Iframes', bm.prefs.iframes, '🖼️', '🚫', 'ml-1'));
-                emojisSpan.appendChild(createEmojiSpan('Raw Mode', bm.prefs.rawMode, '🥩', '🚫', 'ml-1')); 
-                
-                secondLineDiv.appendChild(emojisSpan);
+                // The site's effective server-side preferences.
+                secondLineDiv.appendChild(createPreferenceIndicators(effectivePrefs[hostname] || effectivePrefs.default, 'ml-2'));
                 infoContainer.appendChild(secondLineDiv);
                 item.appendChild(infoContainer);
                 
@@ -651,15 +1626,9 @@ const clientJSContentForEmbedding = `
                     e.preventDefault();
                     const url = this.dataset.url;
                     const name = this.dataset.name; 
-                    const bookmarkPrefs = JSON.parse(this.dataset.prefs);
-                    
-                    globalJsCheckbox.checked = bookmarkPrefs.js;
-                    globalCookiesCheckbox.checked = bookmarkPrefs.cookies;
-                    globalIframesCheckbox.checked = bookmarkPrefs.iframes;
-                    globalRawModeCheckbox.checked = !!bookmarkPrefs.rawMode; 
-                    saveGlobalSettings(); 
 
-                    incrementBookmarkVisitCount(url, name, bookmarkPrefs); 
+                    // Each site's own preferences apply server-side; nothing to restore here.
+                    incrementBookmarkVisitCount(url, name); 
                     window.location.href = '/proxy?url=' + encodeURIComponent(url);
                 });
             });
@@ -682,19 +1651,6 @@ const clientJSContentForEmbedding = `
             });
         }
         
-        function createEmojiSpan(titlePrefix, isEnabled, enabledEmoji, disabledEmoji, additionalClasses = '') {
-            const span = document.createElement('span');
-            span.title = titlePrefix + ': ' + (isEnabled ? 'Enabled' : 'Disabled');
-            if (titlePrefix === 'Raw Mode') { 
-                 span.title = titlePrefix + ': ' + (isEnabled ? 'ON (No Server Rewrite)' : 'OFF (Server Rewrite Active)');
-            }
-            span.textContent = (isEnabled ? enabledEmoji : disabledEmoji) + ' ';
-            if (additionalClasses) {
-                span.className = additionalClasses;
-            }
-            return span;
-        }
-
         function deleteBookmark(index) { 
             const bookmarks = JSON.parse(localStorage.getItem(BOOKMARKS_LS_KEY)) || [];
             if (index >= 0 && index < bookmarks.length) {
@@ -727,15 +1683,401 @@ const clientJSContentForEmbedding = `
                     } catch (e) {
                         siteName = "Current Site";
                     }
-                    incrementBookmarkVisitCount(currentUrl, siteName, getGlobalSettings());
+                    incrementBookmarkVisitCount(currentUrl, siteName);
                     loadBookmarks();
                     alert('Current site bookmarked/visit count updated!');
                 };
             }
         }
         
+        // --- User scripts & styles (stored server-side, see usercontent.go) ---
+        const userContentList = document.getElementById('user-content-list');
+        const userContentForm = document.getElementById('user-content-form');
+        const userContentError = document.getElementById('user-content-error');
+        const userContentFields = {
+            id: document.getElementById('user-content-id'),
+            name: document.getElementById('user-content-name'),
+            kind: document.getElementById('user-content-kind'),
+            hosts: document.getElementById('user-content-hosts'),
+            code: document.getElementById('user-content-code'),
+            enabled: document.getElementById('user-content-enabled')
+        };
+        const userContentSaveBtn = document.getElementById('user-content-save');
+        const userContentCancelBtn = document.getElementById('user-content-cancel');
+
+        function showUserContentError(message) {
+            userContentError.textContent = message;
+            userContentError.classList.toggle('hidden', !message);
+        }
+
+        function userContentRequest(method, id, entry) {
+            const options = { method: method, credentials: 'same-origin', headers: {} };
+            if (entry) {
+                options.headers['Content-Type'] = 'application/json';
+                options.body = JSON.stringify(entry);
+            }
+            return settingsFetch('/proxy-usercontent' + (id ? '?id=' + encodeURIComponent(id) : ''), options)
+                .then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                });
+        }
+
+        function resetUserContentForm() {
+            userContentForm.reset();
+            userContentFields.id.value = '';
+            userContentFields.enabled.checked = true;
+            userContentSaveBtn.textContent = 'Add';
+            userContentCancelBtn.classList.add('hidden');
+            showUserContentError('');
+        }
+
+        function editUserContent(entry) {
+            userContentFields.id.value = entry.id;
+            userContentFields.name.value = entry.name;
+            userContentFields.kind.value = entry.kind;
+            userContentFields.hosts.value = entry.hosts.join(', ');
+            userContentFields.code.value = entry.code;
+            userContentFields.enabled.checked = entry.enabled;
+            userContentSaveBtn.textContent = 'Save';
+            userContentCancelBtn.classList.remove('hidden');
+            userContentFields.name.focus();
+        }
+
+        function renderUserContent(entries) {
+            userContentList.innerHTML = '';
+            if (entries.length === 0) {
+                userContentList.innerHTML = '<p class="text-gray-500 py-2">No user scripts or styles yet.</p>';
+                return;
+            }
+            entries.forEach(entry => {
+                const row = document.createElement('div');
+                row.className = 'flex items-center justify-between py-2';
+                const info = document.createElement('div');
+                info.className = 'min-w-0 flex-grow mr-2';
+                const title = document.createElement('div');
+                title.className = 'font-medium text-gray-800 truncate';
+                title.textContent = (entry.kind === 'script' ? '📜 ' : '🎨 ') + entry.name + (entry.operator ? ' (operator)' : '');
+                const hosts = document.createElement('div');
+                hosts.className = 'text-xs text-gray-500 truncate';
+                hosts.textContent = entry.hosts.join(', ');
+                info.appendChild(title);
+                info.appendChild(hosts);
+                row.appendChild(info);
+
+                if (!entry.operator) {
+                    const controls = document.createElement('div');
+                    controls.className = 'flex items-center space-x-2 flex-shrink-0';
+                    const enabledToggle = document.createElement('input');
+                    enabledToggle.type = 'checkbox';
+                    enabledToggle.checked = entry.enabled;
+                    enabledToggle.title = 'Enabled';
+                    enabledToggle.addEventListener('change', () => {
+                        userContentRequest('PUT', entry.id, Object.assign({}, entry, { enabled: enabledToggle.checked }))
+                            .then(loadUserContent)
+                            .catch(e => showUserContentError('Could not update "' + entry.name + '": ' + e.message));
+                    });
+                    const editBtn = document.createElement('button');
+                    editBtn.type = 'button';
+                    editBtn.className = 'text-blue-600 hover:text-blue-800';
+                    editBtn.textContent = 'Edit';
+                    editBtn.addEventListener('click', () => editUserContent(entry));
+                    const deleteBtn = document.createElement('button');
+                    deleteBtn.type = 'button';
+                    deleteBtn.className = 'text-red-600 hover:text-red-800';
+                    deleteBtn.textContent = 'Delete';
+                    deleteBtn.addEventListener('click', () => {
+                        if (!confirm('Delete "' + entry.name + '"?')) return;
+                        userContentRequest('DELETE', entry.id)
+                            .then(() => {
+                                if (userContentFields.id.value === entry.id) resetUserContentForm();
+                                loadUserContent();
+                            })
+                            .catch(e => showUserContentError('Could not delete "' + entry.name + '": ' + e.message));
+                    });
+                    controls.appendChild(enabledToggle);
+                    controls.appendChild(editBtn);
+                    controls.appendChild(deleteBtn);
+                    row.appendChild(controls);
+                }
+                userContentList.appendChild(row);
+            });
+        }
+
+        function loadUserContent() {
+            if (!userContentList) return;
+            userContentRequest('GET')
+                .then(renderUserContent)
+                .catch(e => showUserContentError('Could not load user scripts and styles: ' + e.message));
+        }
+
+        if (userContentForm) {
+            userContentForm.addEventListener('submit', event => {
+                event.preventDefault();
+                const entry = {
+                    name: userContentFields.name.value.trim(),
+                    kind: userContentFields.kind.value,
+                    hosts: userContentFields.hosts.value.split(',').map(h => h.trim()).filter(h => h),
+                    code: userContentFields.code.value,
+                    enabled: userContentFields.enabled.checked
+                };
+                const id = userContentFields.id.value;
+                userContentRequest(id ? 'PUT' : 'POST', id, entry)
+                    .then(() => {
+                        resetUserContentForm();
+                        loadUserContent();
+                    })
+                    .catch(e => showUserContentError(e.message));
+            });
+            userContentCancelBtn.addEventListener('click', resetUserContentForm);
+        }
+
+        // --- Cookies & site data (stored server-side, see sitedata.go) ---
+        const siteDataList = document.getElementById('site-data-list');
+        const siteDataError = document.getElementById('site-data-error');
+        const clearProxyDataBtn = document.getElementById('clear-proxy-data-btn');
+
+        function showSiteDataError(message) {
+            siteDataError.textContent = message;
+            siteDataError.classList.toggle('hidden', !message);
+        }
+
+        function siteDataRequest(method, params) {
+            const query = new URLSearchParams(params || {}).toString();
+            return settingsFetch('/proxy-sitedata' + (query ? '?' + query : ''), { method: method, credentials: 'same-origin' })
+                .then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                });
+        }
+
+        function createSiteDataButton(label, className, onClick) {
+            const button = document.createElement('button');
+            button.type = 'button';
+            button.className = className;
+            button.textContent = label;
+            button.addEventListener('click', onClick);
+            return button;
+        }
+
+        function describeCookie(cookie) {
+            const flags = [cookie.domain + cookie.path];
+            if (cookie.httpOnly) flags.push('HttpOnly');
+            if (cookie.secure) flags.push('Secure');
+            if (cookie.sameSite) flags.push('SameSite=' + cookie.sameSite);
+            const expires = new Date(cookie.expires);
+            flags.push(expires.getFullYear() > 1 ? 'expires ' + expires.toLocaleString() : 'session');
+            return flags.join(' · ');
+        }
+
+        function renderSiteCookies(container, entry) {
+            container.innerHTML = '';
+            entry.cookies.forEach(cookie => {
+                const row = document.createElement('div');
+                row.className = 'flex items-center justify-between py-1 pl-3';
+                const info = document.createElement('div');
+                info.className = 'min-w-0 flex-grow mr-2';
+                const name = document.createElement('div');
+                name.className = 'font-mono text-xs text-gray-800 truncate';
+                name.textContent = cookie.name;
+                const details = document.createElement('div');
+                details.className = 'text-xs text-gray-500 truncate';
+                details.textContent = describeCookie(cookie);
+                info.appendChild(name);
+                info.appendChild(details);
+                row.appendChild(info);
+                row.appendChild(createSiteDataButton('Delete', 'text-red-600 hover:text-red-800 text-xs flex-shrink-0', () => {
+                    siteDataRequest('DELETE', { site: entry.site, name: cookie.name, domain: cookie.domain, path: cookie.path })
+                        .then(loadSiteData)
+                        .catch(e => showSiteDataError('Could not delete cookie "' + cookie.name + '": ' + e.message));
+                }));
+                container.appendChild(row);
+            });
+        }
+
+        function renderSiteData(sites) {
+            siteDataList.innerHTML = '';
+            if (sites.length === 0) {
+                siteDataList.innerHTML = '<p class="text-gray-500 py-2">No cookies or site preferences stored.</p>';
+                return;
+            }
+            sites.forEach(entry => {
+                const item = document.createElement('div');
+                item.className = 'py-2';
+                const row = document.createElement('div');
+                row.className = 'flex items-center justify-between';
+                const info = document.createElement('div');
+                info.className = 'min-w-0 flex-grow mr-2';
+                const title = document.createElement('div');
+                title.className = 'font-medium text-gray-800 truncate';
+                title.textContent = entry.site;
+                const summary = document.createElement('div');
+                summary.className = 'text-xs text-gray-500 truncate';
+                summary.textContent = entry.cookies.length + (entry.cookies.length === 1 ? ' cookie' : ' cookies') +
+                    (entry.preferences.length ? ' · preferences for ' + entry.preferences.join(', ') : '');
+                info.appendChild(title);
+                info.appendChild(summary);
+                row.appendChild(info);
+
+                const controls = document.createElement('div');
+                controls.className = 'flex items-center space-x-2 flex-shrink-0';
+                const cookieList = document.createElement('div');
+                cookieList.className = 'hidden mt-1';
+                if (entry.cookies.length) {
+                    controls.appendChild(createSiteDataButton('Cookies', 'text-blue-600 hover:text-blue-800', () => {
+                        if (cookieList.classList.toggle('hidden')) return;
+                        renderSiteCookies(cookieList, entry);
+                    }));
+                    controls.appendChild(createSiteDataButton('Clear', 'text-red-600 hover:text-red-800', () => {
+                        siteDataRequest('DELETE', { site: entry.site })
+                            .then(loadSiteData)
+                            .catch(e => showSiteDataError('Could not clear cookies of ' + entry.site + ': ' + e.message));
+                    }));
+                }
+                controls.appendChild(createSiteDataButton('Forget', 'text-red-600 hover:text-red-800 font-semibold', () => forgetSite(entry.site)));
+                row.appendChild(controls);
+                item.appendChild(row);
+                item.appendChild(cookieList);
+                siteDataList.appendChild(item);
+            });
+        }
+
+        function loadSiteData() {
+            if (!siteDataList) return;
+            siteDataRequest('GET')
+                .then(sites => {
+                    showSiteDataError('');
+                    renderSiteData(sites);
+                })
+                .catch(e => showSiteDataError('Could not load site data: ' + e.message));
+        }
+
+        // Forgets a site: its cookies, preferences and cached entries.
+        function forgetSite(site) {
+            if (!confirm('Forget ' + site + '? Its cookies, preferences and cached entries are deleted.')) return;
+            siteDataRequest('POST', { site: site })
+                .then(() => {
+                    loadSiteData();
+                    loadGlobalSettings();
+                })
+                .catch(e => showSiteDataError('Could not forget ' + site + ': ' + e.message));
+        }
+
+        // Deletes what proxied pages left in this origin's storage and caches.
+        // Bookmarks are kept.
+        async function clearBrowserSiteData() {
+            const bookmarksToKeep = localStorage.getItem(BOOKMARKS_LS_KEY);
+            localStorage.clear();
+            if (bookmarksToKeep) localStorage.setItem(BOOKMARKS_LS_KEY, bookmarksToKeep);
+            sessionStorage.clear();
+            if (window.indexedDB && typeof window.indexedDB.databases === 'function') {
+                const dbs = await window.indexedDB.databases();
+                dbs.filter(db => db.name).forEach(db => window.indexedDB.deleteDatabase(db.name));
+            }
+            if (window.caches) {
+                const cacheNames = await window.caches.keys();
+                await Promise.all(cacheNames.map(name => window.caches.delete(name)));
+            }
+        }
+
+        // Deletes every site cookie, and what proxied pages left in this browser.
+        // Bookmarks and the server-side preferences are kept.
+        async function clearProxyData() {
+            if (!confirm('Delete all site cookies and stored site data?')) return;
+            try {
+                await siteDataRequest('DELETE');
+                await clearBrowserSiteData();
+                loadSiteData();
+                alert('Proxy data cleared.');
+            } catch (e) {
+                showSiteDataError('Could not clear proxy data: ' + e.message);
+            }
+        }
+
+        if (clearProxyDataBtn) {
+            clearProxyDataBtn.addEventListener('click', clearProxyData);
+        }
+
+        // --- Incognito session (see incognito.go) ---
+        const incognitoBanner = document.getElementById('incognito-banner');
+        const incognitoBannerText = document.getElementById('incognito-banner-text');
+        const incognitoStatusText = document.getElementById('incognito-status');
+        const incognitoStartBtn = document.getElementById('incognito-start-btn');
+        const incognitoEndBtn = document.getElementById('incognito-end-btn');
+        const logoutForm = document.querySelector('form[action="/auth/logout"]');
+
+        function incognitoRequest(method) {
+            return settingsFetch('/proxy-incognito', { method: method, credentials: 'same-origin' })
+                .then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                });
+        }
+
+        function renderIncognitoStatus(status) {
+            incognitoActive = status.active;
+            const minutes = Math.max(1, Math.round(status.idleTimeoutSeconds / 60));
+            incognitoBanner.classList.toggle('hidden', !status.active);
+            incognitoStartBtn.classList.toggle('hidden', status.active);
+            incognitoBannerText.textContent = 'Cookies, preferences and cached pages are kept in memory only, and deleted when you end the session, log out or stay inactive for ' + minutes + ' minutes.';
+            incognitoStatusText.textContent = status.active
+                ? 'An incognito session is running. Nothing you change is saved to your account.'
+                : 'Cookies, preferences and user scripts are saved to your account. An incognito session starts from your preferences and forgets everything when it ends.';
+        }
+
+        // Reloads everything that belongs to the account or the incognito session.
+        function reloadSessionData() {
+            loadGlobalSettings();
+            loadUserContent();
+            loadSiteData();
+        }
+
+        function loadIncognitoStatus() {
+            if (!incognitoBanner) return;
+            incognitoRequest('GET')
+                .then(renderIncognitoStatus)
+                .catch(e => console.error('Could not load the incognito session status:', e));
+        }
+
+        if (incognitoStartBtn) {
+            incognitoStartBtn.addEventListener('click', () => {
+                incognitoRequest('POST')
+                    .then(status => {
+                        renderIncognitoStatus(status);
+                        reloadSessionData();
+                    })
+                    .catch(e => alert('Could not start an incognito session: ' + e.message));
+            });
+            incognitoEndBtn.addEventListener('click', () => {
+                if (!confirm('End the incognito session? Its cookies, preferences and cached pages are deleted.')) return;
+                incognitoRequest('DELETE')
+                    .then(async status => {
+                        await clearBrowserSiteData();
+                        renderIncognitoStatus(status);
+                        reloadSessionData();
+                    })
+                    .catch(e => alert('Could not end the incognito session: ' + e.message));
+            });
+        }
+        if (logoutForm) {
+            logoutForm.addEventListener('submit', event => {
+                if (!incognitoActive) return;
+                event.preventDefault();
+                clearBrowserSiteData().finally(() => logoutForm.submit());
+            });
+        }
+
         loadGlobalSettings(); 
         loadBookmarks();
+        loadUserContent();
+        loadSiteData();
+        loadIncognitoStatus();
     }); 
 // --- End of Client Logic ---
 `
@@ -756,10 +2098,121 @@ func initEnv() {
 		authServiceURL += "/"
 	}
 	log.Printf("Auth Service URL configured to: %s", authServiceURL)
+
+	if lazyAttrsEnv := os.Getenv("LAZY_LOAD_ATTRIBUTES"); lazyAttrsEnv != "" {
+		configuredLazyAttrs := make(map[string]string)
+		for _, entry := range strings.Split(lazyAttrsEnv, ",") {
+			name, promoteTo, hasTarget := strings.Cut(strings.TrimSpace(entry), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			promoteTo = strings.ToLower(strings.TrimSpace(promoteTo))
+			if !hasTarget {
+				promoteTo = "src"
+			}
+			switch promoteTo {
+			case "src", "srcset", "poster", "background":
+			default:
+				log.Printf("Warning: LAZY_LOAD_ATTRIBUTES entry '%s' has unknown target '%s'. Skipping.", entry, promoteTo)
+				continue
+			}
+			if name != "" {
+				configuredLazyAttrs[name] = promoteTo
+			}
+		}
+		lazyLoadAttributes = configuredLazyAttrs
+		log.Printf("Lazy-load attributes configured: %v", lazyLoadAttributes)
+	}
+	if promoteEnv := os.Getenv("PROMOTE_LAZY_ATTRIBUTES"); promoteEnv != "" {
+		promoteLazyLoadAttrs = promoteEnv == "true" || promoteEnv == "1"
+	}
+	if jsRewriteEnv := os.Getenv("JS_REWRITE_ENABLED"); jsRewriteEnv != "" {
+		jsRewriteEnabled = jsRewriteEnv == "true" || jsRewriteEnv == "1"
+		log.Printf("JavaScript location rewriting enabled: %t", jsRewriteEnabled)
+	}
+	if maxDimEnv := os.Getenv("DATA_SAVER_MAX_DIMENSION"); maxDimEnv != "" {
+		if maxDim, err := strconv.Atoi(maxDimEnv); err == nil && maxDim > 0 {
+			dataSaverMaxDimension = maxDim
+		} else {
+			log.Printf("Warning: Invalid DATA_SAVER_MAX_DIMENSION '%s'. Using %d.", maxDimEnv, dataSaverMaxDimension)
+		}
+	}
+	if qualityEnv := os.Getenv("DATA_SAVER_JPEG_QUALITY"); qualityEnv != "" {
+		if quality, err := strconv.Atoi(qualityEnv); err == nil && quality >= 1 && quality <= 100 {
+			dataSaverJPEGQuality = quality
+		} else {
+			log.Printf("Warning: Invalid DATA_SAVER_JPEG_QUALITY '%s'. Using %d.", qualityEnv, dataSaverJPEGQuality)
+		}
+	}
+	if cleanerEnv := os.Getenv("URL_CLEANER_ENABLED"); cleanerEnv != "" {
+		urlCleanerEnabled = cleanerEnv == "true" || cleanerEnv == "1"
+	}
+	if urlCleanerEnabled {
+		providers := defaultURLCleanerProviders
+		if rulesPath := os.Getenv("URL_CLEANER_RULES"); rulesPath != "" {
+			if loadedProviders, err := loadURLCleanerRules(rulesPath); err == nil {
+				providers = loadedProviders
+			} else {
+				log.Printf("Warning: Error loading URL_CLEANER_RULES: %v. Using built-in rules.", err)
+			}
+		}
+		activeURLCleanerProviders = compileURLCleanerProviders(providers)
+		log.Printf("URL cleaner enabled with %d providers", len(activeURLCleanerProviders))
+	}
+	if filterListsEnv := os.Getenv("FILTER_LISTS"); filterListsEnv != "" {
+		var filterListPaths []string
+		for _, path := range strings.Split(filterListsEnv, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				filterListPaths = append(filterListPaths, path)
+			}
+		}
+		activeFilters = loadFilterLists(filterListPaths)
+	}
+
+	if dataDir = os.Getenv("DATA_DIR"); dataDir != "" {
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			log.Fatalf("Error: Cannot create DATA_DIR '%s': %v", dataDir, err)
+		}
+		log.Printf("Server-side state stored in %s", dataDir)
+	} else {
+		log.Println("Warning: DATA_DIR not set. Site preferences, user scripts and styles, and site cookies are kept in memory only.")
+	}
+	initCookieJar(os.Getenv("COOKIE_JAR_KEY"))
+	if idleTimeoutEnv := os.Getenv("INCOGNITO_IDLE_TIMEOUT"); idleTimeoutEnv != "" {
+		if idleTimeout, err := time.ParseDuration(idleTimeoutEnv); err == nil && idleTimeout > 0 {
+			incognitoIdleTimeout = idleTimeout
+		} else {
+			log.Printf("Warning: Invalid INCOGNITO_IDLE_TIMEOUT '%s'. Using %s.", idleTimeoutEnv, incognitoIdleTimeout)
+		}
+	}
+	initIncognitoSessions()
+	if userContentFile := os.Getenv("USER_CONTENT_FILE"); userContentFile != "" {
+		entries, err := loadOperatorUserContent(userContentFile)
+		if err != nil {
+			log.Printf("Warning: Could not load USER_CONTENT_FILE '%s': %v", userContentFile, err)
+		} else {
+			operatorUserContent = entries
+			log.Printf("Loaded %d operator user scripts and styles from %s", len(entries), userContentFile)
+		}
+	}
+	if profilesFile := os.Getenv("PRIVACY_PROFILES_FILE"); profilesFile != "" {
+		if err := loadPrivacyProfiles(profilesFile); err != nil {
+			log.Fatalf("Error: Could not load PRIVACY_PROFILES_FILE '%s': %v", profilesFile, err)
+		}
+		log.Printf("Privacy profiles available: %s", strings.Join(privacyProfileOrder, ", "))
+	}
+	if profileEnv := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_PRIVACY_PROFILE"))); profileEnv != "" {
+		if _, ok := privacyProfiles[profileEnv]; !ok {
+			log.Fatalf("Error: DEFAULT_PRIVACY_PROFILE '%s' is not a known profile (%s)", profileEnv, strings.Join(privacyProfileOrder, ", "))
+		}
+		defaultPrivacyProfile = profileEnv
+		log.Printf("Default privacy profile: %s", defaultPrivacyProfile)
+	}
+	loadUserContentState()
+	loadSitePreferencesState()
 }
 
-// makeLandingPageHTML constructs the full HTML for the landing page.
-func makeLandingPageHTML() string {
+// makeLandingPageHTML constructs the full HTML for the landing page, carrying
+// the token its scripts send to the settings APIs.
+func makeLandingPageHTML(settingsToken string) string {
 	var sb strings.Builder
 
 	sb.WriteString(`<!DOCTYPE html>
@@ -767,6 +2220,9 @@ func makeLandingPageHTML() string {
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="proxy-settings-token" content="`)
+	sb.WriteString(stdhtml.EscapeString(settingsToken))
+	sb.WriteString(`">
     <title>Service Worker Web Proxy</title>
     <script src="/proxy?url=https%3A%2F%2Fcdn.tailwindcss.com"></script>
     <style type="text/css">`)
@@ -775,6 +2231,10 @@ func makeLandingPageHTML() string {
 </head>
 <body class="bg-gray-100 text-gray-800">
     <div class="container max-w-3xl mx-auto p-4 md:p-6">
+        <div id="incognito-banner" class="hidden bg-gray-800 text-white px-4 py-3 rounded-lg shadow-md mb-6 text-sm flex items-center justify-between">
+            <span>🕶️ <strong>Incognito session.</strong> <span id="incognito-banner-text"></span></span>
+            <button type="button" id="incognito-end-btn" class="ml-3 flex-shrink-0 bg-white text-gray-800 font-semibold py-1 px-3 rounded-md">End session</button>
+        </div>
         
         <div class="proxy-component bg-white p-4 sm:p-6 rounded-lg shadow-md border border-gray-200 mb-6"> 
             <h1 class="text-2xl sm:text-3xl font-bold text-center text-blue-700 mb-6">Service Worker Web Proxy</h1>
@@ -809,6 +2269,13 @@ func makeLandingPageHTML() string {
                     Global Privacy Settings
                 </summary>
                 <div class="advanced-settings-content mt-4 space-y-3">
+                    <div class="settings-item bg-gray-50 p-3 rounded-md text-sm">
+                        <div class="flex items-center justify-between">
+                            <label for="global-profile" class="text-gray-700">Privacy Profile:</label>
+                            <select id="global-profile" class="border border-gray-300 rounded-md px-2 py-1 text-sm focus:ring-blue-500 focus:border-blue-500"></select>
+                        </div>
+                        <p id="global-profile-description" class="text-xs text-gray-500 mt-1"></p>
+                    </div>
                     <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
                         <label for="global-js" class="text-gray-700">Allow JavaScript:</label>
                         <input type="checkbox" id="global-js" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
@@ -821,13 +2288,113 @@ func makeLandingPageHTML() string {
                         <label for="global-iframes" class="text-gray-700">Allow iFrames:</label>
                         <input type="checkbox" id="global-iframes" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
                     </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-images" class="text-gray-700">Allow Images:</label>
+                        <input type="checkbox" id="global-images" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-media" class="text-gray-700">Allow Audio &amp; Video:</label>
+                        <input type="checkbox" id="global-media" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-fonts" class="text-gray-700">Allow Web Fonts:</label>
+                        <input type="checkbox" id="global-fonts" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-workers" class="text-gray-700">Allow Web Workers:</label>
+                        <input type="checkbox" id="global-workers" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-forms" class="text-gray-700">Allow Forms:</label>
+                        <input type="checkbox" id="global-forms" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
                     <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
                         <label for="global-raw-mode" class="text-gray-700">Raw Mode (No Server Rewrite):</label>
                         <input type="checkbox" id="global-raw-mode" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
                     </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-reader-mode" class="text-gray-700">Reader Mode (Article Only):</label>
+                        <input type="checkbox" id="global-reader-mode" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-data-saver" class="text-gray-700">Data Saver (Shrink Images):</label>
+                        <input type="checkbox" id="global-data-saver" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
+                    <div class="settings-item bg-gray-50 p-3 rounded-md flex items-center justify-between text-sm">
+                        <label for="global-image-placeholders" class="text-gray-700">Click-to-Load Images:</label>
+                        <input type="checkbox" id="global-image-placeholders" class="h-5 w-5 text-blue-600 border-gray-300 rounded focus:ring-blue-500">
+                    </div>
+                </div>
+            </details>
+        </div>
+
+        <div class="proxy-component bg-white p-4 sm:p-6 rounded-lg shadow-md border border-gray-200 mt-6"> 
+            <details class="advanced-settings-section" id="user-content-section">
+                <summary class="font-semibold py-2 cursor-pointer list-inside text-blue-700 text-lg hover:text-blue-800">
+                    User Scripts &amp; Styles
+                </summary>
+                <div class="advanced-settings-content mt-4 space-y-3">
+                    <div id="user-content-list" class="divide-y divide-gray-200 text-sm"></div>
+                    <form id="user-content-form" class="bg-gray-50 p-3 rounded-md space-y-2 text-sm">
+                        <input type="hidden" id="user-content-id">
+                        <div class="flex space-x-2">
+                            <input type="text" id="user-content-name" placeholder="Name" required maxlength="100"
+                                   class="flex-grow p-2 border border-gray-300 rounded-md">
+                            <select id="user-content-kind" class="p-2 border border-gray-300 rounded-md">
+                                <option value="style">Style (CSS)</option>
+                                <option value="script">Script (JS)</option>
+                            </select>
+                        </div>
+                        <input type="text" id="user-content-hosts" placeholder="Hosts, e.g. example.com, *.example.org" required
+                               class="block w-full p-2 border border-gray-300 rounded-md">
+                        <textarea id="user-content-code" rows="6" placeholder="Code" spellcheck="false"
+                                  class="block w-full p-2 border border-gray-300 rounded-md font-mono text-xs"></textarea>
+                        <div class="flex items-center justify-between">
+                            <label class="text-gray-700"><input type="checkbox" id="user-content-enabled" checked class="mr-1">Enabled</label>
+                            <div class="space-x-2">
+                                <button type="button" id="user-content-cancel" class="hidden bg-gray-300 hover:bg-gray-400 text-gray-800 py-1 px-3 rounded-md">Cancel</button>
+                                <button type="submit" id="user-content-save" class="bg-blue-600 hover:bg-blue-700 text-white font-semibold py-1 px-3 rounded-md">Add</button>
+                            </div>
+                        </div>
+                        <div id="user-content-error" class="bg-red-100 border border-red-400 text-red-700 px-3 py-1 rounded-md hidden"></div>
+                    </form>
+                </div>
+            </details>
+        </div>
+
+        <div class="proxy-component bg-white p-4 sm:p-6 rounded-lg shadow-md border border-gray-200 mt-6"> 
+            <details class="advanced-settings-section" id="site-data-section">
+                <summary class="font-semibold py-2 cursor-pointer list-inside text-blue-700 text-lg hover:text-blue-800">
+                    Cookies &amp; Site Data
+                </summary>
+                <div class="advanced-settings-content mt-4 space-y-3">
+                    <div id="site-data-list" class="divide-y divide-gray-200 text-sm"></div>
+                    <div id="site-data-error" class="bg-red-100 border border-red-400 text-red-700 px-3 py-1 rounded-md hidden text-sm"></div>
+                    <div class="bg-gray-50 p-3 rounded-md text-sm">
+                        <button type="button" id="clear-proxy-data-btn"
+                                class="bg-amber-400 hover:bg-amber-500 text-gray-800 font-semibold py-2 px-4 rounded-md shadow-sm w-full">
+                            Clear Proxy Data
+                        </button>
+                        <p class="text-xs text-gray-500 mt-1">
+                            Deletes every stored site cookie, plus the storage and caches sites left in this browser. Bookmarks &amp; preferences are kept.
+                        </p>
+                    </div>
                 </div>
             </details>
         </div>
+
+        <div class="proxy-component bg-white p-4 sm:p-6 rounded-lg shadow-md border border-gray-200 mt-6"> 
+            <h2 class="text-xl font-semibold text-blue-700 mb-4 border-b border-gray-300 pb-2">Session</h2>
+            <div class="space-y-3 text-sm">
+                <div class="bg-gray-50 p-3 rounded-md flex items-center justify-between">
+                    <p id="incognito-status" class="text-gray-700 mr-3">Cookies, preferences and user scripts are saved to your account.</p>
+                    <button type="button" id="incognito-start-btn" class="flex-shrink-0 bg-gray-800 hover:bg-gray-900 text-white font-semibold py-2 px-4 rounded-md shadow-sm">Go Incognito</button>
+                </div>
+                <form method="POST" action="/auth/logout" class="text-right">
+                    <button type="submit" class="bg-red-600 hover:bg-red-700 text-white font-semibold py-2 px-4 rounded-md shadow-sm">Log Out</button>
+                </form>
+            </div>
+        </div>
     </div>
     <script type="text/javascript">//<![CDATA[
 `)
@@ -846,6 +2413,7 @@ func main() {
 	http.HandleFunc("/auth/enter-email", handleServeEmailPage)
 	http.HandleFunc("/auth/submit-email", handleSubmitEmailToExternalCF)
 	http.HandleFunc("/auth/submit-code", handleSubmitCodeToExternalCF)
+	http.HandleFunc("/auth/logout", handleLogout)
 	http.HandleFunc(serviceWorkerPath, serveServiceWorkerJS)
 	http.HandleFunc("/", masterHandler)
 
@@ -855,11 +2423,55 @@ func main() {
 	}
 }
 
-func serveServiceWorkerJS(w http.ResponseWriter, r *http.Request) {
+func serveServiceWorkerJS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600, must-revalidate")
+	w.Header().Set("Service-Worker-Allowed", "/")
+	fmt.Fprint(w, embeddedSWContent)
+}
+
+// runtimeConfig is the configuration embedded into the in-page runtime and the worker prelude.
+type runtimeConfig struct {
+	ProxyPath           string   `json:"proxyPath"`
+	PassthroughPrefixes []string `json:"passthroughPrefixes"`
+	CookiePath          string   `json:"cookiePath,omitempty"` // In-page runtime only
+	TargetURL           string   `json:"targetURL,omitempty"`  // Worker prelude only
+}
+
+// fillRuntimeTemplate splices the shared URL helpers and the configuration into a
+// runtime script template.
+func fillRuntimeTemplate(template string, config runtimeConfig) string {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		log.Printf("Error marshalling runtime config: %v", err)
+		configJSON = []byte("{}")
+	}
+	filled := strings.Replace(template, "__PROXY_URL_FUNCTIONS__", embeddedProxyURLFunctionsJS, 1)
+	return strings.Replace(filled, "__PROXY_RUNTIME_CONFIG__", string(configJSON), 1)
+}
+
+// makeRuntimeJS returns the in-page runtime with its configuration filled in.
+func makeRuntimeJS() string {
+	return fillRuntimeTemplate(embeddedRuntimeJSContent, runtimeConfig{
+		ProxyPath:           proxyRequestPath,
+		PassthroughPrefixes: nonProxiedURLPrefixes,
+		CookiePath:          cookieJarPath,
+	})
+}
+
+// makeWorkerPreludeJS returns the worker prelude for a worker script loaded from workerURL.
+func makeWorkerPreludeJS(workerURL *url.URL) string {
+	return fillRuntimeTemplate(embeddedWorkerPreludeContent, runtimeConfig{
+		ProxyPath:           proxyRequestPath,
+		PassthroughPrefixes: nonProxiedURLPrefixes,
+		TargetURL:           workerURL.String(),
+	})
+}
+
+func serveRuntimeJS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
 	w.Header().Set("Cache-Control", "public, max-age=3600, must-revalidate")
-	w.Header().Set("Service-Worker-Allowed", "/")
-	fmt.Fprint(w, embeddedSWContent)
+	fmt.Fprint(w, makeRuntimeJS())
 }
 
 
@@ -1054,7 +2666,7 @@ func handleServeEmailPage(w http.ResponseWriter, r *http.Request) {
 	var sb strings.Builder
 	sb.WriteString(`<!DOCTYPE html><html lang="en"><head><meta charset="UTF-8"><title>Proxy Authentication - Enter Email</title><style>body{font-family:sans-serif;margin:20px;display:flex;flex-direction:column;align-items:center;padding-top:40px;background-color:#f0f2f5;}.container{border:1px solid #ccc;padding:20px 30px;border-radius:8px;background-color:#fff;box-shadow:0 2px 10px rgba(0,0,0,0.1);}form > div{margin-bottom:15px;}label{display:inline-block;min-width:120px;margin-bottom:5px;}input[type="text"],input[type="email"]{padding:10px;border:1px solid #ddd;border-radius:4px;width:250px;}button{padding:10px 15px;background-color:#007bff;color:white;border:none;border-radius:4px;cursor:pointer;font-size:1em;}button:hover{background-color:#0056b3;}</style></head><body><div class="container"><h2>Proxy Service Authentication</h2><p>Please enter your email to access the proxy service:</p><form action="/auth/submit-email" method="POST"><input type="hidden" name="original_url" value="`)
 	sb.WriteString(stdhtml.EscapeString(originalURL))
-	sb.WriteString(`"><div><label for="email">Email:</label><input type="email" id="email" name="email" required autofocus></div><div><button type="submit">Send Verification Code</button></div></form></div></body></html>`)
+	sb.WriteString(`"><div><label for="email">Email:</label><input type="email" id="email" name="email" required autofocus></div><div><label><input type="checkbox" name="incognito" value="1"> Incognito session (nothing is kept after logout or inactivity)</label></div><div><button type="submit">Send Verification Code</button></div></form></div></body></html>`)
 	fmt.Fprint(w, sb.String())
 }
 
@@ -1176,6 +2788,9 @@ func handleSubmitEmailToExternalCF(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		http.SetCookie(w, &http.Cookie{Name: "proxy-original-url", Value: url.QueryEscape(originalURLPath), Path: "/", HttpOnly: true, Secure: r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https", SameSite: http.SameSiteLaxMode, MaxAge: 300})
+		if r.FormValue("incognito") == "1" {
+			http.SetCookie(w, &http.Cookie{Name: incognitoLoginCookieName, Value: "1", Path: "/auth/", HttpOnly: true, Secure: r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https", SameSite: http.SameSiteLaxMode, MaxAge: 300})
+		}
 		serveCustomCodeInputPage(w, r, nonceValue, parsedCodeCallbackURL.String(), currentSetCookieHeaders, baseForCodeCallback.Host)
 		return
 	}
@@ -1211,7 +2826,7 @@ func handleSubmitCodeToExternalCF(w http.ResponseWriter, r *http.Request) {
 	var accumulatedSetCookies []string
 
 	for _, cookie := range r.Cookies() {
-		if cookie.Name != "proxy-original-url" && cookie.Name != authCookieName {
+		if !proxyCookieNames[strings.ToLower(cookie.Name)] {
 			accumulatedSetCookies = append(accumulatedSetCookies, cookie.String())
 		}
 	}
@@ -1345,6 +2960,14 @@ func handleSubmitCodeToExternalCF(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Auth: Set proxy's %s cookie. Name: %s, Path: %s, Secure: %t, HttpOnly: %t, SameSite: %v, MaxAge: %d",
 			authCookieName, cfAuthCookieToSet.Name, cfAuthCookieToSet.Path, cfAuthCookieToSet.Secure, cfAuthCookieToSet.HttpOnly, cfAuthCookieToSet.SameSite, cfAuthCookieToSet.MaxAge)
 
+		if _, errCookie := r.Cookie(incognitoLoginCookieName); errCookie == nil {
+			startIncognitoSession(w, r, accountIDFromPayload(decodedJWTPayload), authExpiry(decodedJWTPayload))
+			http.SetCookie(w, &http.Cookie{Name: incognitoLoginCookieName, Value: "", Path: "/auth/", MaxAge: -1})
+		} else if incognitoCookie, errCookie := r.Cookie(incognitoCookieName); errCookie == nil {
+			endIncognitoSession(incognitoCookie.Value, "replaced by a login")
+			http.SetCookie(w, &http.Cookie{Name: incognitoCookieName, Value: "", Path: "/", MaxAge: -1})
+		}
+
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		http.SetCookie(w, &http.Cookie{Name: "proxy-original-url", Value: "", Path: "/", MaxAge: -1})
@@ -1375,25 +2998,20 @@ func handleSubmitCodeToExternalCF(w http.ResponseWriter, r *http.Request) {
 
 // --- Privacy Proxy Core Handlers & Helpers ---
 
-func getBoolCookie(r *http.Request, name string) bool {
-	cookie, err := r.Cookie(name)
-	if err != nil {
-		return false
-	}
-	return cookie.Value == "true"
-}
-
-
-func rewriteProxiedURL(originalAttrURL string, pageBaseURL *url.URL, clientReq *http.Request) (string, error) {
+// rewriteProxiedURL resolves a URL found in a page against pageBaseURL and points
+// it at the proxy. With blockTrackers (the page's preference), tracking parameters
+// and redirect wrappers are removed first.
+func rewriteProxiedURL(originalAttrURL string, pageBaseURL *url.URL, clientReq *http.Request, blockTrackers bool) (string, error) {
 	originalAttrURL = strings.TrimSpace(originalAttrURL)
-	if originalAttrURL == "" || strings.HasPrefix(originalAttrURL, "#") ||
-		strings.HasPrefix(originalAttrURL, "javascript:") ||
-		strings.HasPrefix(originalAttrURL, "mailto:") ||
-		strings.HasPrefix(originalAttrURL, "tel:") ||
-		strings.HasPrefix(originalAttrURL, "data:") ||
-		strings.HasPrefix(originalAttrURL, "blob:") {
+	if originalAttrURL == "" {
 		return originalAttrURL, nil
 	}
+	lowerAttrURL := strings.ToLower(originalAttrURL)
+	for _, prefix := range nonProxiedURLPrefixes {
+		if strings.HasPrefix(lowerAttrURL, prefix) {
+			return originalAttrURL, nil
+		}
+	}
 
 	absURL, err := pageBaseURL.Parse(originalAttrURL)
 	if err != nil {
@@ -1409,210 +3027,419 @@ func rewriteProxiedURL(originalAttrURL string, pageBaseURL *url.URL, clientReq *
 	if absURL.Scheme != "http" && absURL.Scheme != "https" {
 		return absURL.String(), nil
 	}
+	if blockTrackers {
+		absURL, _ = cleanTrackingURL(absURL)
+	}
 
 	proxyScheme := "http"
 	if clientReq.TLS != nil || clientReq.Header.Get("X-Forwarded-Proto") == "https" {
 		proxyScheme = "https"
 	}
+	// Keep the fragment on the proxy URL itself so the browser can still act on it
+	// (e.g. <use href="sprites.svg#icon">, in-page anchors).
+	fragment := absURL.EscapedFragment()
+	targetWithoutFragment := *absURL
+	targetWithoutFragment.Fragment = ""
+	targetWithoutFragment.RawFragment = ""
+
 	proxyAccessURL := fmt.Sprintf("%s://%s%s?url=%s",
 		proxyScheme,
 		clientReq.Host,
 		proxyRequestPath,
-		url.QueryEscape(absURL.String()),
+		url.QueryEscape(targetWithoutFragment.String()),
 	)
+	if fragment != "" {
+		proxyAccessURL += "#" + fragment
+	}
 	return proxyAccessURL, nil
 }
 
-func rewriteHTMLContentAdvanced(htmlReader io.Reader, pageBaseURL *url.URL, clientReq *http.Request, prefs sitePreferences, scriptNonce string) (io.Reader, error) {
-	doc, err := html.Parse(htmlReader)
-	if err != nil {
-		return nil, fmt.Errorf("HTML parsing error: %w", err)
+// rewriteSrcsetValue rewrites each candidate URL of a srcset attribute, keeping descriptors.
+func rewriteSrcsetValue(srcset string, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) (string, bool) {
+	sources := strings.Split(srcset, ",")
+	var newSources []string
+	changed := false
+	for _, source := range sources {
+		trimmedSource := strings.TrimSpace(source)
+		parts := strings.Fields(trimmedSource)
+		if len(parts) > 0 {
+			u := parts[0]
+			descriptor := ""
+			if len(parts) > 1 {
+				descriptor = " " + strings.Join(parts[1:], " ")
+			}
+			if proxiedU, err := rewriteProxiedURL(u, baseURL, clientReq, blockTrackers); err == nil && proxiedU != u {
+				newSources = append(newSources, proxiedU+descriptor)
+				changed = true
+			} else {
+				newSources = append(newSources, source)
+			}
+		} else {
+			newSources = append(newSources, source)
+		}
+	}
+	if !changed {
+		return srcset, false
 	}
+	return strings.Join(newSources, ", "), true
+}
 
-	// Phase 1: Rewrite existing nodes for proxying and applying preferences
-	var rewriteExistingContentFunc func(*html.Node)
-	rewriteExistingContentFunc = func(n *html.Node) {
-		if n.Type == html.ElementNode {
-			// Handle script tags based on JavaScriptEnabled preference
-			if n.Data == "script" {
-				if !prefs.JavaScriptEnabled {
-					// Change type to prevent execution and remove content
-					n.Attr = []html.Attribute{{Key: "type", Val: "text/inert-script"}}
-					for c := n.FirstChild; c != nil; {
-						next := c.NextSibling
-						n.RemoveChild(c)
-						c = next
-					}
-				} else {
-					// If JS is enabled, rewrite src attribute if present
-					for i, attr := range n.Attr {
-						if strings.ToLower(attr.Key) == "src" && attr.Val != "" {
-							if proxiedURL, err := rewriteProxiedURL(attr.Val, pageBaseURL, clientReq); err == nil && proxiedURL != attr.Val {
-								n.Attr[i].Val = proxiedURL
-							}
-						}
-					}
-				}
-			} else if n.Data == "iframe" || n.Data == "frame" { // Handle iframe/frame tags
-				if !prefs.IframesEnabled {
-					// If iframes are disabled, set src to about:blank
-					n.Attr = []html.Attribute{{Key: "src", Val: "about:blank"}}
-				} else {
-					// If iframes are enabled, rewrite src attribute
-					for i, attr := range n.Attr {
-						if strings.ToLower(attr.Key) == "src" && attr.Val != "" {
-							if proxiedURL, err := rewriteProxiedURL(attr.Val, pageBaseURL, clientReq); err == nil && proxiedURL != attr.Val {
-								n.Attr[i].Val = proxiedURL
-							}
-						}
-					}
-				}
-			} else {
-				// General attribute rewriting for other elements
-				var newAttrs []html.Attribute
-				for _, attr := range n.Attr {
-					currentAttr := attr
-					attrKeyLower := strings.ToLower(currentAttr.Key)
-					attrVal := strings.TrimSpace(currentAttr.Val)
-
-					shouldRewrite := false
-					switch attrKeyLower {
-					case "href", "src", "action", "longdesc", "cite", "formaction", "icon", "manifest", "poster", "data", "background":
-						if attrVal != "" {
-							shouldRewrite = true
-						}
-					case "srcset":
-						if attrVal != "" {
-							sources := strings.Split(attrVal, ",")
-							var newSources []string
-							changed := false
-							for _, source := range sources {
-								trimmedSource := strings.TrimSpace(source)
-								parts := strings.Fields(trimmedSource)
-								if len(parts) > 0 {
-									u := parts[0]
-									descriptor := ""
-									if len(parts) > 1 {
-										descriptor = " " + strings.Join(parts[1:], " ")
-									}
-									if proxiedU, err := rewriteProxiedURL(u, pageBaseURL, clientReq); err == nil && proxiedU != u {
-										newSources = append(newSources, proxiedU+descriptor)
-										changed = true
-									} else {
-										newSources = append(newSources, source)
-									}
-								} else {
-									newSources = append(newSources, source)
-								}
-							}
-							if changed {
-								currentAttr.Val = strings.Join(newSources, ", ")
-							}
-						}
-					case "style":
-						if attrVal != "" {
-							newStyleVal := rewriteCSSURLsInString(attrVal, pageBaseURL, clientReq)
-							if newStyleVal != attrVal {
-								currentAttr.Val = newStyleVal
-							}
-						}
-					case "target":
-						if strings.ToLower(attrVal) == "_blank" {
-							currentAttr.Val = "_self"
-						}
-					case "integrity", "crossorigin":
-						continue
-					}
+// rewriteLazyLoadValue rewrites a lazy-load data attribute according to the real
+// attribute it stands in for (see lazyLoadAttributes).
+func rewriteLazyLoadValue(value string, promoteTo string, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) string {
+	switch promoteTo {
+	case "srcset":
+		if newSrcset, changed := rewriteSrcsetValue(value, baseURL, clientReq, blockTrackers); changed {
+			return newSrcset
+		}
+		return value
+	case "background":
+		// Either a bare URL or a CSS value such as url(...) or image-set(...).
+		if strings.Contains(value, "(") {
+			return rewriteCSSURLsInString(value, baseURL, clientReq, blockTrackers)
+		}
+	}
+	if proxiedURL, err := rewriteProxiedURL(value, baseURL, clientReq, blockTrackers); err == nil {
+		return proxiedURL
+	}
+	return value
+}
 
-					if shouldRewrite {
-						if proxiedURL, err := rewriteProxiedURL(attrVal, pageBaseURL, clientReq); err == nil && proxiedURL != attrVal {
-							currentAttr.Val = proxiedURL
-						} else if err != nil {
-							log.Printf("HTML Rewrite (Phase 1): Error proxying URL for attr '%s' val '%s' (base '%s'): %v", attrKeyLower, attrVal, pageBaseURL.String(), err)
-						}
-					}
+// lazyLoadAttributeApplies reports whether a lazy-load attribute on n holds a
+// resource URL to rewrite. Names such as data-src and data-original are also used
+// for unrelated data, so sources count only on media elements and iframes, and
+// backgrounds only when the value looks like a URL or CSS image value.
+func lazyLoadAttributeApplies(n *html.Node, promoteTo string, value string) bool {
+	switch promoteTo {
+	case "src":
+		switch n.Data {
+		case "img", "source", "video", "audio", "iframe", "embed", "input":
+			return true
+		}
+		return false
+	case "srcset":
+		return n.Data == "img" || n.Data == "source"
+	case "poster":
+		return n.Data == "video"
+	case "background":
+		value = strings.TrimSpace(value)
+		if strings.Contains(value, "(") {
+			return strings.Contains(value, "url(") || strings.Contains(value, "image-set(")
+		}
+		if strings.ContainsAny(value, " \t\n{}<>") {
+			return false
+		}
+		u, err := url.Parse(value)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https" || (u.Scheme == "" && strings.ContainsAny(u.Path, "./")))
+	}
+	return true
+}
 
-					if strings.HasPrefix(attrKeyLower, "on") && !prefs.JavaScriptEnabled {
-						continue
-					}
-					newAttrs = append(newAttrs, currentAttr)
-				}
-				n.Attr = newAttrs
+// promoteLazyLoadAttributes copies already-rewritten lazy-load attribute values into
+// the attributes the browser actually loads from (src, srcset, poster, or a
+// background-image style), replacing any placeholder.
+func promoteLazyLoadAttributes(n *html.Node) {
+	var promotions [][2]string // {target attribute, value}
+	for _, attr := range n.Attr {
+		promoteTo, isLazy := lazyLoadAttributes[attrLocalName(attr)]
+		if !isLazy || strings.TrimSpace(attr.Val) == "" {
+			continue
+		}
+		if !lazyLoadAttributeApplies(n, promoteTo, attr.Val) {
+			continue
+		}
+		// Lazy iframes are script-driven embeds (players, comment widgets) that
+		// cannot work without JavaScript; promoting one would only load a whole
+		// third-party page eagerly.
+		if n.Data == "iframe" && promoteTo == "src" {
+			continue
+		}
+		promotions = append(promotions, [2]string{promoteTo, attr.Val})
+	}
+
+	for _, promotion := range promotions {
+		targetKey, value := promotion[0], promotion[1]
+		if targetKey == "background" {
+			targetKey = "style"
+			if !strings.Contains(value, "(") {
+				value = "url('" + value + "')"
 			}
+			value = "background-image: " + value
 		}
 
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			rewriteExistingContentFunc(c)
+		replaced := false
+		for i, attr := range n.Attr {
+			if attrLocalName(attr) != targetKey {
+				continue
+			}
+			if targetKey == "style" && strings.TrimSpace(attr.Val) != "" {
+				n.Attr[i].Val = strings.TrimRight(strings.TrimSpace(attr.Val), ";") + "; " + value
+			} else {
+				n.Attr[i].Val = value
+			}
+			replaced = true
+			break
+		}
+		if !replaced {
+			n.Attr = append(n.Attr, html.Attribute{Key: targetKey, Val: value})
 		}
 	}
-	rewriteExistingContentFunc(doc)
+}
 
-	var bodyNode *html.Node
-	var findBodyNodeFunc func(*html.Node)
-	findBodyNodeFunc = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "body" {
-			bodyNode = n
-			return
+// resolveDocumentBaseURL returns the effective base URL of a document: the href of
+// its first <base> element resolved against the response URL, or the response URL.
+func resolveDocumentBaseURL(doc *html.Node, pageBaseURL *url.URL) *url.URL {
+	var baseHref string
+	var found bool
+	var findBaseFunc func(*html.Node)
+	findBaseFunc = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "base" {
+			for _, attr := range n.Attr {
+				if strings.ToLower(attr.Key) == "href" {
+					baseHref = strings.TrimSpace(attr.Val)
+					found = true
+					return
+				}
+			}
 		}
-		for c := n.FirstChild; c != nil && bodyNode == nil; c = c.NextSibling {
-			findBodyNodeFunc(c)
+		for c := n.FirstChild; c != nil && !found; c = c.NextSibling {
+			findBaseFunc(c)
 		}
 	}
-	findBodyNodeFunc(doc)
+	findBaseFunc(doc)
+	if !found || baseHref == "" {
+		return pageBaseURL
+	}
 
-	if bodyNode != nil {
-		injectedHTML := makeInjectedHTML(scriptNonce)
-		parsedNodes, errFrag := html.ParseFragment(strings.NewReader(injectedHTML), bodyNode)
-		if errFrag != nil {
-			log.Printf("ERROR parsing HTML fragment for injection (Phase 2): %v. HTML: %s", errFrag, injectedHTML)
-		} else {
-			for _, nodeToAdd := range parsedNodes {
-				bodyNode.AppendChild(nodeToAdd)
-			}
+	baseURL, err := pageBaseURL.Parse(baseHref)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") {
+		log.Printf("HTML Rewrite: Ignoring unusable <base href='%s'> on %s: %v", baseHref, pageBaseURL.String(), err)
+		return pageBaseURL
+	}
+	log.Printf("HTML Rewrite: Using <base href> %s for %s", baseURL.String(), pageBaseURL.String())
+	return baseURL
+}
+
+// isMetaRefresh reports whether n is a <meta http-equiv="refresh"> element.
+func isMetaRefresh(n *html.Node) bool {
+	for _, attr := range n.Attr {
+		if strings.ToLower(attr.Key) == "http-equiv" && strings.EqualFold(strings.TrimSpace(attr.Val), "refresh") {
+			return true
 		}
-	} else {
-		log.Println("Warning: <body> tag not found in HTML document. Cannot inject proxy home button or script.")
 	}
+	return false
+}
 
-	var buf bytes.Buffer
-	if err := html.Render(&buf, doc); err != nil {
-		return nil, fmt.Errorf("HTML rendering error after all phases: %w", err)
+// rewriteRefreshValue rewrites the target of a Refresh header or meta refresh
+// ("5; url=https://example.com/") through the proxy. A value without a target
+// (a plain reload) is returned unchanged. ok is false when the target cannot be
+// proxied and the refresh should be dropped instead.
+func rewriteRefreshValue(refreshValue string, baseURL *url.URL, clientReq *http.Request, blockTrackers bool) (string, bool) {
+	sepIdx := strings.IndexAny(refreshValue, ";,")
+	if sepIdx < 0 {
+		return refreshValue, true
 	}
-	return &buf, nil
+	delay := strings.TrimSpace(refreshValue[:sepIdx])
+	target := strings.TrimSpace(refreshValue[sepIdx+1:])
+	if len(target) >= 3 && strings.EqualFold(target[:3], "url") {
+		if rest := strings.TrimSpace(target[3:]); strings.HasPrefix(rest, "=") {
+			target = strings.TrimSpace(rest[1:])
+		}
+	}
+	if len(target) > 0 && (target[0] == '"' || target[0] == '\'') {
+		quote := target[0]
+		target = target[1:]
+		if end := strings.IndexByte(target, quote); end >= 0 {
+			target = target[:end]
+		}
+	}
+	if target == "" {
+		return delay, true
+	}
+
+	proxiedURL, err := rewriteProxiedURL(target, baseURL, clientReq, blockTrackers)
+	if err != nil || !strings.Contains(proxiedURL, proxyRequestPath+"?url=") {
+		return "", false
+	}
+	return delay + "; url=" + proxiedURL, true
 }
 
+// hasLazyLoadAttribute reports whether an element carries one of the lazyLoadAttributes.
+func hasLazyLoadAttribute(n *html.Node) bool {
+	for _, attr := range n.Attr {
+		if _, isLazy := lazyLoadAttributes[attrLocalName(attr)]; isLazy {
+			return true
+		}
+	}
+	return false
+}
 
-func rewriteCSSURLsInString(cssContent string, baseURL *url.URL, clientReq *http.Request) string {
-	return cssURLRegex.ReplaceAllStringFunc(cssContent, func(match string) string {
-		subMatches := cssURLRegex.FindStringSubmatch(match)
-		var rawURL string
-		if len(subMatches) > 1 {
-			if subMatches[1] != "" {
-				rawURL = subMatches[1]
-			} else if subMatches[2] != "" {
-				rawURL = subMatches[2]
-			} else if subMatches[3] != "" {
-				rawURL = subMatches[3]
-			}
+// unwrapNoscriptElements replaces each <noscript> with its children. The proxied
+// page is rendered with scripting enabled (for the injected script), so the
+// browser would otherwise keep the fallback hidden. Expects a document parsed
+// with scripting disabled, where <noscript> content is markup. A lazy-load <img>
+// directly before a fallback <img> is dropped, since the fallback replaces it.
+func unwrapNoscriptElements(doc *html.Node) {
+	var noscripts []*html.Node
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "noscript" {
+			noscripts = append(noscripts, n)
 		}
-		if rawURL == "" || strings.HasPrefix(strings.ToLower(rawURL), "data:") {
-			return match
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
 		}
+	}
+	collect(doc)
 
-		proxiedURL, err := rewriteProxiedURL(rawURL, baseURL, clientReq)
-		if err == nil && proxiedURL != rawURL {
-			if subMatches[1] != "" {
-				return fmt.Sprintf("url('%s')", proxiedURL)
-			} else if subMatches[2] != "" {
-				return fmt.Sprintf("url(\"%s\")", proxiedURL)
-			} else {
-				return fmt.Sprintf("url('%s')", proxiedURL)
+	for _, noscript := range noscripts {
+		parent := noscript.Parent
+		if parent == nil {
+			continue
+		}
+		if fallbackImg := findFirstElement(noscript, "img"); fallbackImg != nil {
+			prev := noscript.PrevSibling
+			for prev != nil && prev.Type == html.TextNode && strings.TrimSpace(prev.Data) == "" {
+				prev = prev.PrevSibling
+			}
+			if prev != nil && prev.Type == html.ElementNode && prev.Data == "img" && hasLazyLoadAttribute(prev) {
+				parent.RemoveChild(prev)
 			}
 		}
-		return match
+		for c := noscript.FirstChild; c != nil; {
+			next := c.NextSibling
+			noscript.RemoveChild(c)
+			parent.InsertBefore(c, noscript)
+			c = next
+		}
+		parent.RemoveChild(noscript)
+	}
+}
+
+// findFirstElement returns the first element with the given tag name in document order.
+func findFirstElement(n *html.Node, tag string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == tag {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findFirstElement(c, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// injectRuntimeScript inserts the in-page runtime (runtimeScriptPath) as the first
+// child of <head>. The document base is passed along for resolving relative URLs.
+func injectRuntimeScript(doc *html.Node, documentBaseURL *url.URL, scriptNonce string, extraAttrs ...html.Attribute) {
+	headNode := findFirstElement(doc, "head")
+	if headNode == nil {
+		log.Println("Warning: <head> tag not found in HTML document. Cannot inject proxy runtime.")
+		return
+	}
+
+	scriptNode := &html.Node{
+		Type: html.ElementNode,
+		Data: "script",
+		Attr: []html.Attribute{
+			{Key: "nonce", Val: scriptNonce},
+			{Key: "src", Val: runtimeScriptPath},
+			{Key: "data-proxy-base", Val: documentBaseURL.String()},
+		},
+	}
+	scriptNode.Attr = append(scriptNode.Attr, extraAttrs...)
+	headNode.InsertBefore(scriptNode, headNode.FirstChild)
+}
+
+// injectFilterStylesheet links the element hiding stylesheet (filterCSSPath) for
+// the page at the end of <head>. It is computed for the full page URL, as
+// $elemhide, $generichide and $document exceptions may be scoped to a path or
+// scheme.
+func injectFilterStylesheet(doc *html.Node, pageURL *url.URL) {
+	headNode := findFirstElement(doc, "head")
+	if headNode == nil {
+		log.Println("Warning: <head> tag not found in HTML document. Cannot inject filter stylesheet.")
+		return
+	}
+	headNode.AppendChild(&html.Node{
+		Type: html.ElementNode,
+		Data: "link",
+		Attr: []html.Attribute{
+			{Key: "rel", Val: "stylesheet"},
+			{Key: "id", Val: "proxy-filter-styles"},
+			{Key: "href", Val: filterCSSPath + "?url=" + url.QueryEscape(pageURL.String())},
+		},
+	})
+}
+
+// rewriteSrcdocValue runs an iframe srcdoc document through the full rewriting
+// pipeline. A srcdoc document shares its parent's base URL and CSP, so it is
+// rewritten against the parent's base URL and reuses the parent's nonce; it gets
+// none of the proxy UI, which the parent page already shows. A document that
+// cannot be rewritten is dropped rather than left loading from origin.
+func rewriteSrcdocValue(srcdoc string, parent *RewriteContext) string {
+	ctx := &RewriteContext{
+		TargetURL:         parent.BaseURL,
+		ClientReq:         parent.ClientReq,
+		UserID:            parent.UserID,
+		Prefs:             parent.Prefs,
+		ScriptNonce:       parent.ScriptNonce,
+		BlockedCountToken: parent.BlockedCountToken,
+		Srcdoc:            true,
+	}
+	ctx.Prefs.ReaderModeEnabled = false // Reader mode applies to the top-level page only
+	rewrittenReader, err := rewriteHTMLWithContext(strings.NewReader(srcdoc), ctx)
+	if err != nil {
+		log.Printf("HTML Rewrite (Phase 1): Dropping iframe srcdoc on %s: %v", parent.BaseURL.String(), err)
+		return ""
+	}
+	rewrittenSrcdoc, err := io.ReadAll(rewrittenReader)
+	if err != nil {
+		log.Printf("HTML Rewrite (Phase 1): Dropping iframe srcdoc on %s: %v", parent.BaseURL.String(), err)
+		return ""
+	}
+	return string(rewrittenSrcdoc)
+}
+
+func rewriteHTMLContentAdvanced(htmlReader io.Reader, pageBaseURL *url.URL, clientReq *http.Request, userID string, prefs sitePreferences, scriptNonce string, blockedCountToken string) (io.Reader, error) {
+	return rewriteHTMLWithContext(htmlReader, &RewriteContext{
+		TargetURL:         pageBaseURL,
+		ClientReq:         clientReq,
+		UserID:            userID,
+		Prefs:             prefs,
+		ScriptNonce:       scriptNonce,
+		BlockedCountToken: blockedCountToken,
 	})
 }
 
+// rewriteHTMLWithContext parses a document and runs the HTML hooks over it. ctx
+// is complete but for BaseURL, which is taken from the document.
+func rewriteHTMLWithContext(htmlReader io.Reader, ctx *RewriteContext) (io.Reader, error) {
+	// With JavaScript off, parse as a browser with scripting disabled would, so
+	// <noscript> content becomes markup that can be rewritten and unwrapped.
+	doc, err := html.ParseWithOptions(htmlReader, html.ParseOptionEnableScripting(ctx.Prefs.JavaScriptEnabled))
+	if err != nil {
+		return nil, fmt.Errorf("HTML parsing error: %w", err)
+	}
+	if !ctx.Prefs.JavaScriptEnabled {
+		unwrapNoscriptElements(doc)
+	}
+
+	// Relative URLs resolve against the document's <base href> when present.
+	// The <base> element itself is neutralised by attributeRewriter, since every URL we emit is absolute.
+	ctx.BaseURL = resolveDocumentBaseURL(doc, ctx.TargetURL)
+
+	// Element rewriting and injection are done by the Rewriter plugins (see rewriters.go).
+	doc = runHTMLHooks(ctx, doc)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return nil, fmt.Errorf("HTML rendering error after all phases: %w", err)
+	}
+	return &buf, nil
+}
+
+
 // generateCSP creates the Content-Security-Policy for proxied content.
 func generateCSP(prefs sitePreferences, targetURL *url.URL, clientReq *http.Request, scriptNonce string) string {
 	directives := map[string]string{
@@ -1622,6 +3449,10 @@ func generateCSP(prefs sitePreferences, targetURL *url.URL, clientReq *http.Requ
 		"form-action":  "'self'",
 		"manifest-src": "'none'",
 	}
+	if prefs.JavaScriptEnabled {
+		// Manifests are rewritten by handleProxyContent; installable apps only make sense with JS.
+		directives["manifest-src"] = "'self'"
+	}
 
 	scriptSrcElements := []string{}
 
@@ -1635,16 +3466,33 @@ func generateCSP(prefs sitePreferences, targetURL *url.URL, clientReq *http.Requ
 		scriptSrcElements = append(scriptSrcElements, fmt.Sprintf("'nonce-%s'", scriptNonce))
 	}
 	directives["script-src"] = strings.Join(scriptSrcElements, " ")
-	directives["worker-src"] = "'self'"
+	if prefs.JavaScriptEnabled && prefs.WorkersEnabled {
+		// Worker scripts are loaded through the proxy; blob: covers inline workers.
+		directives["worker-src"] = "'self' blob:"
+	} else {
+		directives["worker-src"] = "'none'"
+	}
 
 	styleSrc := []string{"'self'", "'unsafe-inline'", "*"}
 	directives["style-src"] = strings.Join(styleSrc, " ")
 
-	imgSrc := []string{"'self'", "data:", "blob:", "*"}
-	directives["img-src"] = strings.Join(imgSrc, " ")
+	if prefs.ImagesEnabled {
+		imgSrc := []string{"'self'", "data:", "blob:", "*"}
+		directives["img-src"] = strings.Join(imgSrc, " ")
+	} else {
+		// data: keeps the blocked content placeholders (see contentclasses.go).
+		directives["img-src"] = "data:"
+	}
 
-	fontSrc := []string{"'self'", "data:", "*"}
-	directives["font-src"] = strings.Join(fontSrc, " ")
+	if prefs.FontsEnabled {
+		fontSrc := []string{"'self'", "data:", "*"}
+		directives["font-src"] = strings.Join(fontSrc, " ")
+	} else {
+		directives["font-src"] = "'none'"
+	}
+	if !prefs.FormsEnabled {
+		directives["form-action"] = "'none'"
+	}
 
 	connectSrc := []string{"'self'"}
 	directives["connect-src"] = strings.Join(connectSrc, " ")
@@ -1656,8 +3504,12 @@ func generateCSP(prefs sitePreferences, targetURL *url.URL, clientReq *http.Requ
 	}
 	directives["child-src"] = directives["frame-src"]
 
-	mediaSrc := []string{"'self'", "blob:"}
-	directives["media-src"] = strings.Join(mediaSrc, " ")
+	if prefs.MediaEnabled {
+		mediaSrc := []string{"'self'", "blob:"}
+		directives["media-src"] = strings.Join(mediaSrc, " ")
+	} else {
+		directives["media-src"] = "'none'"
+	}
 
 	var cspParts []string
 	for directive, value := range directives {
@@ -1697,14 +3549,24 @@ func handleLandingPage(w http.ResponseWriter, r *http.Request) {
 		"form-action 'self'",
 		"connect-src 'self'",
 		"frame-src 'none'",
+		"frame-ancestors 'none'",
 	}
 	w.Header().Set("Content-Security-Policy", strings.Join(cspHeader, "; "))
-
-	fmt.Fprint(w, makeLandingPageHTML())
+	// Keep proxied pages, which share this origin, from scripting a landing page they open.
+	w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// The settings token (see allowSettingsAPIRequest) is only given to the page
+	// loaded as a document, never to a fetch of it from a proxied page.
+	settingsToken := ""
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest == "" || dest == "document" {
+		settingsToken = pageToken("settings", requestAccountID(r), "")
+	}
+	fmt.Fprint(w, makeLandingPageHTML(settingsToken))
 }
 
 // setupOutgoingHeadersForProxy configures headers for the request to the target server.
-func setupOutgoingHeadersForProxy(proxyToTargetReq *http.Request, clientToProxyReq *http.Request, targetURL *url.URL, prefs sitePreferences) {
+func setupOutgoingHeadersForProxy(proxyToTargetReq *http.Request, clientToProxyReq *http.Request, userID string, targetURL *url.URL, prefs sitePreferences) {
 	targetHost := targetURL.Host
 	// Copy relevant headers from client to proxy request, filtering sensitive ones.
 	for name, values := range clientToProxyReq.Header {
@@ -1726,6 +3588,11 @@ func setupOutgoingHeadersForProxy(proxyToTargetReq *http.Request, clientToProxyR
 			continue
 		}
 
+		// X-Proxy-* headers carry context for the proxy itself (navigation context, request destination).
+		if strings.HasPrefix(lowerName, "x-proxy-") {
+			continue
+		}
+
 		// Filter out Sec- headers, except for Sec-CH-* (Client Hints)
 		if strings.HasPrefix(lowerName, "sec-") {
 			if strings.HasPrefix(lowerName, "sec-ch-") {
@@ -1751,20 +3618,15 @@ func setupOutgoingHeadersForProxy(proxyToTargetReq *http.Request, clientToProxyR
 
 	proxyToTargetReq.Header.Set("Host", targetHost)
 
-	// Handle Cookies based on preferences
+	// Handle Cookies based on preferences. The browser's own cookies belong to the
+	// proxy; the site's come from the user's server-side jar (see cookiejar.go).
 	proxyToTargetReq.Header.Del("Cookie")
 	if prefs.CookiesEnabled {
-		var cookiesToSend []string
-		for _, cookie := range clientToProxyReq.Cookies() {
-			lowerCookieName := strings.ToLower(cookie.Name)
-			if strings.HasPrefix(lowerCookieName, "proxy-") ||
-				strings.HasPrefix(lowerCookieName, "cf_") {
-				continue
-			}
-			cookiesToSend = append(cookiesToSend, cookie.Name+"="+cookie.Value)
-		}
-		if len(cookiesToSend) > 0 {
-			proxyToTargetReq.Header.Set("Cookie", strings.Join(cookiesToSend, "; "))
+		topLevelNavigation := requestIsNavigation(clientToProxyReq) && clientToProxyReq.Header.Get("Sec-Fetch-Dest") == "document" &&
+			(clientToProxyReq.Method == http.MethodGet || clientToProxyReq.Method == http.MethodHead)
+		cookies := matchingCookies(userID, targetURL, requestIsCrossSite(clientToProxyReq, userID, targetURL), topLevelNavigation, true)
+		if len(cookies) > 0 {
+			proxyToTargetReq.Header.Set("Cookie", cookieHeaderValue(cookies))
 		}
 	}
 
@@ -1830,21 +3692,52 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	prefs := sitePreferences{
-		JavaScriptEnabled: getBoolCookie(r, "proxy-js-enabled"),
-		CookiesEnabled:    getBoolCookie(r, "proxy-cookies-enabled"),
-		IframesEnabled:    getBoolCookie(r, "proxy-iframes-enabled"),
-		RawModeEnabled:    getBoolCookie(r, "proxy-raw-mode-enabled"),
+	// Resolved once, so a session ending mid-request cannot move the rest of it
+	// (such as the response's cookies) into the account's persistent stores.
+	userID := requestUserID(r)
+	prefs := resolveSitePreferences(r, userID, targetURL)
+	log.Printf("handleProxyContent: Proxying for %s. Profile:%q, JS:%t, Cookies:%t, Iframes:%t, RawMode:%t, Reader:%t, DataSaver:%t, Placeholders:%t, Images:%t, Media:%t, Fonts:%t, Workers:%t, Forms:%t",
+		targetURL.String(), prefs.Profile, prefs.JavaScriptEnabled, prefs.CookiesEnabled, prefs.IframesEnabled, prefs.RawModeEnabled, prefs.ReaderModeEnabled, prefs.DataSaverEnabled, prefs.ImagePlaceholders,
+		prefs.ImagesEnabled, prefs.MediaEnabled, prefs.FontsEnabled, prefs.WorkersEnabled, prefs.FormsEnabled)
+
+	// Tracker blocking and the request-side policies follow the privacy profile
+	// of the page the request belongs to.
+	pagePrefs := pageSitePreferences(r, userID, prefs)
+	if pagePrefs.BlockTrackers {
+		if cleanedURL, blocked := cleanTrackingURL(targetURL); blocked {
+			log.Printf("URL Cleaner: Blocked request to tracking provider %s", targetURL.String())
+			http.Error(w, "Blocked by URL cleaner: tracking domain", http.StatusForbidden)
+			return
+		} else if cleanedURL.String() != targetURL.String() {
+			// Navigations are redirected so the address bar and the page's base URL
+			// reflect the clean URL; subresources are fetched clean directly.
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && requestDestination(r) == "document" {
+				if cleanProxyURL, errProxy := rewriteProxiedURL(cleanedURL.String(), cleanedURL, r, pagePrefs.BlockTrackers); errProxy == nil {
+					http.Redirect(w, r, cleanProxyURL, http.StatusFound)
+					return
+				}
+			}
+			targetURL = cleanedURL
+		}
+
+		if blockFilteredRequest(w, r, userID, targetURL) {
+			return
+		}
 	}
-	log.Printf("handleProxyContent: Proxying for %s. JS:%t, Cookies:%t, Iframes:%t, RawMode:%t",
-		targetURL.String(), prefs.JavaScriptEnabled, prefs.CookiesEnabled, prefs.IframesEnabled, prefs.RawModeEnabled)
 
 	proxyReq, err := http.NewRequest(r.Method, targetURL.String(), r.Body)
 	if err != nil {
 		http.Error(w, "Error creating target request: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	setupOutgoingHeadersForProxy(proxyReq, r, targetURL, prefs)
+	setupOutgoingHeadersForProxy(proxyReq, r, userID, targetURL, prefs)
+	applyRequestPrivacyPolicies(proxyReq, pagePrefs)
+
+	hookCtx := &RewriteContext{TargetURL: targetURL, ClientReq: r, UserID: userID, Prefs: prefs}
+	if err := runRequestHooks(hookCtx, proxyReq); err != nil {
+		http.Error(w, "Request refused by rewriter: "+err.Error(), http.StatusForbidden)
+		return
+	}
 
 
 	client := &http.Client{
@@ -1862,8 +3755,11 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 	defer targetResp.Body.Close()
 
 	log.Printf("Received response from target %s: Status %s", targetURL.String(), targetResp.Status)
+	runResponseHeaderHooks(hookCtx, targetResp)
 
-	originalSetCookieHeaders := targetResp.Header["Set-Cookie"]
+	// Upstream Set-Cookie headers go to the jar below and never reach the browser;
+	// clear any cookie on the proxy origin that did not come from the proxy.
+	expireForeignBrowserCookies(w, r)
 
 	for name, values := range targetResp.Header {
 		lowerName := strings.ToLower(name)
@@ -1873,13 +3769,14 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 				log.Printf("Cookies disabled: Blocking Set-Cookie headers from %s", targetURL.Host)
 				continue
 			}
+			storeResponseCookies(userID, targetURL, values)
 			continue
 		}
 
 		if lowerName == "location" && (targetResp.StatusCode >= 300 && targetResp.StatusCode <= 308) {
 			if len(values) > 0 {
 				originalLocation := values[0]
-				rewrittenLocation, err := rewriteProxiedURL(originalLocation, targetURL, r)
+				rewrittenLocation, err := rewriteProxiedURL(originalLocation, targetURL, r, pagePrefs.BlockTrackers)
 				if err == nil && rewrittenLocation != originalLocation {
 					w.Header().Set(name, rewrittenLocation)
 				} else {
@@ -1889,6 +3786,43 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 			}
 			continue
 		}
+		if lowerName == "refresh" {
+			for _, value := range values {
+				if rewrittenRefresh, ok := rewriteRefreshValue(value, targetURL, r, pagePrefs.BlockTrackers); ok {
+					w.Header().Add(name, rewrittenRefresh)
+				} else {
+					log.Printf("Dropping Refresh header with unproxyable target '%s' from %s", value, targetURL.Host)
+				}
+			}
+			continue
+		}
+		if lowerName == "link" {
+			for _, value := range values {
+				if rewrittenLink, ok := rewriteLinkHeaderValue(value, targetURL, r, prefs, pagePrefs.BlockTrackers); ok {
+					w.Header().Add(name, rewrittenLink)
+				}
+			}
+			continue
+		}
+		if lowerName == "content-location" {
+			if len(values) > 0 {
+				if proxiedURL, errProxy := rewriteProxiedURL(values[0], targetURL, r, pagePrefs.BlockTrackers); errProxy == nil {
+					w.Header().Set(name, proxiedURL)
+				}
+			}
+			continue
+		}
+		if lowerName == "speculation-rules" {
+			if !prefs.JavaScriptEnabled {
+				continue
+			}
+			for _, value := range values {
+				if rewrittenRules, ok := rewriteSpeculationRulesHeader(value, targetURL, r, pagePrefs.BlockTrackers); ok {
+					w.Header().Add(name, rewrittenRules)
+				}
+			}
+			continue
+		}
 		if lowerName == "content-security-policy" ||
 			lowerName == "content-security-policy-report-only" ||
 			lowerName == "x-frame-options" ||
@@ -1907,11 +3841,6 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(name, value)
 		}
 	}
-	if prefs.CookiesEnabled {
-		for _, cookieHeader := range originalSetCookieHeaders {
-			w.Header().Add("Set-Cookie", cookieHeader)
-		}
-	}
 
 	if targetResp.StatusCode == http.StatusNotModified {
 		w.WriteHeader(http.StatusNotModified)
@@ -1935,6 +3864,16 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 	contentType := targetResp.Header.Get("Content-Type")
 	isHTML := strings.HasPrefix(contentType, "text/html")
 	isCSS := strings.HasPrefix(contentType, "text/css")
+	isSVG := strings.HasPrefix(contentType, "image/svg+xml")
+	isJS := isJavaScriptMIMEType(contentType)
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	isManifest := mediaType == "application/manifest+json" ||
+		(requestDestination(r) == "manifest" && strings.HasSuffix(mediaType, "json"))
+	isSpeculationRules := mediaType == "application/speculationrules+json"
+
+	if isHTML && requestIsNavigation(r) && r.Header.Get("Sec-Fetch-Dest") == "document" {
+		setCurrentURLCookie(w, r, userID, targetURL)
+	}
 
 	if isHTML && prefs.RawModeEnabled {
 		log.Printf("Raw Mode enabled for %s. Serving original HTML.", targetURL.String())
@@ -1947,7 +3886,8 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 	isSuccess := targetResp.StatusCode >= 200 && targetResp.StatusCode < 300
 	if isSuccess {
 		if isHTML {
-			rewrittenHTMLReader, errRewrite := rewriteHTMLContentAdvanced(bytes.NewReader(bodyBytes), targetURL, r, prefs, scriptNonce)
+			blockedCountToken := registerBlockedCountPage(targetURL, userID)
+			rewrittenHTMLReader, errRewrite := rewriteHTMLContentAdvanced(bytes.NewReader(bodyBytes), targetURL, r, userID, prefs, scriptNonce, blockedCountToken)
 			if errRewrite != nil {
 				log.Printf("Error rewriting HTML for %s: %v. Serving original body.", targetURL.String(), errRewrite)
 				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
@@ -1959,11 +3899,68 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 			io.Copy(w, rewrittenHTMLReader)
 			return
 		} else if isCSS {
-			rewrittenCSS := rewriteCSSURLsInString(string(bodyBytes), targetURL, r)
+			rewrittenCSS := rewriteCSSURLsInString(string(bodyBytes), targetURL, r, pagePrefs.BlockTrackers)
 			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(rewrittenCSS)))
 			w.WriteHeader(targetResp.StatusCode)
 			io.WriteString(w, rewrittenCSS)
 			return
+		} else if isJS && prefs.JavaScriptEnabled && !prefs.RawModeEnabled {
+			rewrittenJS := rewriteJSModuleCached(bodyBytes, targetURL, r, userID, pagePrefs.BlockTrackers)
+			if jsRewriteEnabled {
+				rewrittenJS = rewriteJavaScriptCached(rewrittenJS, cacheSite(r, userID, targetURL))
+			}
+			if destination := requestDestination(r); destination == "worker" || destination == "sharedworker" {
+				rewrittenJS = append([]byte(makeWorkerPreludeJS(targetURL)), rewrittenJS...)
+			}
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(rewrittenJS)))
+			w.WriteHeader(targetResp.StatusCode)
+			w.Write(rewrittenJS)
+			return
+		} else if (isManifest || isSpeculationRules) && !prefs.RawModeEnabled {
+			var rewrittenJSON []byte
+			var errRewrite error
+			if isManifest {
+				rewrittenJSON, errRewrite = rewriteWebManifest(bodyBytes, targetURL, r, pagePrefs.BlockTrackers)
+			} else if prefs.JavaScriptEnabled {
+				rewrittenJSON, errRewrite = rewriteSpeculationRules(bodyBytes, targetURL, r, pagePrefs.BlockTrackers)
+			} else {
+				rewrittenJSON = []byte("{}")
+			}
+			if errRewrite != nil {
+				log.Printf("Error rewriting JSON document for %s: %v. Serving original body.", targetURL.String(), errRewrite)
+			} else {
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(rewrittenJSON)))
+				w.WriteHeader(targetResp.StatusCode)
+				w.Write(rewrittenJSON)
+				return
+			}
+		} else if prefs.DataSaverEnabled && !prefs.RawModeEnabled && isTranscodableImage(mediaType) {
+			transcoded, transcodedType, errTranscode := transcodeImageCached(bodyBytes, cacheSite(r, userID, targetURL))
+			if errTranscode != nil {
+				log.Printf("Data Saver: Error transcoding %s: %v. Serving original body.", targetURL.String(), errTranscode)
+			} else if len(transcoded) >= len(bodyBytes) {
+				log.Printf("Data Saver: Transcoding %s would not save space (%d to %d bytes). Serving original body.", targetURL.String(), len(bodyBytes), len(transcoded))
+			} else {
+				log.Printf("Data Saver: %s transcoded from %d to %d bytes", targetURL.String(), len(bodyBytes), len(transcoded))
+				w.Header().Set("Content-Type", transcodedType)
+				w.Header().Del("ETag")
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(transcoded)))
+				w.WriteHeader(targetResp.StatusCode)
+				w.Write(transcoded)
+				return
+			}
+		} else if isSVG && !prefs.RawModeEnabled {
+			rewrittenSVG, errRewrite := rewriteSVGDocument(bodyBytes, targetURL, r, prefs)
+			if errRewrite != nil {
+				// The original would load its references straight from their origins.
+				log.Printf("Error rewriting SVG for %s: %v. Refusing to serve it.", targetURL.String(), errRewrite)
+				http.Error(w, "SVG document could not be rewritten", http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(rewrittenSVG)))
+			w.WriteHeader(targetResp.StatusCode)
+			w.Write(rewrittenSVG)
+			return
 		}
 	}
 
@@ -1972,6 +3969,16 @@ func handleProxyContent(w http.ResponseWriter, r *http.Request) {
 	w.Write(bodyBytes)
 }
 
+// requestDestination returns the fetch destination of a client request ("script",
+// "worker", ...). Requests re-issued by the service worker carry the original
+// destination in X-Proxy-Request-Destination, since their own Sec-Fetch-Dest is "empty".
+func requestDestination(r *http.Request) string {
+	if destination := r.Header.Get("X-Proxy-Request-Destination"); destination != "" {
+		return strings.ToLower(destination)
+	}
+	return strings.ToLower(r.Header.Get("Sec-Fetch-Dest"))
+}
+
 // handleAuthCheck checks authentication and handles unauthorized responses.
 // Returns true if the request should proceed, false if a response has already been sent.
 func handleAuthCheck(w http.ResponseWriter, r *http.Request) bool {
@@ -2014,36 +4021,103 @@ func handleAuthCheck(w http.ResponseWriter, r *http.Request) bool {
 	return true // Auth valid, proceed
 }
 
+// targetURLFromProxyPageURL extracts the target URL embedded in the 'url' query
+// parameter of a proxied page URL on this proxy host.
+func targetURLFromProxyPageURL(rawProxyURL string, proxyHost string) (*url.URL, bool) {
+	pageURL, err := url.Parse(rawProxyURL)
+	if err != nil || pageURL.Host != proxyHost || pageURL.Path != proxyRequestPath {
+		return nil, false
+	}
+	targetURL, err := url.Parse(pageURL.Query().Get("url"))
+	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+		return nil, false
+	}
+	return targetURL, true
+}
+
+// currentURLCookieName holds the last page navigated to in any tab, the last
+// resort of resolveNavigationBase.
+const currentURLCookieName = "proxy-current-url"
+
+// setCurrentURLCookie records targetURL as the page last navigated to. The value
+// is signed for userID, so only a cookie the proxy set itself is ever used.
+func setCurrentURLCookie(w http.ResponseWriter, r *http.Request, userID string, targetURL *url.URL) {
+	encodedURL := hex.EncodeToString([]byte(targetURL.String()))
+	http.SetCookie(w, &http.Cookie{
+		Name:     currentURLCookieName,
+		Value:    encodedURL + "." + pageToken(currentURLCookieName, userID, encodedURL),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// currentURLFromCookie returns the page recorded by setCurrentURLCookie, if the
+// request carries a cookie the proxy signed for the request's user.
+func currentURLFromCookie(r *http.Request) (*url.URL, bool) {
+	cookie, err := r.Cookie(currentURLCookieName)
+	if err != nil {
+		return nil, false
+	}
+	encodedURL, token, found := strings.Cut(cookie.Value, ".")
+	if !found || !validPageToken(token, currentURLCookieName, requestUserID(r), encodedURL) {
+		log.Printf("Rebasing: Ignoring %s cookie not signed by the proxy", currentURLCookieName)
+		return nil, false
+	}
+	rawURL, err := hex.DecodeString(encodedURL)
+	if err != nil {
+		return nil, false
+	}
+	targetURL, err := url.Parse(string(rawURL))
+	if err != nil || !targetURL.IsAbs() {
+		return nil, false
+	}
+	return targetURL, true
+}
+
+// resolveNavigationBase determines which target page issued a request, preferring
+// per-request context over the proxy-current-url cookie, which different tabs
+// overwrite. The cookie is only used when the proxy itself signed it (see
+// setCurrentURLCookie), as a page running in raw mode can set cookies on the
+// proxy origin. The second return value names the source used, for logging.
+func resolveNavigationBase(r *http.Request) (*url.URL, string) {
+	if clientURL := r.Header.Get(clientURLHeader); clientURL != "" {
+		if targetURL, ok := targetURLFromProxyPageURL(clientURL, r.Host); ok {
+			return targetURL, "service worker client URL"
+		}
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		if targetURL, ok := targetURLFromProxyPageURL(referer, r.Host); ok {
+			return targetURL, "Referer"
+		}
+	}
+	if targetURL, ok := currentURLFromCookie(r); ok {
+		// Last resort: the page last navigated to, in whichever tab.
+		return targetURL, "proxy-current-url cookie"
+	}
+	return nil, ""
+}
+
 // handleRebasingRedirects attempts to rebase malformed or unhandled proxy-like requests
-// using the "proxy-current-url" cookie.
+// onto the target page that issued them (see resolveNavigationBase).
 // Returns true if a redirect was issued, false otherwise.
 func handleRebasingRedirects(w http.ResponseWriter, r *http.Request) bool {
 	isMalformedProxyReq := (r.URL.Path == proxyRequestPath && r.URL.Query().Get("url") == "" && r.URL.RawQuery != "")
-	isServiceInfrastructurePath := r.URL.Path == "/" || r.URL.Path == proxyRequestPath || r.URL.Path == serviceWorkerPath || strings.HasPrefix(r.URL.Path, "/auth/")
+	isServiceInfrastructurePath := r.URL.Path == "/" || r.URL.Path == proxyRequestPath || r.URL.Path == serviceWorkerPath || r.URL.Path == runtimeScriptPath || r.URL.Path == filterCSSPath || r.URL.Path == blockedCountPath || r.URL.Path == userContentPath || r.URL.Path == sitePrefsPath || r.URL.Path == cookieJarPath || r.URL.Path == siteDataPath || r.URL.Path == incognitoPath || strings.HasPrefix(r.URL.Path, "/auth/")
 	isUnsupportedPath := !isServiceInfrastructurePath
 
 	if !isMalformedProxyReq && !isUnsupportedPath {
 		return false // Not a candidate for rebasing
 	}
 
-	currentURLCookie, errCookie := r.Cookie("proxy-current-url")
-	if errCookie != nil || currentURLCookie.Value == "" {
-		if isUnsupportedPath || isMalformedProxyReq {
-			log.Printf("Rebasing: proxy-current-url cookie not found or empty. Cannot rebase %s", r.URL.String())
-		}
+	baseTargetURL, contextSource := resolveNavigationBase(r)
+	if baseTargetURL == nil {
+		log.Printf("Rebasing: No navigation context (client URL header, Referer or proxy-current-url cookie). Cannot rebase %s", r.URL.String())
 		return false
 	}
 
-	log.Printf("Rebasing: Attempting rebase for %s using proxy-current-url cookie (value assumed to be unencoded target URL): %s", r.URL.String(), currentURLCookie.Value)
-
-	// Assume cookie value is the direct unencoded target URL
-	baseTargetString := currentURLCookie.Value
-
-	baseTargetURL, errParseBaseTarget := url.Parse(baseTargetString)
-	if errParseBaseTarget != nil || !baseTargetURL.IsAbs() {
-		log.Printf("Rebasing Error: Could not parse baseTargetURL from cookie ('%s') or not absolute: %v", baseTargetString, errParseBaseTarget)
-		return false
-	}
+	log.Printf("Rebasing: Attempting rebase for %s using %s: %s", r.URL.String(), contextSource, baseTargetURL.String())
 
 	var rebasedTargetURL *url.URL
 	if isUnsupportedPath { // e.g. /some/other/path.css?p=1
@@ -2077,6 +4151,9 @@ func masterHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleAuthCheck(w, r) {
 		return
 	}
+	if !enforceIncognitoSession(w, r) {
+		return
+	}
 
 	// Attempt rebasing for malformed or unhandled proxy-like requests.
 	// If a redirect is issued, handleRebasingRedirects returns true and we should stop further processing.
@@ -2092,6 +4169,22 @@ func masterHandler(w http.ResponseWriter, r *http.Request) {
 		handleProxyContent(w, r)
 	case serviceWorkerPath:
 		serveServiceWorkerJS(w, r)
+	case runtimeScriptPath:
+		serveRuntimeJS(w, r)
+	case filterCSSPath:
+		serveFilterStylesheet(w, r)
+	case blockedCountPath:
+		serveBlockedCount(w, r)
+	case userContentPath:
+		serveUserContentAPI(w, r)
+	case sitePrefsPath:
+		serveSitePreferencesAPI(w, r)
+	case cookieJarPath:
+		handleScriptCookie(w, r)
+	case siteDataPath:
+		serveSiteDataAPI(w, r)
+	case incognitoPath:
+		serveIncognitoAPI(w, r)
 	default:
 		http.NotFound(w, r)
 	}
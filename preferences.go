@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// --- Per-Site Preferences ---
+//
+// Preferences are stored server-side per user, as records of flags set at three
+// levels: "default", a registrable domain ("example.co.uk") and an exact host
+// ("www.example.co.uk"). A request resolves the built-in defaults, then each
+// level from least to most specific; flags a level does not set are inherited.
+// A level that selects a privacy profile (see profiles.go) starts over from that
+// profile before applying its own flags.
+
+const (
+	sitePreferencesStateFile = "preferences.json"
+	defaultPreferenceKey     = "default"
+)
+
+// sitePreferenceFlag describes one sitePreferences flag as it appears in stored
+// records and API bodies ({"js": false, "reader": true}) and in the toolbar.
+type sitePreferenceFlag struct {
+	Key   string // Key in preference records
+	Label string // Toolbar label
+	Field func(*sitePreferences) *bool
+}
+
+// sitePreferenceFlags lists the flags in toolbar order. Raw mode has no toolbar
+// toggle, since a raw page carries no toolbar to switch it back off; the toolbar
+// offers a one-off "View original" link instead.
+var sitePreferenceFlags = []sitePreferenceFlag{
+	{"js", "JavaScript", func(p *sitePreferences) *bool { return &p.JavaScriptEnabled }},
+	{"cookies", "Cookies", func(p *sitePreferences) *bool { return &p.CookiesEnabled }},
+	{"iframes", "Iframes", func(p *sitePreferences) *bool { return &p.IframesEnabled }},
+	{"images", "Images", func(p *sitePreferences) *bool { return &p.ImagesEnabled }},
+	{"media", "Media", func(p *sitePreferences) *bool { return &p.MediaEnabled }},
+	{"fonts", "Fonts", func(p *sitePreferences) *bool { return &p.FontsEnabled }},
+	{"workers", "Workers", func(p *sitePreferences) *bool { return &p.WorkersEnabled }},
+	{"forms", "Forms", func(p *sitePreferences) *bool { return &p.FormsEnabled }},
+	{"reader", "Reader", func(p *sitePreferences) *bool { return &p.ReaderModeEnabled }},
+	{"datasaver", "Data Saver", func(p *sitePreferences) *bool { return &p.DataSaverEnabled }},
+	{"placeholders", "Placeholders", func(p *sitePreferences) *bool { return &p.ImagePlaceholders }},
+	{"raw", "", func(p *sitePreferences) *bool { return &p.RawModeEnabled }},
+}
+
+// sitePreferenceRecord holds the profile and flags set at one level. In JSON it is
+// a single object: {"profile": "strict", "js": true}.
+type sitePreferenceRecord struct {
+	Profile string          // Privacy profile name; "" inherits
+	Flags   map[string]bool // Keyed by sitePreferenceFlag.Key
+}
+
+func (record sitePreferenceRecord) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(record.Flags)+1)
+	for flagKey, value := range record.Flags {
+		fields[flagKey] = value
+	}
+	if record.Profile != "" {
+		fields["profile"] = record.Profile
+	}
+	return json.Marshal(fields)
+}
+
+func (record *sitePreferenceRecord) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*record = sitePreferenceRecord{Flags: make(map[string]bool, len(fields))}
+	for key, raw := range fields {
+		if key == "profile" {
+			if err := json.Unmarshal(raw, &record.Profile); err != nil {
+				return fmt.Errorf("profile: %w", err)
+			}
+			continue
+		}
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		record.Flags[key] = value
+	}
+	return nil
+}
+
+func (record sitePreferenceRecord) isEmpty() bool {
+	return record.Profile == "" && len(record.Flags) == 0
+}
+
+// preferenceHostKeyPattern matches the host and domain keys of preference records.
+var preferenceHostKeyPattern = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+var (
+	sitePrefsMu     sync.RWMutex
+	sitePrefsByUser = make(map[string]map[string]sitePreferenceRecord) // User -> key -> record; persisted to sitePreferencesStateFile
+)
+
+// builtinSitePreferences are the preferences before any stored record applies:
+// the DEFAULT_PRIVACY_PROFILE, or else the defaultGlobal* settings.
+func builtinSitePreferences() sitePreferences {
+	if profile, ok := privacyProfiles[defaultPrivacyProfile]; ok {
+		return profile.preferences()
+	}
+	return sitePreferences{
+		JavaScriptEnabled: defaultGlobalJSEnabled,
+		CookiesEnabled:    defaultGlobalCookiesEnabled,
+		IframesEnabled:    defaultGlobalIframesEnabled,
+		RawModeEnabled:    defaultGlobalRawModeEnabled,
+		ImagesEnabled:     true,
+		MediaEnabled:      true,
+		FontsEnabled:      true,
+		WorkersEnabled:    true,
+		FormsEnabled:      true,
+		BlockTrackers:     true,
+	}
+}
+
+// apply applies record on prefs: its profile, if any and still defined, then the
+// flags present in it.
+func (record sitePreferenceRecord) apply(prefs *sitePreferences) {
+	if profile, ok := privacyProfiles[record.Profile]; ok {
+		*prefs = profile.preferences()
+	}
+	for _, flag := range sitePreferenceFlags {
+		if value, ok := record.Flags[flag.Key]; ok {
+			*flag.Field(prefs) = value
+		}
+	}
+}
+
+// toRecord returns the profile and every flag of prefs as a record.
+func (prefs sitePreferences) toRecord() sitePreferenceRecord {
+	record := sitePreferenceRecord{Profile: prefs.Profile, Flags: make(map[string]bool, len(sitePreferenceFlags))}
+	for _, flag := range sitePreferenceFlags {
+		record.Flags[flag.Key] = *flag.Field(&prefs)
+	}
+	return record
+}
+
+// preferenceChain returns the record keys applying to host, least specific first.
+func preferenceChain(host string) []string {
+	host = strings.ToLower(host)
+	if host == defaultPreferenceKey {
+		return []string{defaultPreferenceKey}
+	}
+	chain := []string{defaultPreferenceKey}
+	if domain := siteOfHost(host); domain != host {
+		chain = append(chain, domain)
+	}
+	return append(chain, host)
+}
+
+// effectiveSitePreferences resolves a user's preferences for host, along with the
+// record key that decided the profile and each flag ("built-in" when no record
+// sets it).
+func effectiveSitePreferences(userID string, host string) (sitePreferences, map[string]string) {
+	prefs := builtinSitePreferences()
+	sources := make(map[string]string, len(sitePreferenceFlags)+1)
+	sources["profile"] = "built-in"
+	for _, flag := range sitePreferenceFlags {
+		sources[flag.Key] = "built-in"
+	}
+
+	sitePrefsMu.RLock()
+	defer sitePrefsMu.RUnlock()
+	records := sitePrefsByUser[userID]
+	for _, key := range preferenceChain(host) {
+		record := records[key]
+		record.apply(&prefs)
+		if _, ok := privacyProfiles[record.Profile]; ok {
+			for sourceKey := range sources {
+				sources[sourceKey] = key
+			}
+		}
+		for flagKey := range record.Flags {
+			sources[flagKey] = key
+		}
+	}
+	return prefs, sources
+}
+
+// proxyQueryFlag reads a boolean flag from the proxy URL's own query ("reader=1",
+// "raw=0"). ok is false when the flag is absent or not a recognised value.
+func proxyQueryFlag(r *http.Request, name string) (value bool, ok bool) {
+	switch strings.ToLower(r.URL.Query().Get(name)) {
+	case "1", "true", "on":
+		return true, true
+	case "0", "false", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// resolveSitePreferences computes the preferences for a request to targetURL: the
+// user's stored records for the target host, then the one-off "reader" and "raw"
+// query flags.
+func resolveSitePreferences(r *http.Request, userID string, targetURL *url.URL) sitePreferences {
+	prefs, _ := effectiveSitePreferences(userID, targetURL.Hostname())
+	if value, ok := proxyQueryFlag(r, "reader"); ok {
+		prefs.ReaderModeEnabled = value
+	}
+	if value, ok := proxyQueryFlag(r, "raw"); ok {
+		prefs.RawModeEnabled = value
+	}
+	return prefs
+}
+
+// sitePreferenceToken authorises the toolbar on a proxied page to change the
+// record of that page's host (and no other) for userID.
+func sitePreferenceToken(userID string, host string) string {
+	return pageToken("prefs", userID, host)
+}
+
+// loadSitePreferencesState restores the stored records from the data directory.
+func loadSitePreferencesState() {
+	sitePrefsMu.Lock()
+	defer sitePrefsMu.Unlock()
+	if err := loadStateFile(sitePreferencesStateFile, &sitePrefsByUser); err != nil {
+		log.Printf("Error loading site preferences: %v", err)
+	}
+}
+
+// saveSitePreferencesStateLocked persists the stored records. sitePrefsMu must be held.
+func saveSitePreferencesStateLocked() {
+	if err := saveStateFile(sitePreferencesStateFile, persistentUsers(sitePrefsByUser)); err != nil {
+		log.Printf("Error saving site preferences: %v", err)
+	}
+}
+
+// sitePreferencesResponse is the body of GET /proxy-prefs.
+type sitePreferencesResponse struct {
+	Profiles  []privacyProfile                `json:"profiles"`
+	Builtin   sitePreferenceRecord            `json:"builtin"`
+	Records   map[string]sitePreferenceRecord `json:"records"`
+	Effective map[string]sitePreferenceRecord `json:"effective"` // For "default" and each requested host
+	Sources   map[string]map[string]string    `json:"sources"`   // Record key deciding the effective profile and each flag
+}
+
+// serveSitePreferencesAPI reads and updates the current user's preference records.
+// The "host" parameter is a record key: "default", a domain or a host.
+//
+//	GET    [?host=<host>...]    profiles, stored records, and effective preferences per host
+//	PUT    ?host=<key>          replace a record with the JSON body ({"profile": "strict", "js": true, ...})
+//	PATCH  ?host=<key>          merge the JSON body into a record; null unsets the profile or a flag
+//	DELETE ?host=<key>          delete a record
+//
+// The landing page may use every method. The toolbar on a proxied page may PATCH
+// and DELETE its own host's record, authorised by the token from sitePreferenceToken,
+// and change only the profile and the flags it has a toggle for.
+func serveSitePreferencesAPI(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+	query := r.URL.Query()
+	key := strings.ToLower(strings.TrimSpace(query.Get("host")))
+
+	token := query.Get("token")
+	fromToolbar := token != ""
+	if fromToolbar {
+		validToken := validPageToken(token, "prefs", userID, key)
+		if !validToken || key == defaultPreferenceKey || (r.Method != http.MethodPatch && r.Method != http.MethodDelete) {
+			log.Printf("Site Preferences: Refused toolbar %s for host %q", r.Method, key)
+			http.Error(w, "Forbidden: invalid preference token", http.StatusForbidden)
+			return
+		}
+	} else if !allowSettingsAPIRequest(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		sitePrefsMu.RLock()
+		records := make(map[string]sitePreferenceRecord, len(sitePrefsByUser[userID]))
+		for recordKey, record := range sitePrefsByUser[userID] {
+			records[recordKey] = record
+		}
+		sitePrefsMu.RUnlock()
+
+		response := sitePreferencesResponse{
+			Profiles:  make([]privacyProfile, 0, len(privacyProfileOrder)),
+			Builtin:   builtinSitePreferences().toRecord(),
+			Records:   records,
+			Effective: make(map[string]sitePreferenceRecord),
+			Sources:   make(map[string]map[string]string),
+		}
+		for _, name := range privacyProfileOrder {
+			response.Profiles = append(response.Profiles, privacyProfiles[name])
+		}
+		for _, host := range append([]string{defaultPreferenceKey}, query["host"]...) {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host == "" {
+				continue
+			}
+			prefs, sources := effectiveSitePreferences(userID, host)
+			response.Effective[host] = prefs.toRecord()
+			response.Sources[host] = sources
+		}
+		writeJSONResponse(w, http.StatusOK, response)
+		return
+	}
+
+	if key != defaultPreferenceKey && !preferenceHostKeyPattern.MatchString(key) {
+		http.Error(w, "Invalid or missing 'host' parameter", http.StatusBadRequest)
+		return
+	}
+	var changes map[string]json.RawMessage
+	if r.Method == http.MethodPut || r.Method == http.MethodPatch {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 4096)
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for changeKey, value := range changes {
+			if string(value) == "null" {
+				continue
+			}
+			var err error
+			if changeKey == "profile" {
+				var name string
+				if err = json.Unmarshal(value, &name); err == nil {
+					if _, ok := privacyProfiles[name]; !ok {
+						err = fmt.Errorf("unknown profile %q", name)
+					}
+				}
+			} else if isSitePreferenceFlagKey(changeKey) {
+				if fromToolbar && !sitePreferenceFlagHasToggle(changeKey) {
+					log.Printf("Site Preferences: Refused toolbar change of %q for host %q", changeKey, key)
+					http.Error(w, "Forbidden: the toolbar cannot change "+changeKey, http.StatusForbidden)
+					return
+				}
+				err = json.Unmarshal(value, new(bool))
+			} else {
+				err = fmt.Errorf("unknown preference %q", changeKey)
+			}
+			if err != nil {
+				http.Error(w, "Invalid preferences: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	sitePrefsMu.Lock()
+	defer sitePrefsMu.Unlock()
+	records := sitePrefsByUser[userID]
+	if records == nil {
+		records = make(map[string]sitePreferenceRecord)
+		sitePrefsByUser[userID] = records
+	}
+	record := sitePreferenceRecord{Flags: make(map[string]bool)}
+	switch r.Method {
+	case http.MethodPut:
+	case http.MethodPatch:
+		record.Profile = records[key].Profile
+		for flagKey, value := range records[key].Flags {
+			record.Flags[flagKey] = value
+		}
+	case http.MethodDelete:
+		changes = nil
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for changeKey, value := range changes {
+		switch {
+		case changeKey == "profile":
+			record.Profile = ""
+			json.Unmarshal(value, &record.Profile) // null leaves it unset
+		case string(value) == "null":
+			delete(record.Flags, changeKey)
+		default:
+			var flagValue bool
+			json.Unmarshal(value, &flagValue)
+			record.Flags[changeKey] = flagValue
+		}
+	}
+	if record.isEmpty() {
+		delete(records, key)
+	} else {
+		records[key] = record
+	}
+	if len(records) == 0 {
+		delete(sitePrefsByUser, userID)
+	}
+	saveSitePreferencesStateLocked()
+	log.Printf("Site Preferences: %s %s for %s: profile %q, %v", r.Method, key, userID, record.Profile, record.Flags)
+	writeJSONResponse(w, http.StatusOK, record)
+}
+
+// forgetSitePreferences deletes userID's records for site and returns how many
+// were deleted.
+func forgetSitePreferences(userID string, site string) int {
+	sitePrefsMu.Lock()
+	defer sitePrefsMu.Unlock()
+	records := sitePrefsByUser[userID]
+	removed := 0
+	for key := range records {
+		if key != defaultPreferenceKey && siteOfHost(key) == site {
+			delete(records, key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	if len(records) == 0 {
+		delete(sitePrefsByUser, userID)
+	}
+	saveSitePreferencesStateLocked()
+	return removed
+}
+
+func isSitePreferenceFlagKey(key string) bool {
+	for _, flag := range sitePreferenceFlags {
+		if flag.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sitePreferenceFlagHasToggle reports whether the toolbar shows a toggle for the
+// flag key, and so may change it.
+func sitePreferenceFlagHasToggle(key string) bool {
+	for _, flag := range sitePreferenceFlags {
+		if flag.Key == key {
+			return flag.Label != ""
+		}
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// --- Privacy Profiles ---
+
+// privacyProfile bundles site preferences with the request-side privacy policies.
+// Selecting a profile for "default", a domain or a host (see preferences.go)
+// replaces everything inherited from less specific levels.
+type privacyProfile struct {
+	Name           string          `json:"name"`
+	Label          string          `json:"label"`
+	Description    string          `json:"description"`
+	Preferences    map[string]bool `json:"preferences"`    // sitePreferences flags by key; unset flags are off
+	ReferrerPolicy string          `json:"referrerPolicy"` // Referrer-Policy token applied to forwarded Referers; "" forwards them unchanged
+	StripHeaders   []string        `json:"stripHeaders"`   // Request headers not forwarded upstream; "sec-ch-*" matches a prefix
+	BlockTrackers  bool            `json:"blockTrackers"`  // Apply the filter lists and the URL cleaner
+	ImagePolicy    string          `json:"imagePolicy"`    // "load", "shrink" (data saver), "click-to-load" or "block"; decides the "images" flag
+}
+
+// defaultPrivacyProfiles are the built-in profiles. Operators can override them or
+// add their own with PRIVACY_PROFILES_FILE.
+var defaultPrivacyProfiles = []privacyProfile{
+	{
+		Name:           "strict",
+		Label:          "Strict",
+		Description:    "No scripts, cookies, frames, media or web fonts. No referrers, no client hints, trackers blocked, images on click.",
+		Preferences:    map[string]bool{"forms": true},
+		ReferrerPolicy: "no-referrer",
+		StripHeaders:   []string{"accept-language", "sec-ch-*", "x-requested-with"},
+		BlockTrackers:  true,
+		ImagePolicy:    "click-to-load",
+	},
+	{
+		Name:           "balanced",
+		Label:          "Balanced",
+		Description:    "Scripts and cookies allowed, frames blocked. Cross-site referrers trimmed to the origin, trackers blocked.",
+		Preferences:    map[string]bool{"js": true, "cookies": true, "media": true, "fonts": true, "workers": true, "forms": true},
+		ReferrerPolicy: "strict-origin-when-cross-origin",
+		StripHeaders:   []string{"sec-ch-ua-arch", "sec-ch-ua-bitness", "sec-ch-ua-full-version-list", "sec-ch-ua-model", "sec-ch-ua-platform-version"},
+		BlockTrackers:  true,
+		ImagePolicy:    "load",
+	},
+	{
+		Name:          "compatible",
+		Label:         "Compatible",
+		Description:   "Everything allowed and forwarded as the browser sent it. For sites that break otherwise.",
+		Preferences:   map[string]bool{"js": true, "cookies": true, "iframes": true, "media": true, "fonts": true, "workers": true, "forms": true},
+		BlockTrackers: false,
+		ImagePolicy:   "load",
+	},
+}
+
+// referrerPolicies are the Referrer-Policy tokens a profile may use.
+var referrerPolicies = map[string]bool{
+	"":                                true,
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+var (
+	// privacyProfiles holds the available profiles by name, listed in privacyProfileOrder.
+	privacyProfiles     = make(map[string]privacyProfile)
+	privacyProfileOrder []string
+	// The profile applied before any stored record (DEFAULT_PRIVACY_PROFILE). When
+	// empty, builtinSitePreferences uses the defaultGlobal* settings.
+	defaultPrivacyProfile string
+)
+
+func init() {
+	for _, profile := range defaultPrivacyProfiles {
+		addPrivacyProfile(profile)
+	}
+}
+
+// validatePrivacyProfile normalises a profile definition.
+func validatePrivacyProfile(profile *privacyProfile) error {
+	profile.Name = strings.ToLower(strings.TrimSpace(profile.Name))
+	if profile.Name == "" || !preferenceHostKeyPattern.MatchString(profile.Name) {
+		return fmt.Errorf("invalid profile name %q", profile.Name)
+	}
+	if profile.Label == "" {
+		profile.Label = profile.Name
+	}
+	for flagKey := range profile.Preferences {
+		if !isSitePreferenceFlagKey(flagKey) {
+			return fmt.Errorf("unknown preference %q", flagKey)
+		}
+	}
+	profile.ReferrerPolicy = strings.ToLower(strings.TrimSpace(profile.ReferrerPolicy))
+	if !referrerPolicies[profile.ReferrerPolicy] {
+		return fmt.Errorf("unknown referrer policy %q", profile.ReferrerPolicy)
+	}
+	for i, header := range profile.StripHeaders {
+		profile.StripHeaders[i] = strings.ToLower(strings.TrimSpace(header))
+	}
+	switch profile.ImagePolicy {
+	case "":
+		profile.ImagePolicy = "load"
+	case "load", "shrink", "click-to-load", "block":
+	default:
+		return fmt.Errorf("unknown image policy %q", profile.ImagePolicy)
+	}
+	return nil
+}
+
+// addPrivacyProfile adds a profile, replacing any profile of the same name.
+func addPrivacyProfile(profile privacyProfile) {
+	if _, exists := privacyProfiles[profile.Name]; !exists {
+		privacyProfileOrder = append(privacyProfileOrder, profile.Name)
+	}
+	privacyProfiles[profile.Name] = profile
+}
+
+// loadPrivacyProfiles reads operator profiles from a JSON file holding an array of
+// privacyProfile objects.
+func loadPrivacyProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var profiles []privacyProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i := range profiles {
+		if err := validatePrivacyProfile(&profiles[i]); err != nil {
+			return fmt.Errorf("profile %d in %s: %w", i, path, err)
+		}
+		addPrivacyProfile(profiles[i])
+	}
+	return nil
+}
+
+// preferences returns the site preferences a profile starts from.
+func (profile privacyProfile) preferences() sitePreferences {
+	prefs := sitePreferences{
+		Profile:        profile.Name,
+		ReferrerPolicy: profile.ReferrerPolicy,
+		StripHeaders:   profile.StripHeaders,
+		BlockTrackers:  profile.BlockTrackers,
+	}
+	for _, flag := range sitePreferenceFlags {
+		*flag.Field(&prefs) = profile.Preferences[flag.Key]
+	}
+	prefs.ImagesEnabled = profile.ImagePolicy != "block"
+	switch profile.ImagePolicy {
+	case "shrink":
+		prefs.DataSaverEnabled = true
+	case "click-to-load":
+		prefs.DataSaverEnabled = true
+		prefs.ImagePlaceholders = true
+	}
+	return prefs
+}
+
+// pageSitePreferences returns the preferences of the page a request belongs to,
+// which decide its request-side policies: the target's own (targetPrefs) for
+// navigations. For a load by an element, the page is the document the browser
+// names in the Referer. Any other request names its page only in headers a page
+// script can set (X-Proxy-Client-URL, a fetch referrer) or not at all, so the
+// stricter policies of the target and of that page (or of the user's defaults)
+// apply: a script cannot pick a laxer site's policies to escape its own page's.
+func pageSitePreferences(r *http.Request, userID string, targetPrefs sitePreferences) sitePreferences {
+	if requestIsNavigation(r) {
+		return targetPrefs
+	}
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" && dest != "empty" {
+		if pageURL, ok := targetURLFromProxyPageURL(r.Header.Get("Referer"), r.Host); ok {
+			pagePrefs, _ := effectiveSitePreferences(userID, pageURL.Hostname())
+			return pagePrefs
+		}
+	}
+	namedHost := defaultPreferenceKey
+	if pageURL, _ := resolveNavigationBase(r); pageURL != nil {
+		namedHost = pageURL.Hostname()
+	}
+	namedPrefs, _ := effectiveSitePreferences(userID, namedHost)
+	return stricterRequestPolicies(namedPrefs, targetPrefs)
+}
+
+// referrerPolicyStrictness orders the Referrer-Policy tokens from the one sending
+// the least to the one sending the most.
+var referrerPolicyStrictness = []string{
+	"no-referrer",
+	"same-origin",
+	"strict-origin",
+	"origin",
+	"strict-origin-when-cross-origin",
+	"origin-when-cross-origin",
+	"no-referrer-when-downgrade",
+	"unsafe-url",
+	"",
+}
+
+// stricterRequestPolicies returns prefs with the request-side policies of other
+// merged in where they are stricter: tracker blocking if either blocks, the
+// stricter referrer policy and the headers either strips.
+func stricterRequestPolicies(prefs sitePreferences, other sitePreferences) sitePreferences {
+	prefs.BlockTrackers = prefs.BlockTrackers || other.BlockTrackers
+	for _, policy := range referrerPolicyStrictness {
+		if policy == prefs.ReferrerPolicy {
+			break
+		}
+		if policy == other.ReferrerPolicy {
+			prefs.ReferrerPolicy = policy
+			break
+		}
+	}
+	stripHeaders := append([]string(nil), prefs.StripHeaders...)
+	stripped := make(map[string]bool, len(stripHeaders))
+	for _, header := range stripHeaders {
+		stripped[header] = true
+	}
+	for _, header := range other.StripHeaders {
+		if !stripped[header] {
+			stripHeaders = append(stripHeaders, header)
+		}
+	}
+	prefs.StripHeaders = stripHeaders
+	return prefs
+}
+
+// applyRequestPrivacyPolicies enforces a profile's referrer policy and header
+// stripping on a request prepared by setupOutgoingHeadersForProxy.
+func applyRequestPrivacyPolicies(outReq *http.Request, prefs sitePreferences) {
+	if referer := outReq.Header.Get("Referer"); referer != "" {
+		if trimmed := applyReferrerPolicy(referer, outReq.URL, prefs.ReferrerPolicy); trimmed == "" {
+			outReq.Header.Del("Referer")
+		} else {
+			outReq.Header.Set("Referer", trimmed)
+		}
+	}
+	for name := range outReq.Header {
+		lowerName := strings.ToLower(name)
+		for _, pattern := range prefs.StripHeaders {
+			if lowerName == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(lowerName, strings.TrimSuffix(pattern, "*"))) {
+				outReq.Header.Del(name)
+				break
+			}
+		}
+	}
+}
+
+// applyReferrerPolicy returns the Referer to send from referer to target under a
+// Referrer-Policy token, or "" for none.
+func applyReferrerPolicy(referer string, target *url.URL, policy string) string {
+	refererURL, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	origin := refererURL.Scheme + "://" + refererURL.Host + "/"
+	sameOrigin := refererURL.Scheme == target.Scheme && strings.EqualFold(refererURL.Host, target.Host)
+	downgrade := refererURL.Scheme == "https" && target.Scheme != "https"
+
+	switch policy {
+	case "no-referrer":
+		return ""
+	case "origin":
+		return origin
+	case "same-origin":
+		if sameOrigin {
+			return referer
+		}
+		return ""
+	case "origin-when-cross-origin":
+		if sameOrigin {
+			return referer
+		}
+		return origin
+	case "strict-origin":
+		if downgrade {
+			return ""
+		}
+		return origin
+	case "strict-origin-when-cross-origin":
+		if sameOrigin {
+			return referer
+		}
+		if downgrade {
+			return ""
+		}
+		return origin
+	case "no-referrer-when-downgrade":
+		if downgrade {
+			return ""
+		}
+	}
+	return referer
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	stdhtml "html"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// --- Reader Mode (Readability-style Article Extraction) ---
+
+var (
+	readerUnlikelyRegex = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|cookie|disqus|extra|footer|gdpr|header|legends|menu|modal|nav|newsletter|pager|popup|promo|related|remark|replies|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|subscribe|tags|tool|widget|advert|^ad-|-ad$|\bads?\b`)
+	readerMaybeRegex    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow|story`)
+	readerPositiveRegex = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story`)
+	readerNegativeRegex = regexp.MustCompile(`(?i)hidden|banner|combx|comment|com-|contact|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget|advert`)
+	readerBylineRegex   = regexp.MustCompile(`(?i)byline|author|dateline|writtenby|p-author`)
+)
+
+// readerRemovedTags are never part of an article.
+var readerRemovedTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "link": true, "meta": true,
+	"nav": true, "aside": true, "footer": true, "form": true, "button": true, "input": true,
+	"select": true, "textarea": true, "iframe": true, "frame": true, "object": true, "embed": true,
+	"canvas": true, "dialog": true,
+}
+
+// readerKeptAttrs are the attributes kept on article content, by element.
+var readerKeptAttrs = map[string]map[string]bool{
+	"a":      {"href": true, "title": true},
+	"img":    {"src": true, "srcset": true, "alt": true, "title": true, "width": true, "height": true, "data-proxy-src": true, "data-proxy-srcset": true},
+	"source": {"src": true, "srcset": true, "type": true, "media": true, "data-proxy-srcset": true},
+	"video":  {"src": true, "poster": true, "controls": true},
+	"audio":  {"src": true, "controls": true},
+	"td":     {"colspan": true, "rowspan": true},
+	"th":     {"colspan": true, "rowspan": true},
+	"ol":     {"start": true},
+	"time":   {"datetime": true},
+}
+
+// readerArticle is the result of extracting the main content of a page.
+type readerArticle struct {
+	Title    string
+	Byline   string
+	SiteName string
+	Content  []*html.Node // Detached nodes making up the article body
+}
+
+// nodeText returns the concatenated text content of a node.
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+func nodeAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func nodeHasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkDensity is the share of a node's text that sits inside links.
+func linkDensity(n *html.Node) float64 {
+	textLength := len(nodeText(n))
+	if textLength == 0 {
+		return 0
+	}
+	linkLength := 0
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			linkLength += len(nodeText(n))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return float64(linkLength) / float64(textLength)
+}
+
+// readerClassWeight scores an element's class and id against the positive and
+// negative content patterns.
+func readerClassWeight(n *html.Node) float64 {
+	weight := 0.0
+	for _, value := range []string{nodeAttr(n, "class"), nodeAttr(n, "id")} {
+		if value == "" {
+			continue
+		}
+		if readerNegativeRegex.MatchString(value) {
+			weight -= 25
+		}
+		if readerPositiveRegex.MatchString(value) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+func readerTagWeight(n *html.Node) float64 {
+	switch n.Data {
+	case "article":
+		return 10
+	case "div", "section", "main":
+		return 5
+	case "pre", "td", "blockquote":
+		return 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		return -3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		return -5
+	}
+	return 0
+}
+
+// readerMetadata collects title, byline and site name from the document head
+// (OpenGraph, article and author meta tags, then <title>).
+func readerMetadata(doc *html.Node, pageURL *url.URL) readerArticle {
+	var article readerArticle
+	var documentTitle string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "title":
+				if documentTitle == "" {
+					documentTitle = nodeText(n)
+				}
+			case "meta":
+				key := strings.ToLower(nodeAttr(n, "property") + nodeAttr(n, "name"))
+				content := strings.TrimSpace(nodeAttr(n, "content"))
+				switch key {
+				case "og:title", "twitter:title":
+					if article.Title == "" {
+						article.Title = content
+					}
+				case "author", "article:author", "parsely-author":
+					if article.Byline == "" && !strings.Contains(content, "://") {
+						article.Byline = content
+					}
+				case "og:site_name":
+					article.SiteName = content
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if article.Title == "" {
+		article.Title = documentTitle
+	}
+	if article.SiteName == "" {
+		article.SiteName = strings.TrimPrefix(pageURL.Hostname(), "www.")
+	}
+	return article
+}
+
+// prepareReaderDOM removes elements that cannot be article content and notes a
+// byline found in the body (rel=author, itemprop=author, .byline, ...).
+func prepareReaderDOM(n *html.Node, byline *string) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode {
+			n.RemoveChild(c)
+		} else if c.Type == html.ElementNode {
+			matchString := nodeAttr(c, "class") + " " + nodeAttr(c, "id")
+			isByline := strings.EqualFold(nodeAttr(c, "rel"), "author") || strings.Contains(strings.ToLower(nodeAttr(c, "itemprop")), "author") || readerBylineRegex.MatchString(matchString)
+			if isByline && *byline == "" {
+				if text := nodeText(c); len(text) > 0 && len(text) < 100 {
+					*byline = text
+					n.RemoveChild(c)
+					c = next
+					continue
+				}
+			}
+			isUnlikely := strings.TrimSpace(matchString) != "" && readerUnlikelyRegex.MatchString(matchString) && !readerMaybeRegex.MatchString(matchString) && c.Data != "body" && c.Data != "a"
+			if readerRemovedTags[c.Data] || isUnlikely || nodeHasAttr(c, "hidden") || strings.EqualFold(nodeAttr(c, "aria-hidden"), "true") || strings.EqualFold(nodeAttr(c, "role"), "dialog") {
+				n.RemoveChild(c)
+			} else {
+				prepareReaderDOM(c, byline)
+			}
+		}
+		c = next
+	}
+}
+
+// extractReadableArticle finds the main content of a document by scoring
+// paragraphs and crediting their ancestors, in the manner of Readability. The
+// document is modified. ok is false when no convincing article was found.
+func extractReadableArticle(doc *html.Node, pageURL *url.URL) (*readerArticle, bool) {
+	article := readerMetadata(doc, pageURL)
+	body := findFirstElement(doc, "body")
+	if body == nil {
+		return nil, false
+	}
+	prepareReaderDOM(body, &article.Byline)
+
+	scores := make(map[*html.Node]float64)
+	initCandidate := func(n *html.Node) {
+		if _, seen := scores[n]; !seen {
+			scores[n] = readerTagWeight(n) + readerClassWeight(n)
+		}
+	}
+	var candidates []*html.Node
+	var scoreParagraphs func(*html.Node)
+	scoreParagraphs = func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.Data == "p" || n.Data == "pre" || n.Data == "td" || n.Data == "blockquote") {
+			text := nodeText(n)
+			if len(text) >= 25 {
+				contentScore := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+				ancestor := n.Parent
+				for level := 0; level < 3 && ancestor != nil && ancestor.Type == html.ElementNode; level++ {
+					if _, seen := scores[ancestor]; !seen {
+						candidates = append(candidates, ancestor)
+					}
+					initCandidate(ancestor)
+					switch level {
+					case 0:
+						scores[ancestor] += contentScore
+					case 1:
+						scores[ancestor] += contentScore / 2
+					default:
+						scores[ancestor] += contentScore / 6
+					}
+					ancestor = ancestor.Parent
+				}
+			}
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			scoreParagraphs(c)
+		}
+	}
+	scoreParagraphs(body)
+
+	var topCandidate *html.Node
+	topScore := 0.0
+	for _, candidate := range candidates {
+		score := scores[candidate] * (1 - linkDensity(candidate))
+		scores[candidate] = score
+		if topCandidate == nil || score > topScore {
+			topCandidate, topScore = candidate, score
+		}
+	}
+	if topCandidate == nil || topScore < 20 || len(nodeText(topCandidate)) < 250 {
+		return nil, false
+	}
+
+	// Siblings that score well, or look like article paragraphs, belong to the article too.
+	threshold := math.Max(10, topScore*0.2)
+	var content []*html.Node
+	if topCandidate.Parent == nil {
+		content = append(content, topCandidate)
+	} else {
+		for sibling := topCandidate.Parent.FirstChild; sibling != nil; sibling = sibling.NextSibling {
+			include := sibling == topCandidate
+			if !include && sibling.Type == html.ElementNode {
+				if score, scored := scores[sibling]; scored && score >= threshold {
+					include = true
+				} else if sibling.Data == "p" {
+					text := nodeText(sibling)
+					density := linkDensity(sibling)
+					include = (len(text) > 80 && density < 0.25) || (len(text) > 0 && density == 0 && strings.HasSuffix(text, "."))
+				}
+			}
+			if include {
+				content = append(content, sibling)
+			}
+		}
+	}
+	for _, n := range content {
+		if n.Parent != nil {
+			n.Parent.RemoveChild(n)
+		}
+		cleanReaderContent(n)
+	}
+	article.Content = content
+	return &article, true
+}
+
+// cleanReaderContent strips presentational attributes and leftover empty
+// containers. Lazy-load sources are promoted, since no page script will run.
+func cleanReaderContent(n *html.Node) {
+	if n.Type == html.ElementNode {
+		promoteLazyLoadAttributes(n)
+		kept := n.Attr[:0]
+		for _, attr := range n.Attr {
+			if readerKeptAttrs[n.Data][strings.ToLower(attr.Key)] {
+				kept = append(kept, attr)
+			}
+		}
+		n.Attr = kept
+	}
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		cleanReaderContent(c)
+		if c.Type == html.ElementNode && (c.Data == "div" || c.Data == "span" || c.Data == "section" || c.Data == "p") &&
+			c.FirstChild == nil {
+			n.RemoveChild(c)
+		}
+		c = next
+	}
+}
+
+// withReaderFlag sets the reader query flag on a proxy URL.
+func withReaderFlag(proxyURL string, flag string) string {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return proxyURL
+	}
+	query := parsed.Query()
+	query.Set("reader", flag)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// buildReaderDocument assembles the reader page: proxy styling, title, byline and
+// the extracted content, plus a link to the full page. When reader mode came from
+// the query flag, article links carry the flag along.
+func buildReaderDocument(article *readerArticle, pageURL *url.URL, clientReq *http.Request, blockTrackers bool) (*html.Node, error) {
+	fullPageURL, err := rewriteProxiedURL(pageURL.String(), pageURL, clientReq, blockTrackers)
+	if err != nil {
+		return nil, err
+	}
+	fullPageURL = withReaderFlag(fullPageURL, "0")
+
+	var sb strings.Builder
+	sb.WriteString(`<!DOCTYPE html><html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>`)
+	sb.WriteString(stdhtml.EscapeString(article.Title))
+	sb.WriteString(`</title><style id="proxy-reader-styles">`)
+	sb.WriteString(readerStyleCSSContent)
+	sb.WriteString(`</style></head><body><main id="proxy-reader"><header id="proxy-reader-header"><p id="proxy-reader-site">`)
+	sb.WriteString(stdhtml.EscapeString(article.SiteName))
+	sb.WriteString(`</p><h1>`)
+	sb.WriteString(stdhtml.EscapeString(article.Title))
+	sb.WriteString(`</h1>`)
+	if article.Byline != "" {
+		sb.WriteString(`<p id="proxy-reader-byline">`)
+		sb.WriteString(stdhtml.EscapeString(article.Byline))
+		sb.WriteString(`</p>`)
+	}
+	sb.WriteString(`<a id="proxy-reader-full-page" href="`)
+	sb.WriteString(stdhtml.EscapeString(fullPageURL))
+	sb.WriteString(`">View full page</a></header><article id="proxy-reader-content"></article></main></body></html>`)
+
+	readerDoc, err := html.Parse(strings.NewReader(sb.String()))
+	if err != nil {
+		return nil, err
+	}
+	contentNode := findFirstElement(readerDoc, "article")
+
+	propagateFlag, _ := proxyQueryFlag(clientReq, "reader")
+	proxyPrefix := "://" + clientReq.Host + proxyRequestPath + "?"
+	var flagLinks func(*html.Node)
+	flagLinks = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			for i, attr := range n.Attr {
+				if attr.Key == "href" && strings.Contains(attr.Val, proxyPrefix) {
+					n.Attr[i].Val = withReaderFlag(attr.Val, "1")
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			flagLinks(c)
+		}
+	}
+
+	for _, n := range article.Content {
+		if propagateFlag {
+			flagLinks(n)
+		}
+		contentNode.AppendChild(n)
+	}
+	log.Printf("Reader Mode: Extracted article '%s' from %s", article.Title, pageURL.String())
+	return readerDoc, nil
+}
+
+const readerStyleCSSContent = `
+html { background: #f9fafb; }
+body { margin: 0; color: #1f2937; font: 19px/1.65 Georgia, "Times New Roman", serif; }
+#proxy-reader { max-width: 42rem; margin: 0 auto; padding: 2rem 1.25rem 6rem; }
+#proxy-reader-header { border-bottom: 1px solid #e5e7eb; margin-bottom: 2rem; padding-bottom: 1rem; }
+#proxy-reader-header h1 { font-size: 2rem; line-height: 1.25; margin: 0.25rem 0 0.5rem; }
+#proxy-reader-site, #proxy-reader-byline, #proxy-reader-full-page { font: 14px/1.5 system-ui, -apple-system, sans-serif; color: #6b7280; margin: 0; }
+#proxy-reader-full-page { display: inline-block; margin-top: 0.5rem; color: #1d4ed8; }
+#proxy-reader-content a { color: #1d4ed8; }
+#proxy-reader-content img, #proxy-reader-content video { max-width: 100%; height: auto; }
+#proxy-reader-content pre { overflow-x: auto; background: #f3f4f6; padding: 0.75rem; font-size: 15px; }
+#proxy-reader-content blockquote { border-left: 3px solid #d1d5db; margin-left: 0; padding-left: 1rem; color: #4b5563; }
+#proxy-reader-content table { border-collapse: collapse; }
+#proxy-reader-content td, #proxy-reader-content th { border: 1px solid #e5e7eb; padding: 0.25rem 0.5rem; }
+@media (prefers-color-scheme: dark) {
+    html { background: #111827; }
+    body { color: #e5e7eb; }
+    #proxy-reader-header { border-color: #374151; }
+    #proxy-reader-content a, #proxy-reader-full-page { color: #93c5fd; }
+    #proxy-reader-content pre { background: #1f2937; }
+}
+`
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// --- Rewriter Plugins ---
+//
+// Every proxied request runs through the Rewriter plugins whose host patterns
+// match the target host, in ascending order. The HTML rewriting itself is made of
+// the built-in plugins registered at the bottom of this file; site-specific fixes
+// (cookie banners, paywall overlays, ...) go in their own file with an init()
+// calling RegisterRewriter.
+
+// NodeAction tells the HTML walker what to do after a Rewriter has seen an element.
+type NodeAction int
+
+const (
+	NodeContinue     NodeAction = iota // Keep the element and walk its children
+	NodeSkipChildren                   // Keep the element but do not walk its children
+	NodeRemove                         // Remove the element; later plugins do not see it
+)
+
+// RewriteContext carries the state of one proxied request through the plugin hooks.
+type RewriteContext struct {
+	TargetURL *url.URL      // URL being proxied (the page URL for documents)
+	BaseURL   *url.URL      // Document base URL after <base href>; set for HTML hooks only
+	ClientReq *http.Request // The browser's request to the proxy
+	UserID    string        // requestUserID, resolved once when the request arrived
+	Prefs     sitePreferences
+
+	// Set for HTML hooks only.
+	ScriptNonce       string // CSP nonce for injected <script> elements
+	BlockedCountToken string // Token of the page's blocked request count, for makeInjectedHTML
+	ReaderApplied     bool   // The document has been replaced by the reader view
+	Srcdoc            bool   // The document is an iframe srcdoc inside the page (see rewriteSrcdocValue)
+}
+
+// Rewriter is a plugin hooking into proxying. Embed RewriterBase to implement
+// only the hooks you need.
+type Rewriter interface {
+	// Name identifies the plugin in logs.
+	Name() string
+	// OnRequest may adjust the outgoing request before it is sent upstream.
+	// Returning an error refuses the request with 403 Forbidden.
+	OnRequest(ctx *RewriteContext, outReq *http.Request) error
+	// OnResponseHeaders may adjust the upstream response headers before the proxy
+	// rewrites and copies them.
+	OnResponseHeaders(ctx *RewriteContext, resp *http.Response)
+	// OnNode is called for every element of an HTML document, parents first.
+	OnNode(ctx *RewriteContext, n *html.Node) NodeAction
+	// OnDocument is called once the whole HTML document has been walked and
+	// returns the document to serve (usually doc itself).
+	OnDocument(ctx *RewriteContext, doc *html.Node) *html.Node
+}
+
+// RewriterBase implements every Rewriter hook as a no-op.
+type RewriterBase struct{}
+
+func (RewriterBase) OnRequest(ctx *RewriteContext, outReq *http.Request) error  { return nil }
+func (RewriterBase) OnResponseHeaders(ctx *RewriteContext, resp *http.Response) {}
+func (RewriterBase) OnNode(ctx *RewriteContext, n *html.Node) NodeAction        { return NodeContinue }
+func (RewriterBase) OnDocument(ctx *RewriteContext, doc *html.Node) *html.Node  { return doc }
+
+type registeredRewriter struct {
+	rewriter     Rewriter
+	hostPatterns []string
+	order        int
+}
+
+var registeredRewriters []registeredRewriter
+
+// RegisterRewriter adds a plugin for hosts matching any of hostPatterns: "*" for
+// every host, "example.com" for that host only, "*.example.com" for the domain
+// and its subdomains. Plugins run in ascending order; equal orders run in
+// registration order. Call it from init(), before the server starts.
+func RegisterRewriter(rewriter Rewriter, order int, hostPatterns ...string) {
+	if len(hostPatterns) == 0 {
+		hostPatterns = []string{"*"}
+	}
+	for i, pattern := range hostPatterns {
+		hostPatterns[i] = strings.ToLower(strings.TrimSpace(pattern))
+	}
+	registeredRewriters = append(registeredRewriters, registeredRewriter{rewriter: rewriter, hostPatterns: hostPatterns, order: order})
+	sort.SliceStable(registeredRewriters, func(i, j int) bool {
+		return registeredRewriters[i].order < registeredRewriters[j].order
+	})
+}
+
+// hostMatchesPattern matches a host against a RegisterRewriter host pattern.
+func hostMatchesPattern(host string, pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if domain, isWildcard := strings.CutPrefix(pattern, "*."); isWildcard {
+		return hostMatchesFilterDomain(host, domain)
+	}
+	return host == pattern
+}
+
+// rewritersFor returns the plugins applying to targetURL, in order.
+func rewritersFor(targetURL *url.URL) []Rewriter {
+	host := strings.ToLower(targetURL.Hostname())
+	var matched []Rewriter
+	for _, registered := range registeredRewriters {
+		for _, pattern := range registered.hostPatterns {
+			if hostMatchesPattern(host, pattern) {
+				matched = append(matched, registered.rewriter)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// runRequestHooks passes the outgoing request through the OnRequest hooks.
+func runRequestHooks(ctx *RewriteContext, outReq *http.Request) error {
+	for _, rewriter := range rewritersFor(ctx.TargetURL) {
+		if err := rewriter.OnRequest(ctx, outReq); err != nil {
+			log.Printf("Rewriter %s: Refused request to %s: %v", rewriter.Name(), ctx.TargetURL.String(), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// runResponseHeaderHooks passes the upstream response through the OnResponseHeaders hooks.
+func runResponseHeaderHooks(ctx *RewriteContext, resp *http.Response) {
+	for _, rewriter := range rewritersFor(ctx.TargetURL) {
+		rewriter.OnResponseHeaders(ctx, resp)
+	}
+}
+
+// runHTMLHooks walks doc through the OnNode hooks, then the OnDocument hooks, and
+// returns the document to render.
+func runHTMLHooks(ctx *RewriteContext, doc *html.Node) *html.Node {
+	rewriters := rewritersFor(ctx.TargetURL)
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			skipChildren := false
+			for _, rewriter := range rewriters {
+				action := rewriter.OnNode(ctx, n)
+				if action == NodeRemove {
+					if n.Parent != nil {
+						n.Parent.RemoveChild(n)
+					}
+					return
+				}
+				if action == NodeSkipChildren {
+					skipChildren = true
+				}
+			}
+			if skipChildren {
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			walk(c)
+			c = next
+		}
+	}
+	walk(doc)
+
+	for _, rewriter := range rewriters {
+		doc = rewriter.OnDocument(ctx, doc)
+	}
+	return doc
+}
+
+// --- Built-in Rewriters ---
+
+func init() {
+	RegisterRewriter(scriptRewriter{}, 100)
+	RegisterRewriter(frameRewriter{}, 200)
+	RegisterRewriter(contentClassRewriter{}, 250)
+	RegisterRewriter(attributeRewriter{}, 300)
+	RegisterRewriter(readerModeRewriter{}, 1000)
+	RegisterRewriter(runtimeInjector{}, 1100)
+	RegisterRewriter(filterStylesheetInjector{}, 1200)
+	RegisterRewriter(userContentInjector{}, 1250)
+	RegisterRewriter(proxyUIInjector{}, 1300)
+}
+
+// scriptRewriter neutralises <script> elements when JavaScript is disabled and
+// otherwise proxies their sources and rewrites inline scripts, import maps and
+// speculation rules.
+type scriptRewriter struct{ RewriterBase }
+
+func (scriptRewriter) Name() string { return "script" }
+
+func (scriptRewriter) OnNode(ctx *RewriteContext, n *html.Node) NodeAction {
+	if n.Data != "script" {
+		return NodeContinue
+	}
+	if !ctx.Prefs.JavaScriptEnabled {
+		// Change type to prevent execution and remove content
+		n.Attr = []html.Attribute{{Key: "type", Val: "text/inert-script"}}
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			n.RemoveChild(c)
+			c = next
+		}
+		return NodeSkipChildren
+	}
+
+	// Rewrite src (HTML) or href/xlink:href (SVG) if present
+	scriptType := ""
+	for i, attr := range n.Attr {
+		localName := attrLocalName(attr)
+		if (localName == "src" || localName == "href") && attr.Val != "" {
+			if proxiedURL, err := rewriteProxiedURL(attr.Val, ctx.BaseURL, ctx.ClientReq, ctx.Prefs.BlockTrackers); err == nil && proxiedURL != attr.Val {
+				n.Attr[i].Val = proxiedURL
+			}
+		} else if localName == "type" {
+			scriptType = attr.Val
+		}
+	}
+	isInlineJS := strings.TrimSpace(scriptType) == "" || isJavaScriptMIMEType(scriptType)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.TextNode {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(scriptType), "importmap") {
+			if rewrittenMap, errMap := rewriteImportMap(c.Data, ctx.BaseURL, ctx.ClientReq, ctx.Prefs.BlockTrackers); errMap == nil {
+				c.Data = rewrittenMap
+			} else {
+				log.Printf("HTML Rewrite (Phase 1): Error rewriting import map on %s: %v", ctx.BaseURL.String(), errMap)
+			}
+		} else if strings.EqualFold(strings.TrimSpace(scriptType), "speculationrules") {
+			if rewrittenRules, errRules := rewriteSpeculationRules([]byte(c.Data), ctx.BaseURL, ctx.ClientReq, ctx.Prefs.BlockTrackers); errRules == nil {
+				c.Data = string(rewrittenRules)
+			} else {
+				log.Printf("HTML Rewrite (Phase 1): Error rewriting speculation rules on %s: %v", ctx.BaseURL.String(), errRules)
+			}
+		} else if isInlineJS {
+			// Inline scripts get the same rewriting as script responses.
+			c.Data = rewriteJSImportSpecifiers(c.Data, ctx.BaseURL, ctx.ClientReq, ctx.Prefs.BlockTrackers)
+			if jsRewriteEnabled {
+				c.Data = string(rewriteJavaScriptCached([]byte(c.Data), cacheSite(ctx.ClientReq, ctx.UserID, ctx.TargetURL)))
+			}
+		}
+	}
+	return NodeSkipChildren
+}
+
+// frameRewriter blanks <iframe>/<frame> elements when iframes are disabled and
+// otherwise proxies their src and rewrites their srcdoc document.
+type frameRewriter struct{ RewriterBase }
+
+func (frameRewriter) Name() string { return "frame" }
+
+func (frameRewriter) OnNode(ctx *RewriteContext, n *html.Node) NodeAction {
+	if n.Data != "iframe" && n.Data != "frame" {
+		return NodeContinue
+	}
+	if !ctx.Prefs.IframesEnabled {
+		// If iframes are disabled, set src to about:blank (this also strips srcdoc)
+		n.Attr = []html.Attribute{{Key: "src", Val: "about:blank"}}
+		return NodeContinue
+	}
+	for i, attr := range n.Attr {
+		if strings.ToLower(attr.Key) == "src" && attr.Val != "" {
+			if proxiedURL, err := rewriteProxiedURL(attr.Val, ctx.BaseURL, ctx.ClientReq, ctx.Prefs.BlockTrackers); err == nil && proxiedURL != attr.Val {
+				n.Attr[i].Val = proxiedURL
+			}
+		} else if strings.ToLower(attr.Key) == "srcdoc" {
+			n.Attr[i].Val = rewriteSrcdocValue(attr.Val, ctx)
+		}
+	}
+	return NodeContinue
+}
+
+// attributeRewriter proxies the URL-bearing attributes of every other element,
+// rewrites inline styles, drops event handlers without JavaScript and applies
+// the lazy-load and image placeholder preferences.
+type attributeRewriter struct{ RewriterBase }
+
+func (attributeRewriter) Name() string { return "attributes" }
+
+func (attributeRewriter) OnNode(ctx *RewriteContext, n *html.Node) NodeAction {
+	if n.Data == "script" || n.Data == "iframe" || n.Data == "frame" {
+		return NodeContinue
+	}
+	documentBaseURL, clientReq, prefs := ctx.BaseURL, ctx.ClientReq, ctx.Prefs
+
+	var newAttrs []html.Attribute
+	for _, attr := range n.Attr {
+		currentAttr := attr
+		// Namespace-aware: xlink:href and friends are matched by their local name.
+		attrKeyLower := attrLocalName(currentAttr)
+		attrVal := strings.TrimSpace(currentAttr.Val)
+
+		if n.Data == "base" && attrKeyLower == "href" {
+			continue
+		}
+		if n.Data == "meta" && attrKeyLower == "content" && isMetaRefresh(n) {
+			if rewrittenRefresh, ok := rewriteRefreshValue(currentAttr.Val, documentBaseURL, clientReq, prefs.BlockTrackers); ok {
+				currentAttr.Val = rewrittenRefresh
+			} else {
+				log.Printf("HTML Rewrite (Phase 1): Dropping meta refresh with unproxyable target '%s'", currentAttr.Val)
+				continue
+			}
+		}
+
+		shouldRewrite := false
+		switch attrKeyLower {
+		case "href", "src", "action", "longdesc", "cite", "formaction", "icon", "manifest", "poster", "data", "background":
+			if attrVal != "" {
+				shouldRewrite = true
+			}
+		case "srcset":
+			if attrVal != "" {
+				if newSrcset, changed := rewriteSrcsetValue(attrVal, documentBaseURL, clientReq, prefs.BlockTrackers); changed {
+					currentAttr.Val = newSrcset
+				}
+			}
+		case "style":
+			if attrVal != "" {
+				newStyleVal := rewriteCSSURLsInString(attrVal, documentBaseURL, clientReq, prefs.BlockTrackers)
+				if newStyleVal != attrVal {
+					currentAttr.Val = newStyleVal
+				}
+			}
+		case "target":
+			if strings.ToLower(attrVal) == "_blank" {
+				currentAttr.Val = "_self"
+			}
+		case "integrity", "crossorigin":
+			continue
+		case "altimg": // MathML <math altimg>
+			if n.Namespace == "math" && attrVal != "" {
+				shouldRewrite = true
+			}
+		default:
+			if promoteTo, isLazy := lazyLoadAttributes[attrKeyLower]; isLazy && attrVal != "" && lazyLoadAttributeApplies(n, promoteTo, attrVal) {
+				currentAttr.Val = rewriteLazyLoadValue(attrVal, promoteTo, documentBaseURL, clientReq, prefs.BlockTrackers)
+				break
+			}
+			// SVG presentation attributes may reference external resources via url().
+			if n.Namespace == "svg" && svgURLPresentationAttrs[attrKeyLower] && attrVal != "" {
+				if newVal := rewriteCSSURLsInString(attrVal, documentBaseURL, clientReq, prefs.BlockTrackers); newVal != attrVal {
+					currentAttr.Val = newVal
+				}
+			}
+		}
+
+		if shouldRewrite {
+			if proxiedURL, err := rewriteProxiedURL(attrVal, documentBaseURL, clientReq, prefs.BlockTrackers); err == nil && proxiedURL != attrVal {
+				currentAttr.Val = proxiedURL
+			} else if err != nil {
+				log.Printf("HTML Rewrite (Phase 1): Error proxying URL for attr '%s' val '%s' (base '%s'): %v", attrKeyLower, attrVal, documentBaseURL.String(), err)
+			}
+		}
+
+		if strings.HasPrefix(attrKeyLower, "on") && !prefs.JavaScriptEnabled {
+			continue
+		}
+		newAttrs = append(newAttrs, currentAttr)
+	}
+	n.Attr = newAttrs
+
+	// Without JavaScript no lazy-load library will run, so move the real sources into place.
+	if !prefs.JavaScriptEnabled && promoteLazyLoadAttrs {
+		promoteLazyLoadAttributes(n)
+	}
+	// srcdoc documents lack the click-to-load script (see proxyUIInjector).
+	if prefs.ImagePlaceholders && !ctx.Srcdoc && (n.Data == "img" || (n.Data == "source" && n.Parent != nil && n.Parent.Data == "picture")) {
+		applyImagePlaceholder(n)
+	}
+
+	// Rewrite URLs inside inline <style> blocks.
+	if n.Data == "style" {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				c.Data = rewriteCSSURLsInString(c.Data, documentBaseURL, clientReq, prefs.BlockTrackers)
+			}
+		}
+	}
+	return NodeContinue
+}
+
+// readerModeRewriter replaces the document with the extracted article. Pages
+// without a recognisable article are served normally.
+type readerModeRewriter struct{ RewriterBase }
+
+func (readerModeRewriter) Name() string { return "reader" }
+
+func (readerModeRewriter) OnDocument(ctx *RewriteContext, doc *html.Node) *html.Node {
+	if !ctx.Prefs.ReaderModeEnabled {
+		return doc
+	}
+	article, ok := extractReadableArticle(doc, ctx.TargetURL)
+	if !ok {
+		log.Printf("Reader Mode: No article found on %s. Serving full page.", ctx.TargetURL.String())
+		return doc
+	}
+	readerDoc, err := buildReaderDocument(article, ctx.TargetURL, ctx.ClientReq, ctx.Prefs.BlockTrackers)
+	if err != nil {
+		log.Printf("Reader Mode: Error building reader page for %s: %v", ctx.TargetURL.String(), err)
+		return doc
+	}
+	ctx.ReaderApplied = true
+	return readerDoc
+}
+
+// runtimeInjector adds the runtime shim, which must run before any page script,
+// so it goes first in <head>. When the page is being navigated to, it also gets
+// the initiator token of its site for the runtime's fetch and XHR requests and,
+// with cookies enabled, its script-visible cookies and a token for storing new
+// ones for document.cookie. Other loads of the same HTML (a fetch from another
+// page) get none of these (see requestIsDocumentNavigation).
+type runtimeInjector struct{ RewriterBase }
+
+func (runtimeInjector) Name() string { return "runtime" }
+
+func (runtimeInjector) OnDocument(ctx *RewriteContext, doc *html.Node) *html.Node {
+	if ctx.Prefs.JavaScriptEnabled && !ctx.ReaderApplied {
+		var pageAttrs []html.Attribute
+		if requestIsDocumentNavigation(ctx.ClientReq) {
+			userID := ctx.UserID
+			pageAttrs = append(pageAttrs, html.Attribute{Key: "data-proxy-initiator-token", Val: pageToken(initiatorTokenPurpose, userID, siteOfHost(ctx.TargetURL.Hostname()))})
+			if ctx.Prefs.CookiesEnabled {
+				topLevel := ctx.ClientReq.Header.Get("Sec-Fetch-Dest") == "document"
+				pageAttrs = append(pageAttrs,
+					html.Attribute{Key: "data-proxy-cookies", Val: cookieHeaderValue(matchingCookies(userID, ctx.TargetURL, requestIsCrossSite(ctx.ClientReq, userID, ctx.TargetURL), topLevel, false))},
+					html.Attribute{Key: "data-proxy-cookie-token", Val: pageToken(cookieTokenPurpose, userID, ctx.TargetURL.Hostname())},
+				)
+			}
+		}
+		injectRuntimeScript(doc, ctx.BaseURL, ctx.ScriptNonce, pageAttrs...)
+	}
+	return doc
+}
+
+// filterStylesheetInjector links the cosmetic filter stylesheet.
+type filterStylesheetInjector struct{ RewriterBase }
+
+func (filterStylesheetInjector) Name() string { return "filter-stylesheet" }
+
+func (filterStylesheetInjector) OnDocument(ctx *RewriteContext, doc *html.Node) *html.Node {
+	if activeFilters != nil && ctx.Prefs.BlockTrackers && !ctx.ReaderApplied {
+		injectFilterStylesheet(doc, ctx.TargetURL)
+	}
+	return doc
+}
+
+// proxyUIInjector appends the home button, its script and, on pages navigated to
+// in a top-level window, the toolbar to <body>. The toolbar carries the host's
+// preference token, so it is left out of HTML loaded any other way, such as a
+// fetch from another page. srcdoc documents get none of it: their parent has it.
+type proxyUIInjector struct{ RewriterBase }
+
+func (proxyUIInjector) Name() string { return "proxy-ui" }
+
+func (proxyUIInjector) OnDocument(ctx *RewriteContext, doc *html.Node) *html.Node {
+	if ctx.Srcdoc {
+		return doc
+	}
+	bodyNode := findFirstElement(doc, "body")
+	if bodyNode == nil {
+		log.Println("Warning: <body> tag not found in HTML document. Cannot inject proxy home button or script.")
+		return doc
+	}
+
+	injectedHTML := makeInjectedHTML(ctx.ScriptNonce, ctx.BlockedCountToken)
+	if requestIsNavigation(ctx.ClientReq) && ctx.ClientReq.Header.Get("Sec-Fetch-Dest") == "document" {
+		prefsToken := sitePreferenceToken(ctx.UserID, ctx.TargetURL.Hostname())
+		injectedHTML += makeToolbarHTML(ctx.ScriptNonce, ctx.TargetURL, ctx.Prefs, prefsToken)
+	}
+	parsedNodes, err := html.ParseFragment(strings.NewReader(injectedHTML), bodyNode)
+	if err != nil {
+		log.Printf("ERROR parsing HTML fragment for injection (Phase 2): %v. HTML: %s", err, injectedHTML)
+		return doc
+	}
+	for _, nodeToAdd := range parsedNodes {
+		bodyNode.AppendChild(nodeToAdd)
+	}
+	return doc
+}
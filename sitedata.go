@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// --- Site Data ---
+//
+// The landing page's cookie manager lists what the proxy holds for each site
+// (registrable domain): the cookies in the user's jar and the preference records.
+// Forgetting a site removes both, along with the rewrite cache entries used for
+// it. The browser's HTTP cache cannot be cleared per site, so forgetting a site
+// clears it for the whole proxy origin.
+
+// siteOfHost returns the site a host belongs to: its registrable domain by the
+// Public Suffix List. IP addresses, and hosts that are themselves public
+// suffixes, are their own site.
+func siteOfHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return host
+	}
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return site
+}
+
+// cacheSite returns the site a cached rewrite of targetURL is used for: the page's
+// site, as found by resolveNavigationBase for subresources. Entries used by an
+// incognito session (userID) are recorded under its user ID instead, and dropped
+// when it ends.
+func cacheSite(r *http.Request, userID string, targetURL *url.URL) string {
+	if isIncognitoUserID(userID) {
+		return userID
+	}
+	switch requestDestination(r) {
+	case "", "document", "iframe", "frame":
+	default:
+		if pageURL, _ := resolveNavigationBase(r); pageURL != nil {
+			return siteOfHost(pageURL.Hostname())
+		}
+	}
+	return siteOfHost(targetURL.Hostname())
+}
+
+// siteData is one site in the response to GET /proxy-sitedata.
+type siteData struct {
+	Site        string           `json:"site"`
+	Cookies     []siteDataCookie `json:"cookies"`
+	Preferences []string         `json:"preferences"` // Preference record keys, see preferences.go
+}
+
+// siteDataCookie describes a jar cookie in a site listing. Values are left out:
+// the listing only needs to identify cookies, and HttpOnly ones must not reach
+// any script.
+type siteDataCookie struct {
+	Name     string    `json:"name"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	HostOnly bool      `json:"hostOnly"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"httpOnly"`
+	SameSite string    `json:"sameSite,omitempty"`
+	Expires  time.Time `json:"expires"` // Zero for session cookies
+}
+
+// forgetSiteResult is the response to a forget request: how much was removed.
+type forgetSiteResult struct {
+	Site         string `json:"site"`
+	Cookies      int    `json:"cookies"`
+	Preferences  int    `json:"preferences"`
+	CacheEntries int    `json:"cacheEntries"`
+}
+
+// serveSiteDataAPI manages the current user's cookies and forgets sites. The
+// "site" parameter may be any host; it is reduced to its site.
+//
+//	GET    [?site=<site>]                                 sites with their cookies (without values) and preference records
+//	DELETE ?site=<site>&domain=<d>&path=<p>&name=<n>      delete one cookie
+//	DELETE ?site=<site>                                   delete a site's cookies
+//	DELETE                                                delete every cookie
+//	POST   ?site=<site>                                   forget a site: cookies, preferences and cache entries
+func serveSiteDataAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowSettingsAPIRequest(w, r) {
+		return
+	}
+	userID := requestUserID(r)
+	query := r.URL.Query()
+	site := ""
+	if siteParam := strings.TrimSpace(query.Get("site")); siteParam != "" {
+		site = siteOfHost(siteParam)
+		if !preferenceHostKeyPattern.MatchString(site) && net.ParseIP(strings.Trim(site, "[]")) == nil {
+			http.Error(w, "Invalid 'site' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sites := make(map[string]*siteData)
+		entryFor := func(s string) *siteData {
+			if sites[s] == nil {
+				sites[s] = &siteData{Site: s, Cookies: []siteDataCookie{}, Preferences: []string{}}
+			}
+			return sites[s]
+		}
+		for _, c := range listCookies(userID) {
+			if cookieSite := siteOfHost(c.Domain); site == "" || cookieSite == site {
+				entry := entryFor(cookieSite)
+				entry.Cookies = append(entry.Cookies, siteDataCookie{
+					Name:     c.Name,
+					Domain:   c.Domain,
+					Path:     c.Path,
+					HostOnly: c.HostOnly,
+					Secure:   c.Secure,
+					HttpOnly: c.HttpOnly,
+					SameSite: c.SameSite,
+					Expires:  c.Expires,
+				})
+			}
+		}
+		sitePrefsMu.RLock()
+		var recordKeys []string
+		for key := range sitePrefsByUser[userID] {
+			recordKeys = append(recordKeys, key)
+		}
+		sitePrefsMu.RUnlock()
+		for _, key := range recordKeys {
+			if key == defaultPreferenceKey {
+				continue
+			}
+			if recordSite := siteOfHost(key); site == "" || recordSite == site {
+				entry := entryFor(recordSite)
+				entry.Preferences = append(entry.Preferences, key)
+			}
+		}
+
+		response := make([]*siteData, 0, len(sites))
+		for _, entry := range sites {
+			sort.Slice(entry.Cookies, func(i, j int) bool {
+				a, b := entry.Cookies[i], entry.Cookies[j]
+				return a.Domain+";"+a.Path+";"+a.Name < b.Domain+";"+b.Path+";"+b.Name
+			})
+			sort.Strings(entry.Preferences)
+			response = append(response, entry)
+		}
+		sort.Slice(response, func(i, j int) bool { return response[i].Site < response[j].Site })
+		writeJSONResponse(w, http.StatusOK, response)
+
+	case http.MethodDelete:
+		name := query.Get("name")
+		domain := strings.ToLower(query.Get("domain"))
+		cookiePath := query.Get("path")
+		removed := deleteCookies(userID, func(c *jarCookie) bool {
+			if site != "" && siteOfHost(c.Domain) != site {
+				return false
+			}
+			return name == "" || (c.Name == name && c.Domain == domain && c.Path == cookiePath)
+		})
+		if name != "" && removed == 0 {
+			http.Error(w, "No such cookie", http.StatusNotFound)
+			return
+		}
+		log.Printf("Site Data: Deleted %d cookies (site %q, name %q) for %s", removed, site, name, userID)
+		writeJSONResponse(w, http.StatusOK, forgetSiteResult{Site: site, Cookies: removed})
+
+	case http.MethodPost:
+		if site == "" {
+			http.Error(w, "Missing 'site' parameter", http.StatusBadRequest)
+			return
+		}
+		result := forgetSiteResult{
+			Site:         site,
+			Cookies:      deleteCookies(userID, func(c *jarCookie) bool { return siteOfHost(c.Domain) == site }),
+			Preferences:  forgetSitePreferences(userID, site),
+			CacheEntries: jsRewriteCache.Forget(site) + imageTranscodeCache.Forget(site),
+		}
+		log.Printf("Site Data: Forgot %s for %s: %d cookies, %d preference records, %d cache entries", site, userID, result.Cookies, result.Preferences, result.CacheEntries)
+		w.Header().Set("Clear-Site-Data", `"cache"`)
+		writeJSONResponse(w, http.StatusOK, result)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Server-Side State & Settings APIs ---
+
+// loadStateFile decodes the JSON state file name from dataDir into v. A missing
+// file, or no dataDir, leaves v untouched.
+func loadStateFile(name string, v interface{}) error {
+	if dataDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(dataDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// saveStateFile writes v as JSON to the state file name in dataDir, replacing it
+// atomically. Without a dataDir, state is kept in memory only.
+func saveStateFile(name string, v interface{}) error {
+	if dataDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dataDir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dataDir, name))
+}
+
+// requestUserID identifies the user a request stores data for: the account from
+// requestAccountID or, during an incognito session, that session's own user ID
+// (see incognito.go).
+func requestUserID(r *http.Request) string {
+	accountID := requestAccountID(r)
+	if sessionID, ok := requestIncognitoSession(r, accountID); ok {
+		return incognitoUserID(accountID, sessionID)
+	}
+	return accountID
+}
+
+// requestAccountID identifies the authenticated user making a request, by the
+// email (or subject) claim of the auth cookie. handleAuthCheck has already
+// validated the cookie for every path that reaches the settings APIs.
+func requestAccountID(r *http.Request) string {
+	_, payload, _ := isCFAuthCookieValid(r)
+	return accountIDFromPayload(payload)
+}
+
+func accountIDFromPayload(payload *JWTPayload) string {
+	if payload == nil {
+		return "anonymous"
+	}
+	if payload.Email != "" {
+		return strings.ToLower(payload.Email)
+	}
+	if payload.Subject != "" {
+		return payload.Subject
+	}
+	return "anonymous"
+}
+
+// persistentUsers returns the entries of a per-user store that may be saved,
+// leaving out incognito sessions.
+func persistentUsers[T any](byUser map[string]T) map[string]T {
+	persistent := make(map[string]T, len(byUser))
+	for userID, value := range byUser {
+		if !isIncognitoUserID(userID) {
+			persistent[userID] = value
+		}
+	}
+	return persistent
+}
+
+// settingsTokenHeader carries the landing page's settings token (see
+// handleLandingPage) on every call to the proxy's own JSON APIs.
+const settingsTokenHeader = "X-Proxy-Settings-Token"
+
+// allowSettingsAPIRequest guards the proxy's own JSON APIs. Proxied pages share
+// the proxy's origin, so a request must prove it comes from the landing page by
+// sending the settings token only that page is given; headers showing it came
+// from a proxied page refuse it as well. A proxied site must not be able to read
+// or change the user's settings. Writes a 403 and returns false when refused.
+func allowSettingsAPIRequest(w http.ResponseWriter, r *http.Request) bool {
+	refused := !validPageToken(r.Header.Get(settingsTokenHeader), "settings", requestAccountID(r), "")
+	if r.Header.Get(clientURLHeader) != "" {
+		refused = true
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+		refused = true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if originURL, err := url.Parse(origin); err != nil || originURL.Host != r.Host {
+			refused = true
+		}
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		if refererURL, err := url.Parse(referer); err != nil || refererURL.Host != r.Host || strings.HasPrefix(refererURL.Path, proxyRequestPath) {
+			refused = true
+		}
+	}
+	if refused {
+		log.Printf("Settings API: Refused %s %s (token: %t, Referer: %q, Sec-Fetch-Site: %q)", r.Method, r.URL.Path, r.Header.Get(settingsTokenHeader) != "", r.Header.Get("Referer"), r.Header.Get("Sec-Fetch-Site"))
+		http.Error(w, "Forbidden: settings can only be changed from the proxy home page", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// pageTokenKey signs the tokens that let a proxied page make one kind of change
+// for its own host. A fresh key per process only invalidates pages loaded before
+// a restart.
+var pageTokenKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Error generating page token key: %v", err)
+	}
+	return key
+}()
+
+// pageToken authorises a proxied page on host to use the API named by purpose
+// ("prefs", "cookies") for userID, and for that host only.
+func pageToken(purpose string, userID string, host string) string {
+	mac := hmac.New(sha256.New, pageTokenKey)
+	mac.Write([]byte(purpose + "\n" + userID + "\n" + strings.ToLower(host)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validPageToken checks a token from pageToken.
+func validPageToken(token string, purpose string, userID string, host string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(pageToken(purpose, userID, host)))
+}
+
+// writeJSONResponse sends v as a JSON response.
+func writeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Settings API: Error writing JSON response: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// --- SVG & Namespaced Attribute Rewriting ---
+
+// svgURLPresentationAttrs are SVG presentation attributes whose values may hold
+// url() references to external resources (e.g. fill="url(sprites.svg#grad)").
+var svgURLPresentationAttrs = map[string]bool{
+	"fill":         true,
+	"stroke":       true,
+	"filter":       true,
+	"clip-path":    true,
+	"mask":         true,
+	"marker-start": true,
+	"marker-mid":   true,
+	"marker-end":   true,
+	"cursor":       true,
+}
+
+// svgURLAttrs are attributes (by local name) holding a plain URL in standalone SVG documents.
+var svgURLAttrs = map[string]bool{
+	"href": true,
+	"src":  true,
+}
+
+// attrLocalName returns the lowercased local name of an attribute. The HTML parser
+// already splits xlink:href into namespace and key inside <svg>/<math>, but
+// prefixed names can still appear unadjusted elsewhere.
+func attrLocalName(attr html.Attribute) string {
+	key := strings.ToLower(attr.Key)
+	if attr.Namespace == "" {
+		if idx := strings.IndexByte(key, ':'); idx > 0 && key[:idx] != "xmlns" {
+			return key[idx+1:]
+		}
+	}
+	return key
+}
+
+// escapeXMLText escapes character data for XML output.
+func escapeXMLText(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// escapeXMLAttr escapes a double-quoted XML attribute value, preserving whitespace.
+func escapeXMLAttr(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(s)
+}
+
+func xmlQualifiedName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// svgEntityDeclRegex matches the general entity declarations of a DOCTYPE's
+// internal subset, as in Illustrator exports (<!ENTITY ns_svg "http://...">).
+var svgEntityDeclRegex = regexp.MustCompile(`<!ENTITY\s+([^\s%"']+)\s+(?:"([^"]*)"|'([^']*)')`)
+
+// rewriteSVGDocument rewrites a standalone image/svg+xml document: href/xlink:href
+// and src attributes, url() references in presentation and style attributes, and
+// <style> contents go through the proxy. With JavaScript disabled, <script>
+// elements and on* handlers are dropped. Prefixes are kept as written (RawToken),
+// so the document's namespace declarations stay valid. Parsing is lenient, and
+// entities declared in the DOCTYPE or named like HTML's are expanded, so that an
+// error is rare: callers must not serve a document that failed unrewritten.
+func rewriteSVGDocument(svgBytes []byte, baseURL *url.URL, clientReq *http.Request, prefs sitePreferences) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(svgBytes))
+	decoder.Strict = false
+	decoder.Entity = make(map[string]string, len(xml.HTMLEntity))
+	for name, value := range xml.HTMLEntity {
+		decoder.Entity[name] = value
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(svgBytes))
+	var elementStack []string // Local names of open elements
+	skipDepth := 0            // > 0 while inside a dropped <script>
+
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("SVG parsing error: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			localName := strings.ToLower(t.Name.Local)
+			if skipDepth > 0 || (localName == "script" && !prefs.JavaScriptEnabled) {
+				skipDepth++
+				continue
+			}
+			elementStack = append(elementStack, localName)
+
+			out.WriteString("<" + xmlQualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				attrName := strings.ToLower(attr.Name.Local)
+				attrVal := attr.Value
+				if attr.Name.Space != "xmlns" && !(attr.Name.Space == "" && attrName == "xmlns") {
+					if strings.HasPrefix(attrName, "on") && !prefs.JavaScriptEnabled {
+						continue
+					}
+					switch {
+					case svgURLAttrs[attrName]:
+						if proxiedURL, errProxy := rewriteProxiedURL(attrVal, baseURL, clientReq, prefs.BlockTrackers); errProxy == nil {
+							attrVal = proxiedURL
+						}
+					case attrName == "style" || (attr.Name.Space == "" && svgURLPresentationAttrs[attrName]):
+						attrVal = rewriteCSSURLsInString(attrVal, baseURL, clientReq, prefs.BlockTrackers)
+					}
+				}
+				out.WriteString(" " + xmlQualifiedName(attr.Name) + `="` + escapeXMLAttr(attrVal) + `"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if len(elementStack) > 0 {
+				elementStack = elementStack[:len(elementStack)-1]
+			}
+			out.WriteString("</" + xmlQualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			text := string(t)
+			if len(elementStack) > 0 && elementStack[len(elementStack)-1] == "style" {
+				text = rewriteCSSURLsInString(text, baseURL, clientReq, prefs.BlockTrackers)
+			}
+			out.WriteString(escapeXMLText(text))
+		case xml.Comment:
+			if skipDepth > 0 {
+				continue
+			}
+			out.WriteString("<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			out.WriteString("<?" + t.Target)
+			if len(t.Inst) > 0 {
+				out.WriteString(" " + string(t.Inst))
+			}
+			out.WriteString("?>")
+		case xml.Directive:
+			// The DOCTYPE precedes every reference to its entities.
+			for _, decl := range svgEntityDeclRegex.FindAllStringSubmatch("<!"+string(t)+">", -1) {
+				decoder.Entity[decl[1]] = decl[2] + decl[3]
+			}
+			out.WriteString("<!" + string(t) + ">")
+		}
+	}
+
+	if skipDepth > 0 || len(elementStack) > 0 {
+		log.Printf("SVG Rewrite: Document for %s ended with unclosed elements", baseURL.String())
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	stdhtml "html"
+	"net/url"
+	"strings"
+)
+
+// --- Proxy Toolbar ---
+
+const toolbarStyleCSSContent = `
+#proxy-toolbar {
+    position: fixed !important;
+    top: 0 !important;
+    left: 50% !important;
+    transform: translateX(-50%) !important;
+    max-width: calc(100vw - 16px) !important;
+    z-index: 2147483647 !important;
+    display: flex !important;
+    flex-direction: column !important;
+    align-items: center !important;
+    font: 13px/1.4 -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif !important;
+    color: #111827 !important;
+    text-align: left !important;
+}
+#proxy-toolbar-panel {
+    display: flex !important;
+    flex-wrap: wrap !important;
+    align-items: center !important;
+    gap: 6px 10px !important;
+    padding: 6px 10px !important;
+    background: rgba(255, 255, 255, 0.97) !important;
+    border: 1px solid #d1d5db !important;
+    border-top: none !important;
+    border-radius: 0 0 8px 8px !important;
+    box-shadow: 0 4px 8px rgba(0,0,0,0.15) !important;
+}
+#proxy-toolbar-panel[hidden] {
+    display: none !important;
+}
+#proxy-toolbar input[type="text"] {
+    width: 36em !important;
+    max-width: 60vw !important;
+    padding: 3px 6px !important;
+    border: 1px solid #9ca3af !important;
+    border-radius: 4px !important;
+    background: white !important;
+    color: #111827 !important;
+    font: inherit !important;
+}
+#proxy-toolbar select {
+    padding: 2px 4px !important;
+    border: 1px solid #9ca3af !important;
+    border-radius: 4px !important;
+    background: white !important;
+    color: #111827 !important;
+    font: inherit !important;
+}
+#proxy-toolbar button {
+    padding: 3px 8px !important;
+    border: 1px solid #9ca3af !important;
+    border-radius: 4px !important;
+    background: #f3f4f6 !important;
+    color: #111827 !important;
+    font: inherit !important;
+    cursor: pointer !important;
+}
+#proxy-toolbar button:hover {
+    background: #e5e7eb !important;
+}
+#proxy-toolbar-site {
+    display: inline-flex !important;
+    flex-wrap: wrap !important;
+    gap: 4px 10px !important;
+}
+#proxy-toolbar label {
+    display: inline-flex !important;
+    align-items: center !important;
+    gap: 3px !important;
+    margin: 0 !important;
+    color: #111827 !important;
+    font: inherit !important;
+    white-space: nowrap !important;
+    cursor: pointer !important;
+}
+#proxy-toolbar input[type="checkbox"] {
+    margin: 0 !important;
+    width: auto !important;
+    height: auto !important;
+    appearance: auto !important;
+}
+#proxy-toolbar-handle {
+    margin-top: -1px !important;
+    padding: 0 12px !important;
+    border-top: none !important;
+    border-radius: 0 0 6px 6px !important;
+    opacity: 0.85 !important;
+}
+`
+
+// makeToolbarHTML generates the collapsible toolbar injected at the top of proxied
+// pages: an address bar showing targetURL, a privacy profile selector and per-site
+// toggles for the flags in sitePreferenceFlags (both set per prefs), a "View
+// original" link that reloads the page once in raw mode, and a reset button.
+// Changes update the host's preference record through the preferences API,
+// authorised by prefsToken (see sitePreferenceToken), and take effect by
+// reloading. The script carries scriptNonce.
+func makeToolbarHTML(scriptNonce string, targetURL *url.URL, prefs sitePreferences, prefsToken string) string {
+	host := strings.ToLower(targetURL.Hostname())
+	var sb strings.Builder
+	sb.WriteString(`<style id="proxy-toolbar-styles" type="text/css">`)
+	sb.WriteString(toolbarStyleCSSContent)
+	sb.WriteString(`</style>
+<div id="proxy-toolbar" data-proxy-host="`)
+	sb.WriteString(stdhtml.EscapeString(host))
+	sb.WriteString(`" data-proxy-prefs-token="`)
+	sb.WriteString(stdhtml.EscapeString(prefsToken))
+	sb.WriteString(`">
+<div id="proxy-toolbar-panel" hidden>
+    <input type="text" id="proxy-toolbar-address" value="`)
+	sb.WriteString(stdhtml.EscapeString(targetURL.String()))
+	sb.WriteString(`" spellcheck="false" autocomplete="off" aria-label="Address">
+    <button type="button" id="proxy-toolbar-go">Go</button>
+    <span id="proxy-toolbar-site" title="These settings apply to `)
+	sb.WriteString(stdhtml.EscapeString(host))
+	sb.WriteString(` only">
+    <select id="proxy-toolbar-profile" aria-label="Privacy profile">`)
+	if _, ok := privacyProfiles[prefs.Profile]; !ok {
+		sb.WriteString(`<option value="" selected>Custom</option>`)
+	}
+	for _, name := range privacyProfileOrder {
+		profile := privacyProfiles[name]
+		sb.WriteString(`<option value="`)
+		sb.WriteString(stdhtml.EscapeString(profile.Name))
+		sb.WriteString(`" title="`)
+		sb.WriteString(stdhtml.EscapeString(profile.Description))
+		sb.WriteString(`"`)
+		if profile.Name == prefs.Profile {
+			sb.WriteString(` selected`)
+		}
+		sb.WriteString(`>`)
+		sb.WriteString(stdhtml.EscapeString(profile.Label))
+		sb.WriteString(`</option>`)
+	}
+	sb.WriteString(`</select>`)
+	for _, flag := range sitePreferenceFlags {
+		if flag.Label == "" {
+			continue
+		}
+		sb.WriteString(`
+    <label><input type="checkbox" data-proxy-flag="`)
+		sb.WriteString(flag.Key)
+		sb.WriteString(`"`)
+		if *flag.Field(&prefs) {
+			sb.WriteString(` checked`)
+		}
+		sb.WriteString(`> `)
+		sb.WriteString(flag.Label)
+		sb.WriteString(`</label>`)
+	}
+	sb.WriteString(`
+    </span>
+    <button type="button" id="proxy-toolbar-original" title="Reload this page once without any rewriting">View original</button>
+    <button type="button" id="proxy-toolbar-reset" title="Forget the settings for `)
+	sb.WriteString(stdhtml.EscapeString(host))
+	sb.WriteString(`">Reset</button>
+</div>
+<button type="button" id="proxy-toolbar-handle" title="Show proxy toolbar" aria-expanded="false">&#9662;</button>
+</div>`)
+
+	sb.WriteString(`<script nonce="`)
+	sb.WriteString(stdhtml.EscapeString(scriptNonce))
+	sb.WriteString(`">`)
+	sb.WriteString(`
+(function() {
+    const toolbar = document.getElementById('proxy-toolbar');
+    if (!toolbar) {
+        return;
+    }
+    // Only the top-level page gets a toolbar; frames share the parent's.
+    if (window.top !== window.self) {
+        toolbar.remove();
+        return;
+    }
+    const panel = document.getElementById('proxy-toolbar-panel');
+    const handle = document.getElementById('proxy-toolbar-handle');
+    const address = document.getElementById('proxy-toolbar-address');
+    const prefsURL = '/proxy-prefs?host=' + encodeURIComponent(toolbar.getAttribute('data-proxy-host')) +
+        '&token=' + encodeURIComponent(toolbar.getAttribute('data-proxy-prefs-token'));
+
+    const setExpanded = function(expanded) {
+        panel.hidden = !expanded;
+        handle.textContent = expanded ? '\u25B4' : '\u25BE';
+        handle.title = expanded ? 'Hide proxy toolbar' : 'Show proxy toolbar';
+        handle.setAttribute('aria-expanded', String(expanded));
+        try {
+            localStorage.setItem('proxy-toolbar-expanded', String(expanded));
+        } catch (e) { /* localStorage may be unavailable */ }
+    };
+    let startExpanded = false;
+    try {
+        startExpanded = localStorage.getItem('proxy-toolbar-expanded') === 'true';
+    } catch (e) { /* localStorage may be unavailable */ }
+    setExpanded(startExpanded);
+    handle.addEventListener('click', function() {
+        setExpanded(panel.hidden);
+    });
+
+    // Reloads the current page, dropping one-off reader/raw query flags so the
+    // per-site settings take effect.
+    const reloadPage = function(extraFlag) {
+        const proxyURL = new URL(window.location.href);
+        proxyURL.searchParams.delete('reader');
+        proxyURL.searchParams.delete('raw');
+        if (extraFlag) {
+            proxyURL.searchParams.set(extraFlag, '1');
+        }
+        window.location.href = proxyURL.toString();
+    };
+
+    const navigate = function() {
+        let target = address.value.trim();
+        if (!target) {
+            return;
+        }
+        if (!/^https?:\/\//i.test(target)) {
+            target = 'https://' + target;
+        }
+        window.location.href = '/proxy?url=' + encodeURIComponent(target);
+    };
+    document.getElementById('proxy-toolbar-go').addEventListener('click', navigate);
+    address.addEventListener('keydown', function(event) {
+        if (event.key === 'Enter') {
+            event.preventDefault();
+            navigate();
+        }
+    });
+
+    // Changes this host's preference record, then reloads to apply it.
+    const updatePreferences = function(method, changes) {
+        const options = { method: method, credentials: 'same-origin' };
+        if (changes) {
+            options.headers = { 'Content-Type': 'application/json' };
+            options.body = JSON.stringify(changes);
+        }
+        fetch(prefsURL, options)
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(response.status + ' ' + response.statusText);
+                }
+                reloadPage();
+            })
+            .catch(e => {
+                console.error('Proxy toolbar: Error updating site preferences:', e);
+                alert('Could not update the settings for this site. Reload the page and try again.');
+            });
+    };
+
+    toolbar.querySelectorAll('input[data-proxy-flag]').forEach(function(checkbox) {
+        checkbox.addEventListener('change', function() {
+            const changes = {};
+            changes[checkbox.getAttribute('data-proxy-flag')] = checkbox.checked;
+            updatePreferences('PATCH', changes);
+        });
+    });
+    // Selecting a profile also drops this host's own toggles, so the profile applies as defined.
+    document.getElementById('proxy-toolbar-profile').addEventListener('change', function(event) {
+        const changes = { profile: event.target.value || null };
+        toolbar.querySelectorAll('input[data-proxy-flag]').forEach(function(checkbox) {
+            changes[checkbox.getAttribute('data-proxy-flag')] = null;
+        });
+        updatePreferences('PATCH', changes);
+    });
+    document.getElementById('proxy-toolbar-reset').addEventListener('click', function() {
+        updatePreferences('DELETE');
+    });
+    document.getElementById('proxy-toolbar-original').addEventListener('click', function() {
+        reloadPage('raw');
+    });
+})();
+`)
+	sb.WriteString(`</script>`)
+	return sb.String()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// --- Tracking Parameter Stripping (ClearURLs-style Rules) ---
+
+// urlCleanerProvider is one provider in the ClearURLs rule format: query
+// parameters matching rules are removed from URLs matching urlPattern, rawRules
+// are cut from the URL text, and redirections unwrap redirect wrappers (capture
+// group 1 holds the destination). referralMarketing parameters are kept, as in
+// ClearURLs' default configuration.
+type urlCleanerProvider struct {
+	URLPattern        string   `json:"urlPattern"`
+	CompleteProvider  bool     `json:"completeProvider"`
+	Rules             []string `json:"rules"`
+	RawRules          []string `json:"rawRules"`
+	ReferralMarketing []string `json:"referralMarketing"`
+	Exceptions        []string `json:"exceptions"`
+	Redirections      []string `json:"redirections"`
+}
+
+// compiledURLCleanerProvider is a urlCleanerProvider with its expressions compiled.
+type compiledURLCleanerProvider struct {
+	name             string
+	urlPattern       *regexp.Regexp
+	completeProvider bool
+	rules            []*regexp.Regexp
+	rawRules         []*regexp.Regexp
+	exceptions       []*regexp.Regexp
+	redirections     []*regexp.Regexp
+}
+
+// defaultURLCleanerProviders are used unless URL_CLEANER_RULES names a ClearURLs
+// rules file. "globalRules" applies to every URL.
+var defaultURLCleanerProviders = map[string]urlCleanerProvider{
+	"globalRules": {
+		URLPattern: `.*`,
+		Rules: []string{
+			`utm_[a-z_]*`, `fbclid`, `gclid`, `gclsrc`, `dclid`, `gbraid`, `wbraid`, `msclkid`, `yclid`,
+			`mc_eid`, `mc_cid`, `_ga`, `_gl`, `igshid`, `twclid`, `ttclid`, `li_fat_id`,
+			`_hsenc`, `_hsmi`, `__hs[a-z_]*`, `hsa_[a-z]*`, `mkt_tok`, `oly_anon_id`, `oly_enc_id`,
+			`vero_id`, `vero_conv`, `wickedid`, `rb_clickid`, `s_cid`, `ml_subscriber`, `ml_subscriber_hash`,
+			`_openstat`, `spm`, `scm`, `ncid`, `cmpid`, `soc_src`, `soc_trk`,
+		},
+		Exceptions: []string{
+			`^https?://[^/]*accounts\.google\.[a-z.]+/`,
+			`^https?://[^/]*(?:paypal|stripe)\.com/`,
+		},
+	},
+	"google": {
+		URLPattern: `^https?://(?:[a-z0-9-]+\.)*google\.[a-z.]+/`,
+		Rules:      []string{`ved`, `ei`, `sei`, `gws_rd`, `sa`, `usg`, `cd`, `cad`, `uact`, `sca_esv`, `sca_upv`, `iflsig`, `oq`, `gs_lcp`, `gs_lcrp`, `sclient`, `bih`, `biw`, `rlz`, `sourceid`},
+		Exceptions: []string{`^https?://(?:[a-z0-9-]+\.)*google\.[a-z.]+/(?:recaptcha|maps|_/)`},
+		Redirections: []string{
+			`^https?://(?:[a-z0-9-]+\.)*google\.[a-z.]+/url\?(?:.*&)?(?:q|url)=([^&]+)`,
+		},
+	},
+	"facebook": {
+		URLPattern:   `^https?://(?:[a-z0-9-]+\.)*facebook\.com/`,
+		Rules:        []string{`hc_[a-z_%\[\]0-9]*`, `__tn__`, `eid`, `__xts__(?:\[|%5B)\d(?:\]|%5D)`, `comment_tracking`, `dti`, `app`, `video_source`, `ftentidentifier`, `pageid`, `padding`, `ls_ref`, `action_history`},
+		Redirections: []string{`^https?://lm?\.facebook\.com/l\.php\?(?:.*&)?u=([^&]+)`},
+	},
+	"youtube": {
+		URLPattern:   `^https?://(?:[a-z0-9-]+\.)*(?:youtube\.com|youtu\.be)/`,
+		Rules:        []string{`feature`, `gclid`, `kw`, `pp`},
+		Redirections: []string{`^https?://(?:[a-z0-9-]+\.)*youtube\.com/redirect\?(?:.*&)?q=([^&]+)`},
+	},
+	"amazon": {
+		URLPattern: `^https?://(?:[a-z0-9-]+\.)*amazon(?:\.[a-z]{2,3}){1,2}/`,
+		Rules: []string{
+			`p[fd]_rd_[a-z]*`, `qid`, `srs?`, `__mk_[a-z]{1,3}_[a-z]{1,3}`, `spIA`, `ms3_c`,
+			`refRID`, `colii?d`, `qualifier`, `_encoding`, `smid`, `field-lbr_brands_browse-bin`,
+			`ref_?`, `th`, `sprefix`, `crid`, `keywords`, `cv_ct_[a-z]+`, `linkCode`, `creativeASIN`,
+			`ascsubtag`, `aaxitk`, `hsa_cr_id`, `sb-ci-[a-z]+`, `rnid`, `dchild`, `camp`, `creative`, `s`, `content-id`, `dib`, `dib_tag`, `social_share`, `starsLeft`, `skipTwisterOG`,
+		},
+		RawRules: []string{`/ref=[^/?]*`},
+		Exceptions: []string{
+			`^https?://(?:[a-z0-9-]+\.)*amazon(?:\.[a-z]{2,3}){1,2}/gp/.*?(?:redirector\.html|cart/ajax-update\.html|video/api/)`,
+			`^https?://(?:[a-z0-9-]+\.)*amazon(?:\.[a-z]{2,3}){1,2}/(?:hz/reviews-render/ajax/|message-us\?|s\?)`,
+		},
+	},
+	"twitter": {
+		URLPattern: `^https?://(?:[a-z0-9-]+\.)*(?:twitter\.com|x\.com)/`,
+		Rules:      []string{`(?:ref_?)?src`, `s`, `cn`, `ref_url`, `t`},
+		Exceptions: []string{`^https?://(?:[a-z0-9-]+\.)*(?:twitter\.com|x\.com)/i/redirect`},
+	},
+	"reddit": {
+		URLPattern:   `^https?://(?:[a-z0-9-]+\.)*reddit\.com/`,
+		Rules:        []string{`%24deep_link`, `\$deep_link`, `correlation_id`, `ref_campaign`, `ref_source`, `%243p`, `\$3p`, `%24original_url`, `\$original_url`, `_branch_match_id`, `share_id`},
+		Redirections: []string{`^https?://out\.reddit\.com/.*?\?(?:.*&)?url=([^&]+)`},
+	},
+	"steam": {
+		URLPattern:   `^https?://steamcommunity\.com/`,
+		Redirections: []string{`^https?://steamcommunity\.com/linkfilter/\?(?:.*&)?url=([^&]+)`},
+	},
+	"linkedin": {
+		URLPattern:   `^https?://(?:[a-z0-9-]+\.)*linkedin\.com/`,
+		Rules:        []string{`refId`, `trk`, `li[a-z]{2}`, `trackingId`},
+		Redirections: []string{`^https?://(?:[a-z0-9-]+\.)*linkedin\.com/redir/redirect\?(?:.*&)?url=([^&]+)`},
+	},
+	"duckduckgo": {
+		URLPattern:   `^https?://(?:[a-z0-9-]+\.)*duckduckgo\.com/`,
+		Redirections: []string{`^https?://(?:[a-z0-9-]+\.)*duckduckgo\.com/l/\?(?:.*&)?uddg=([^&]+)`},
+	},
+}
+
+// activeURLCleanerProviders is nil when the URL cleaner is disabled.
+var activeURLCleanerProviders []compiledURLCleanerProvider
+
+// loadURLCleanerRules reads providers from a ClearURLs rules file ({"providers": {...}}).
+func loadURLCleanerRules(path string) (map[string]urlCleanerProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rulesFile struct {
+		Providers map[string]urlCleanerProvider `json:"providers"`
+	}
+	if err := json.Unmarshal(data, &rulesFile); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return rulesFile.Providers, nil
+}
+
+// compileURLCleanerProviders compiles providers, skipping expressions Go's regexp
+// package rejects (ClearURLs rules are written for JavaScript). Providers are
+// sorted by name so globalRules and the rest apply in a stable order.
+func compileURLCleanerProviders(providers map[string]urlCleanerProvider) []compiledURLCleanerProvider {
+	compileAll := func(providerName string, exprs []string, wrap string) []*regexp.Regexp {
+		var compiled []*regexp.Regexp
+		for _, expr := range exprs {
+			re, err := regexp.Compile("(?i)" + fmt.Sprintf(wrap, expr))
+			if err != nil {
+				log.Printf("URL Cleaner: Skipping rule %q of provider %s: %v", expr, providerName, err)
+				continue
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled
+	}
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var compiled []compiledURLCleanerProvider
+	for _, name := range names {
+		provider := providers[name]
+		urlPattern, err := regexp.Compile("(?i)" + provider.URLPattern)
+		if err != nil {
+			log.Printf("URL Cleaner: Skipping provider %s: invalid urlPattern: %v", name, err)
+			continue
+		}
+		compiled = append(compiled, compiledURLCleanerProvider{
+			name:             name,
+			urlPattern:       urlPattern,
+			completeProvider: provider.CompleteProvider,
+			rules:            compileAll(name, provider.Rules, "^(?:%s)$"),
+			rawRules:         compileAll(name, provider.RawRules, "%s"),
+			exceptions:       compileAll(name, provider.Exceptions, "%s"),
+			redirections:     compileAll(name, provider.Redirections, "%s"),
+		})
+	}
+	return compiled
+}
+
+// cleanTrackingURL unwraps known redirect wrappers and strips tracking parameters
+// from an http(s) URL. The query keeps its original order and encoding apart from
+// the removed parameters. blocked is true when the URL belongs to a complete
+// provider (a pure tracking domain) and should not be fetched at all.
+func cleanTrackingURL(u *url.URL) (cleaned *url.URL, blocked bool) {
+	if activeURLCleanerProviders == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return u, false
+	}
+
+	copied := *u
+	current := &copied
+	for depth := 0; depth < 5; depth++ {
+		unwrapped := false
+		urlString := current.String()
+		for _, provider := range activeURLCleanerProviders {
+			if !provider.urlPattern.MatchString(urlString) || matchesAny(provider.exceptions, urlString) {
+				continue
+			}
+			if provider.completeProvider {
+				return current, true
+			}
+			for _, redirection := range provider.redirections {
+				match := redirection.FindStringSubmatch(urlString)
+				if len(match) < 2 {
+					continue
+				}
+				destination, err := url.QueryUnescape(match[1])
+				if err != nil {
+					continue
+				}
+				if target, err := url.Parse(destination); err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != "" {
+					current = target
+					unwrapped = true
+					break
+				}
+			}
+			if unwrapped {
+				break
+			}
+
+			for _, rawRule := range provider.rawRules {
+				urlString = rawRule.ReplaceAllString(urlString, "")
+			}
+			if parsed, err := url.Parse(urlString); err == nil {
+				current = parsed
+			}
+			if len(provider.rules) > 0 && current.RawQuery != "" {
+				current.RawQuery = stripQueryParams(current.RawQuery, provider.rules)
+				if current.RawQuery == "" {
+					current.ForceQuery = false
+				}
+				urlString = current.String()
+			}
+		}
+		if !unwrapped {
+			break
+		}
+	}
+
+	if current.String() != u.String() {
+		log.Printf("URL Cleaner: %s -> %s", u.String(), current.String())
+	}
+	return current, false
+}
+
+func matchesAny(exprs []*regexp.Regexp, s string) bool {
+	for _, re := range exprs {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripQueryParams removes the parameters whose (decoded) name matches one of the rules.
+func stripQueryParams(rawQuery string, rules []*regexp.Regexp) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		if !matchesAny(rules, name) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+// --- User Scripts & User Styles ---
+
+const (
+	userContentStateFile    = "usercontent.json"
+	maxUserContentEntries   = 200 // Per user
+	maxUserContentCodeBytes = 256 << 10
+)
+
+// userContentEntry is a userscript or userstyle injected into pages whose host
+// matches one of Hosts.
+type userContentEntry struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`  // "script" or "style"
+	Hosts    []string `json:"hosts"` // Host patterns, as for RegisterRewriter
+	Code     string   `json:"code"`
+	Enabled  bool     `json:"enabled"`
+	Operator bool     `json:"operator,omitempty"` // From USER_CONTENT_FILE; read-only through the API
+}
+
+// userContentHostPattern matches "*", "example.com" and "*.example.com".
+var userContentHostPattern = regexp.MustCompile(`^(\*|(\*\.)?[a-z0-9-]+(\.[a-z0-9-]+)*)$`)
+
+// userContentEndTags find end tags that would close the injected raw text element early.
+var userContentEndTags = map[string]*regexp.Regexp{
+	"script": regexp.MustCompile(`(?i)</(script)`),
+	"style":  regexp.MustCompile(`(?i)</(style)`),
+}
+
+var (
+	// Operator entries apply to every user.
+	operatorUserContent []userContentEntry
+
+	userContentMu     sync.RWMutex
+	userContentByUser = make(map[string][]userContentEntry) // Persisted to userContentStateFile
+)
+
+// validateUserContentEntry normalises an entry and checks it can be injected safely.
+func validateUserContentEntry(entry *userContentEntry) error {
+	entry.Name = strings.TrimSpace(entry.Name)
+	if entry.Name == "" || len(entry.Name) > 100 {
+		return fmt.Errorf("name must be 1-100 characters")
+	}
+	if entry.Kind != "script" && entry.Kind != "style" {
+		return fmt.Errorf("kind must be \"script\" or \"style\"")
+	}
+	var hosts []string
+	for _, host := range entry.Hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if !userContentHostPattern.MatchString(host) {
+			return fmt.Errorf("invalid host pattern %q", host)
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("at least one host pattern is required")
+	}
+	entry.Hosts = hosts
+	if len(entry.Code) > maxUserContentCodeBytes {
+		return fmt.Errorf("code exceeds %d bytes", maxUserContentCodeBytes)
+	}
+	return nil
+}
+
+// loadOperatorUserContent reads operator-provided entries from a JSON file holding
+// an array of userContentEntry objects. Invalid entries are skipped.
+func loadOperatorUserContent(path string) ([]userContentEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []userContentEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	var valid []userContentEntry
+	for i, entry := range entries {
+		if err := validateUserContentEntry(&entry); err != nil {
+			log.Printf("Warning: USER_CONTENT_FILE entry %d (%q): %v. Skipping.", i, entry.Name, err)
+			continue
+		}
+		entry.ID = fmt.Sprintf("operator-%d", i)
+		entry.Operator = true
+		valid = append(valid, entry)
+	}
+	return valid, nil
+}
+
+// loadUserContentState restores the users' entries from the data directory.
+func loadUserContentState() {
+	userContentMu.Lock()
+	defer userContentMu.Unlock()
+	if err := loadStateFile(userContentStateFile, &userContentByUser); err != nil {
+		log.Printf("Error loading user scripts and styles: %v", err)
+	}
+}
+
+// saveUserContentStateLocked persists the users' entries. userContentMu must be held.
+func saveUserContentStateLocked() {
+	if err := saveStateFile(userContentStateFile, persistentUsers(userContentByUser)); err != nil {
+		log.Printf("Error saving user scripts and styles: %v", err)
+	}
+}
+
+// userContentFor returns the enabled entries applying to host for a user:
+// operator entries first, then the user's own, each in their stored order.
+func userContentFor(userID string, host string) []userContentEntry {
+	host = strings.ToLower(host)
+	userContentMu.RLock()
+	candidates := append(append([]userContentEntry(nil), operatorUserContent...), userContentByUser[userID]...)
+	userContentMu.RUnlock()
+
+	var matched []userContentEntry
+	for _, entry := range candidates {
+		if !entry.Enabled {
+			continue
+		}
+		for _, pattern := range entry.Hosts {
+			if hostMatchesPattern(host, pattern) {
+				matched = append(matched, entry)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// serveUserContentAPI manages the current user's scripts and styles:
+//
+//	GET                 list operator and own entries
+//	POST                create an entry (JSON body), returns it with its ID
+//	PUT    ?id=<id>     replace an entry (JSON body)
+//	DELETE ?id=<id>     delete an entry
+func serveUserContentAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowSettingsAPIRequest(w, r) {
+		return
+	}
+	userID := requestUserID(r)
+
+	if r.Method == http.MethodGet {
+		userContentMu.RLock()
+		entries := append(append([]userContentEntry{}, operatorUserContent...), userContentByUser[userID]...)
+		userContentMu.RUnlock()
+		writeJSONResponse(w, http.StatusOK, entries)
+		return
+	}
+
+	var entry userContentEntry
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUserContentCodeBytes+4096)
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateUserContentEntry(&entry); err != nil {
+			http.Error(w, "Invalid entry: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		entry.Operator = false
+	}
+
+	userContentMu.Lock()
+	defer userContentMu.Unlock()
+	entries := userContentByUser[userID]
+	index := -1
+	if id := r.URL.Query().Get("id"); id != "" {
+		for i := range entries {
+			if entries[i].ID == id {
+				index = i
+				break
+			}
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if len(entries) >= maxUserContentEntries {
+			http.Error(w, fmt.Sprintf("Limit of %d scripts and styles reached", maxUserContentEntries), http.StatusConflict)
+			return
+		}
+		entry.ID = generateSecureNonce()
+		userContentByUser[userID] = append(entries, entry)
+	case http.MethodPut:
+		if index < 0 {
+			http.Error(w, "No such script or style", http.StatusNotFound)
+			return
+		}
+		entry.ID = entries[index].ID
+		entries[index] = entry
+	case http.MethodDelete:
+		if index < 0 {
+			http.Error(w, "No such script or style", http.StatusNotFound)
+			return
+		}
+		entry = entries[index]
+		userContentByUser[userID] = append(entries[:index:index], entries[index+1:]...)
+		if len(userContentByUser[userID]) == 0 {
+			delete(userContentByUser, userID)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	saveUserContentStateLocked()
+	log.Printf("User Content: %s %s %q (%s) for %s", r.Method, entry.Kind, entry.Name, entry.ID, userID)
+	writeJSONResponse(w, http.StatusOK, entry)
+}
+
+// userContentInjector adds the matching userstyles to <head> and userscripts to
+// <body>, next to the proxy UI. Both carry the CSP nonce, so userscripts run even
+// when the site's own JavaScript is disabled.
+type userContentInjector struct{ RewriterBase }
+
+func (userContentInjector) Name() string { return "user-content" }
+
+func (userContentInjector) OnDocument(ctx *RewriteContext, doc *html.Node) *html.Node {
+	if ctx.ReaderApplied {
+		return doc
+	}
+	entries := userContentFor(ctx.UserID, ctx.TargetURL.Hostname())
+	if len(entries) == 0 {
+		return doc
+	}
+	headNode := findFirstElement(doc, "head")
+	bodyNode := findFirstElement(doc, "body")
+	for _, entry := range entries {
+		tag, parent, code := "style", headNode, entry.Code
+		if entry.Kind == "script" {
+			// Each userscript gets its own scope, and a failing one does not stop the others.
+			tag, parent = "script", bodyNode
+			quotedName, _ := json.Marshal("Proxy userscript " + entry.Name + " failed:")
+			code = "(function() {\ntry {\n" + code + "\n} catch (e) { console.error(" + string(quotedName) + ", e); }\n})();"
+		}
+		if parent == nil {
+			parent = bodyNode
+		}
+		if parent == nil {
+			log.Printf("User Content: No <head> or <body> on %s. Cannot inject %q.", ctx.TargetURL.String(), entry.Name)
+			continue
+		}
+		// Raw text elements end at the first matching end tag, so escape any in the code.
+		code = userContentEndTags[tag].ReplaceAllString(code, `<\/$1`)
+		node := &html.Node{
+			Type: html.ElementNode,
+			Data: tag,
+			Attr: []html.Attribute{
+				{Key: "id", Val: "proxy-user" + tag + "-" + entry.ID},
+				{Key: "nonce", Val: ctx.ScriptNonce},
+			},
+		}
+		node.AppendChild(&html.Node{Type: html.TextNode, Data: code})
+		parent.AppendChild(node)
+	}
+	return doc
+}